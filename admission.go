@@ -0,0 +1,81 @@
+package scrimplb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// admissionDelegate rejects nodes which belong to a different cluster, whose
+// name hasn't been verified as a TLS identity at their address or,
+// if join authorisation is configured, which don't present a valid join
+// token. Checks are made both when nodes announce themselves as alive and
+// when clusters merge, before any node reaches the event delegate.
+type admissionDelegate struct {
+	clusterName string
+	joinAuth    *JoinAuthConfig
+	localName   string
+	peers       *peerIdentities
+}
+
+// admit returns an error if the node shouldn't be a member of the cluster
+func (d *admissionDelegate) admit(peer *memberlist.Node) error {
+	if d.peers != nil {
+		err := d.peers.verify(peer.Name, peer.Addr, peer.Port)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	meta, err := parseMetadata(peer)
+
+	if err != nil {
+		return fmt.Errorf("couldn't parse metadata: %w", err)
+	}
+
+	if meta.Cluster != d.clusterName {
+		return fmt.Errorf("node is in cluster '%s', not '%s'", meta.Cluster, d.clusterName)
+	}
+
+	if d.joinAuth != nil {
+		return d.joinAuth.authorise(peer, meta, time.Now())
+	}
+
+	return nil
+}
+
+// NotifyAlive ignores alive messages from nodes which aren't admitted
+func (d *admissionDelegate) NotifyAlive(peer *memberlist.Node) error {
+	if peer.Name == d.localName {
+		return nil
+	}
+
+	err := d.admit(peer)
+
+	if err != nil {
+		log.Printf("rejecting node %s (%s): %v\n", peer.Name, peer.Addr, err)
+		return err
+	}
+
+	return nil
+}
+
+// NotifyMerge cancels a merge if any of the other cluster's nodes aren't
+// admitted. Nodes whose identity hasn't been verified don't cancel the merge,
+// since a joining node has only talked to its seed, but they're still ignored
+// by NotifyAlive until it has been.
+func (d *admissionDelegate) NotifyMerge(peers []*memberlist.Node) error {
+	for _, peer := range peers {
+		err := d.NotifyAlive(peer)
+
+		if err != nil && !errors.Is(err, errUnverifiedPeer) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -7,11 +7,20 @@ import (
 
 // JSONApplication is a helper for loading applications with string slices for Domains
 type JSONApplication struct {
-	Name            string   `json:"name"`
-	ListenPort      string   `json:"listen-port"`
-	ApplicationPort string   `json:"application-port"`
-	Protocol        string   `json:"protocol"`
-	Domains         []string `json:"domains"`
+	Name            string           `json:"name"`
+	ListenPort      string           `json:"listen-port"`
+	ApplicationPort string           `json:"application-port"`
+	Protocol        string           `json:"protocol"`
+	Domains         []string         `json:"domains"`
+	UpstreamTLS     *JSONUpstreamTLS `json:"upstream-tls,omitempty"`
+}
+
+// JSONUpstreamTLS is advertised by a backend for an https application to ask
+// load balancers to verify its certificate, optionally against a given name.
+// Load balancers supply the CA bundle and any client certificate themselves.
+type JSONUpstreamTLS struct {
+	Verify     bool   `json:"verify"`
+	ServerName string `json:"server-name"`
 }
 
 // ToApplication turns a JSON loaded application into an application. This is needed to keep
@@ -22,13 +31,20 @@ func (a *JSONApplication) ToApplication() Application {
 	})
 
 	domainString := strings.Join(a.Domains, " ")
-	return Application{
+	app := Application{
 		Name:            a.Name,
 		ListenPort:      a.ListenPort,
 		ApplicationPort: a.ApplicationPort,
 		Protocol:        a.Protocol,
 		domains:         domainString,
 	}
+
+	if a.UpstreamTLS != nil {
+		app.UpstreamVerify = a.UpstreamTLS.Verify
+		app.UpstreamServerName = a.UpstreamTLS.ServerName
+	}
+
+	return app
 }
 
 // Application is a service running on a backend. A backend will respond
@@ -39,11 +55,16 @@ type Application struct {
 	ApplicationPort string
 	Protocol        string
 	domains         string
+
+	// UpstreamVerify and UpstreamServerName are requested by the backend for
+	// connections from load balancers to an https application
+	UpstreamVerify     bool
+	UpstreamServerName string
 }
 
 // Equal implements an equality check for two Applications
 func (a *Application) Equal(other Application) bool {
-	return a.Name == other.Name && a.ListenPort == other.ListenPort && a.ApplicationPort == other.ApplicationPort && a.Protocol == other.Protocol && a.domains == other.domains
+	return a.Name == other.Name && a.ListenPort == other.ListenPort && a.ApplicationPort == other.ApplicationPort && a.Protocol == other.Protocol && a.domains == other.domains && a.UpstreamVerify == other.UpstreamVerify && a.UpstreamServerName == other.UpstreamServerName
 }
 
 // DomainSlice returns domains as a []string
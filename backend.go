@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/hashicorp/memberlist"
 )
 
 // BackendConfig describes configuration for backend instances
@@ -42,6 +45,10 @@ func initialiseBackendConfig(config *ScrimpConfig) error {
 			return errors.New("applications must have at least one domain")
 		}
 
+		if app.UpstreamTLS != nil && app.Protocol != "https" {
+			return fmt.Errorf("application '%s' sets upstream-tls but its protocol isn't https", app.Name)
+		}
+
 		// TODO: more validation
 	}
 
@@ -53,6 +60,9 @@ func initialiseBackendConfig(config *ScrimpConfig) error {
 type BackendMetadata struct {
 	Type         string            `json:"type"`
 	Applications []JSONApplication `json:"applications"`
+	Token        string            `json:"token,omitempty"`
+	Cluster      string            `json:"cluster,omitempty"`
+	Started      int64             `json:"started,omitempty"`
 }
 
 // BackendDelegate listens for messages from other cluster members requesting
@@ -61,11 +71,15 @@ type BackendDelegate struct {
 	metadata []byte
 }
 
-// NewBackendDelegate creates a BackendDelegate from a channel which receives work tasks
-func NewBackendDelegate(config *BackendConfig) (*BackendDelegate, error) {
+// NewBackendDelegate creates a BackendDelegate advertising the configured
+// applications, cluster name and, optionally, a join token
+func NewBackendDelegate(config *BackendConfig, cluster string, token string) (*BackendDelegate, error) {
 	backendMetadata := BackendMetadata{
 		"backend",
 		config.Applications,
+		token,
+		cluster,
+		time.Now().Unix(),
 	}
 
 	rawMetadata, err := json.Marshal(backendMetadata)
@@ -90,6 +104,10 @@ func NewBackendDelegate(config *BackendConfig) (*BackendDelegate, error) {
 		return nil, fmt.Errorf("couldn't close gzip metadata writer: %w", err)
 	}
 
+	if buf.Len() > memberlist.MetaMaxSize {
+		return nil, fmt.Errorf("compressed backend metadata is %d bytes, more than memberlist's limit of %d; serve fewer applications or domains from this backend", buf.Len(), memberlist.MetaMaxSize)
+	}
+
 	return &BackendDelegate{
 		buf.Bytes(),
 	}, nil
@@ -0,0 +1,44 @@
+package scrimplb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewBackendDelegateMetadataLimit(t *testing.T) {
+	config := &BackendConfig{
+		Applications: []JSONApplication{{
+			Name:            "web",
+			ListenPort:      "443",
+			ApplicationPort: "8443",
+			Protocol:        "https",
+			Domains:         []string{"www.example.com"},
+		}},
+	}
+
+	_, err := NewBackendDelegate(config, "prod", "")
+
+	if err != nil {
+		t.Fatalf("expected small metadata to be accepted but got: %v", err)
+	}
+
+	// random domains don't compress, so these can't fit in 512 bytes
+	for i := 0; i < 32; i++ {
+		label := make([]byte, 16)
+
+		_, err = rand.Read(label)
+
+		if err != nil {
+			t.Fatalf("couldn't generate domain: %v", err)
+		}
+
+		config.Applications[0].Domains = append(config.Applications[0].Domains, hex.EncodeToString(label)+".example.com")
+	}
+
+	_, err = NewBackendDelegate(config, "prod", "")
+
+	if err == nil {
+		t.Fatal("expected metadata over memberlist's limit to be rejected")
+	}
+}
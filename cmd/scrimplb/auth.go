@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sgtcodfish/scrimplb"
+)
+
+const authUsage = `usage: scrimplb auth COMMAND [OPTIONS]
+
+Creates keys and tokens for authorising nodes to join a cluster.
+
+commands:
+  keygen        print a new signing key pair; the public key goes in
+                "join-auth" or "keyring-operator-keys" config and the
+                private key should be kept offline
+  issue         print a join token for a node, to be set as "auth-token"
+
+options for issue:
+`
+
+// runAuthCommand handles the "auth" subcommand and returns an exit code
+func runAuthCommand(args []string) int {
+	issueFlags := flag.NewFlagSet("issue", flag.ContinueOnError)
+
+	var privateKeyFile, identity, node, domains string
+	var loadBalancer bool
+	var ttl time.Duration
+
+	issueFlags.StringVar(&privateKeyFile, "private-key-file", "", "File containing the base64 encoded private key from 'auth keygen'")
+	issueFlags.StringVar(&identity, "identity", "", "Name of the token holder")
+	issueFlags.StringVar(&node, "node", "", "Name of the node the token is for, as given in its TLS certificate")
+	issueFlags.StringVar(&domains, "domains", "", "Comma-separated domains the holder may serve, e.g. 'app.example.com,*.example.org'")
+	issueFlags.BoolVar(&loadBalancer, "lb", false, "Allow the holder to join as a load balancer")
+	issueFlags.DurationVar(&ttl, "ttl", 0, "How long the token is valid for; forever if zero")
+
+	usage := func() {
+		fmt.Fprint(os.Stderr, authUsage)
+		issueFlags.PrintDefaults()
+	}
+
+	issueFlags.Usage = usage
+
+	if len(args) == 0 {
+		usage()
+		return exitFailure
+	}
+
+	switch args[0] {
+	case "keygen":
+		publicKey, privateKey, err := scrimplb.GenerateJoinAuthKey()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+		fmt.Println("public:", publicKey)
+		fmt.Println("private:", privateKey)
+		return exitSuccess
+
+	case "issue":
+		err := issueFlags.Parse(args[1:])
+
+		if err != nil {
+			return exitFailure
+		}
+
+		if privateKeyFile == "" || node == "" {
+			usage()
+			return exitFailure
+		}
+
+		privateKey, err := ioutil.ReadFile(privateKeyFile)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+		claims := scrimplb.JoinClaims{
+			Identity:     identity,
+			Node:         node,
+			LoadBalancer: loadBalancer,
+		}
+
+		if domains != "" {
+			claims.Domains = strings.Split(domains, ",")
+		}
+
+		if ttl > 0 {
+			claims.Expires = time.Now().Add(ttl).UTC()
+		}
+
+		token, err := scrimplb.IssueJoinToken(string(privateKey), claims)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+		fmt.Println(token)
+		return exitSuccess
+
+	default:
+		usage()
+		return exitFailure
+	}
+}
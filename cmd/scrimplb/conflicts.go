@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sgtcodfish/scrimplb"
+)
+
+const conflictsUsage = `usage: scrimplb [-config-file FILE] conflicts
+
+Lists the domain conflicts found on the last generator run of the local load
+balancer, through its control socket.
+`
+
+// runConflictsCommand handles the "conflicts" subcommand and returns an exit
+// code
+func runConflictsCommand(configFile string, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprint(os.Stderr, conflictsUsage)
+		return exitFailure
+	}
+
+	socketPath, err := readControlSocket(configFile)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	result, err := scrimplb.ConflictsRequest(socketPath)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if len(result.Conflicts) == 0 {
+		fmt.Println("no domain conflicts")
+		return exitSuccess
+	}
+
+	for _, conflict := range result.Conflicts {
+		fmt.Printf("%s:%s allowed: %s; excluded: %s\n", conflict.Domain, conflict.ListenPort, describeNames(conflict.Allowed), describeNames(conflict.Excluded))
+	}
+
+	return exitSuccess
+}
+
+func describeNames(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/sgtcodfish/scrimplb"
+)
+
+const keysUsage = `usage: scrimplb [-config-file FILE] keys [-private-key-file FILE] COMMAND [KEY]
+
+Manages the gossip encryption keyring of a running cluster through the
+control socket of the local node. Changes are signed with the operator key
+in -private-key-file and sent to every other member, each of which applies
+them only if the matching public key is in its "keyring-operator-keys".
+
+commands:
+  generate      print a new random key
+  list          list keys installed on the local node
+  install KEY   add KEY to every node's keyring
+  use KEY       make KEY the primary encryption key on every node
+  remove KEY    remove KEY from every node's keyring
+
+To rotate keys: install the new key, use it, then remove the old key.
+Operator keys are made with 'scrimplb auth keygen'.
+`
+
+// runKeysCommand handles the "keys" subcommand and returns an exit code
+func runKeysCommand(configFile string, args []string) int {
+	keysFlags := flag.NewFlagSet("keys", flag.ContinueOnError)
+	keysFlags.Usage = func() { fmt.Fprint(os.Stderr, keysUsage) }
+
+	var privateKeyFile string
+
+	keysFlags.StringVar(&privateKeyFile, "private-key-file", "", "File containing the base64 encoded operator private key from 'auth keygen'")
+
+	err := keysFlags.Parse(args)
+
+	if err != nil {
+		return exitFailure
+	}
+
+	args = keysFlags.Args()
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, keysUsage)
+		return exitFailure
+	}
+
+	op := args[0]
+
+	if op == "generate" {
+		key, err := scrimplb.GenerateEncryptionKey()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+		fmt.Println(key)
+		return exitSuccess
+	}
+
+	var change string
+
+	switch op {
+	case scrimplb.KeyringOpList:
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, keysUsage)
+			return exitFailure
+		}
+
+	case scrimplb.KeyringOpInstall, scrimplb.KeyringOpUse, scrimplb.KeyringOpRemove:
+		if len(args) != 2 || privateKeyFile == "" {
+			fmt.Fprint(os.Stderr, keysUsage)
+			return exitFailure
+		}
+
+		privateKey, err := ioutil.ReadFile(privateKeyFile)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+		change, err = scrimplb.SignKeyringChange(string(privateKey), op, args[1])
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, keysUsage)
+		return exitFailure
+	}
+
+	socketPath, err := readControlSocket(configFile)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	result, err := scrimplb.KeyringRequest(socketPath, change)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	for _, k := range result.Keys {
+		if k == result.PrimaryKey {
+			fmt.Println(k, "(primary)")
+		} else {
+			fmt.Println(k)
+		}
+	}
+
+	if op == scrimplb.KeyringOpList {
+		return exitSuccess
+	}
+
+	// other nodes apply the change after it's delivered, so this can't say
+	// whether they accepted it
+	others := result.Delivered - 1
+	fmt.Printf("applied '%s' locally and delivered it to %d of %d other nodes; check their keys with 'keys list'\n", op, others, others+len(result.Errors))
+
+	if len(result.Errors) == 0 {
+		return exitSuccess
+	}
+
+	var names []string
+	for name := range result.Errors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, " - %s: %s\n", name, result.Errors[name])
+	}
+
+	return exitFailure
+}
+
+// readControlSocket reads only the control socket path from the config file,
+// so that a running node can be managed without initialising providers or
+// resolvers
+func readControlSocket(configFile string) (string, error) {
+	data, err := ioutil.ReadFile(configFile)
+
+	if err != nil {
+		return "", err
+	}
+
+	var config struct {
+		ControlSocket string `json:"control-socket"`
+	}
+
+	err = json.Unmarshal(data, &config)
+
+	if err != nil {
+		return "", fmt.Errorf("couldn't parse config file: %w", err)
+	}
+
+	if config.ControlSocket == "" {
+		return "", errors.New("no control-socket set in config file")
+	}
+
+	return config.ControlSocket, nil
+}
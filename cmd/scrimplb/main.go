@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/sgtcodfish/scrimplb"
+)
+
+const (
+	// exitSuccess is returned after a clean shutdown
+	exitSuccess = iota
+
+	// exitFailure is returned if scrimplb couldn't start
+	exitFailure
 
-	"github.com/hashicorp/memberlist"
+	// exitShutdownFailure is returned if scrimplb couldn't cleanly leave the
+	// cluster or tidy up after itself when shutting down
+	exitShutdownFailure
 )
 
 func main() {
@@ -22,6 +34,17 @@ func main() {
 	flag.BoolVar(&shouldEnumerateNetwork, "enumerate-network", false, "Print all detected addresses")
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "keys":
+		os.Exit(runKeysCommand(configFile, flag.Args()[1:]))
+
+	case "auth":
+		os.Exit(runAuthCommand(flag.Args()[1:]))
+
+	case "conflicts":
+		os.Exit(runConflictsCommand(configFile, flag.Args()[1:]))
+	}
+
 	if shouldEnumerateNetwork {
 		enumerateNetworkInterfaces()
 	}
@@ -29,164 +52,65 @@ func main() {
 	config, err := scrimplb.LoadScrimpConfig(configFile)
 	handleErr(err)
 
-	memberlistConfig := memberlist.DefaultLANConfig()
-
-	memberlistConfig.BindAddr = config.BindAddress
-	memberlistConfig.BindPort = config.Port
-	// we tweak some timeouts to reasonably minimise the time between
-	// a node being suspected to being declared dead - otherwise we have ~15s
-	// after a node dies where we might still route traffic to it
-	memberlistConfig.TCPTimeout = 5 * time.Second
-	memberlistConfig.SuspicionMult = 2
-	memberlistConfig.SuspicionMaxTimeoutMult = 3
-	memberlistConfig.RetransmitMult = 2
-
-	if config.IsLoadBalancer {
-		delegate, err := scrimplb.NewLoadBalancerDelegate(make(chan<- string))
-		handleErr(err)
+	// metrics from scrimplb and memberlist are dumped to stderr on SIGUSR1
+	metricsSink := metrics.NewInmemSink(10*time.Second, time.Minute)
+	metrics.DefaultInmemSignal(metricsSink)
 
-		memberlistConfig.Delegate = delegate
+	metricsConfig := metrics.DefaultConfig("")
+	metricsConfig.EnableHostname = false
 
-		upstreamNotificationChannel := make(chan *scrimplb.LoadBalancerState)
-		eventDelegate := scrimplb.NewLoadBalancerEventDelegate(upstreamNotificationChannel)
-		memberlistConfig.Events = &eventDelegate
-
-		go handleUpstreamNotification(config, upstreamNotificationChannel)
+	_, err = metrics.NewGlobal(metricsConfig, metricsSink)
+	handleErr(err)
 
-		upstreamNotificationChannel <- &scrimplb.LoadBalancerState{}
-	} else {
-		delegate, err := scrimplb.NewBackendDelegate(config.BackendConfig)
-		handleErr(err)
+	node, err := scrimplb.New(config)
+	handleErr(err)
 
-		memberlistConfig.Delegate = delegate
-	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	list, err := memberlist.Create(memberlistConfig)
-	handleErr(err)
+	startCtx, cancelStart := context.WithCancel(context.Background())
+	startupSignal := make(chan os.Signal, 1)
 
-	localNode := list.LocalNode()
-	log.Println("listening as", localNode.Name, localNode.Addr)
-
-	if config.ProviderName == "" {
-		log.Printf("Warning: No provider given; this node may be orphaned")
-	} else {
-		log.Printf("joining cluster with provider '%s'\n", config.ProviderName)
-
-		initSuccessful := false
-		var err error
-		// retry multiple times as we could be hitting a race condition during init on system boot
-		for i := 0; i < 3; i++ {
-			err = initFromSeed(list, config)
-
-			if err == nil {
-				initSuccessful = true
-				break
-			} else {
-				log.Printf("attempt %d to initialise from seed failed: %v\n", i, err)
-				time.Sleep(time.Second * 5)
-			}
-		}
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %v during startup, aborting\n", sig)
+			cancelStart()
+			// passed on in case startup completed anyway
+			startupSignal <- sig
 
-		if !initSuccessful {
-			handleErr(fmt.Errorf("failed to initialise from seed: %w", err))
+		case <-startCtx.Done():
 		}
-	}
-
-	if config.IsLoadBalancer {
-		err = initLoadBalancer(config)
-	} else {
-		err = initBackend(config)
-	}
+	}()
 
+	err = node.Start(startCtx)
+	cancelStart()
 	handleErr(err)
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	wg.Wait()
-}
-
-func initLoadBalancer(config *scrimplb.ScrimpConfig) error {
-	log.Println("initializing load balancer")
-
-	err := initPusher(config)
+	var sig os.Signal
 
-	if err != nil {
-		return err
+	select {
+	case sig = <-signals:
+	case sig = <-startupSignal:
 	}
 
-	return nil
-}
-
-func initBackend(config *scrimplb.ScrimpConfig) error {
-	log.Println("initializing backend")
-	return nil
-}
-
-func initFromSeed(list *memberlist.Memberlist, config *scrimplb.ScrimpConfig) error {
-	seedList, err := config.Provider.FetchSeed()
-
-	if err != nil {
-		return fmt.Errorf("failed to fetch seed during initialization: %w", err)
-	}
+	log.Printf("received %v, shutting down\n", sig)
 
-	var ips []string
-	for _, s := range seedList.Seeds {
-		ips = append(ips, s.Address+":"+s.Port)
-	}
+	// a second signal skips the graceful shutdown entirely
+	go func() {
+		sig := <-signals
+		log.Printf("received %v during shutdown, exiting immediately\n", sig)
+		os.Exit(exitShutdownFailure)
+	}()
 
-	_, err = list.Join(ips)
+	err = node.Stop(context.Background())
 
 	if err != nil {
-		return fmt.Errorf("couldn't join cluster: %w", err)
+		log.Println(err)
+		os.Exit(exitShutdownFailure)
 	}
 
-	return nil
-}
-
-func initPusher(config *scrimplb.ScrimpConfig) error {
-	if config.ProviderName == "" {
-		log.Println("not starting pusher as no provider given")
-		return nil
-	}
-
-	log.Printf("initializing '%s' pusher", config.ProviderName)
-	pushTask := scrimplb.NewPushTask(config)
-	go pushTask.Loop()
-
-	return nil
-}
-
-func handleUpstreamNotification(config *scrimplb.ScrimpConfig, ch <-chan *scrimplb.LoadBalancerState) {
-	for {
-		time.Sleep(5 * time.Second)
-		val := <-ch
-		txt, err := config.LoadBalancerConfig.Generator.GenerateConfig(val.MemberMap, config)
-
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		if config.LoadBalancerConfig.GeneratorPrintStdout {
-			fmt.Println(txt)
-		}
-
-		if config.LoadBalancerConfig.GeneratorTarget != "" {
-			err = ioutil.WriteFile(config.LoadBalancerConfig.GeneratorTarget, []byte(txt), 0664)
-
-			if err != nil {
-				log.Printf("couldn't write config file: %v\n", err)
-				continue
-			}
-
-			err := config.LoadBalancerConfig.Generator.HandleRestart()
-
-			if err != nil {
-				log.Printf("couldn't restart after writing generated config: %v\n", err)
-				continue
-			}
-		}
-	}
+	os.Exit(exitSuccess)
 }
 
 func enumerateNetworkInterfaces() {
@@ -207,6 +131,7 @@ func enumerateNetworkInterfaces() {
 
 func handleErr(err error) {
 	if err != nil {
-		panic(err)
+		log.Printf("fatal error: %v\n", err)
+		os.Exit(exitFailure)
 	}
 }
@@ -5,3 +5,7 @@ const DefaultPort = "9999"
 
 // DefaultKey is the default key used in pushers/seed providers when no other is provided
 const DefaultKey = "scrimplb"
+
+// DefaultSeedTTL is the default time after which a seed which hasn't been
+// re-pushed is considered stale and is pruned by seed providers
+const DefaultSeedTTL = "10m"
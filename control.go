@@ -0,0 +1,274 @@
+package scrimplb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const controlTimeout = 30 * time.Second
+
+// controlRequest is sent over the control socket, and holds exactly one
+// request
+type controlRequest struct {
+	Keyring   *keyringRequest   `json:"keyring,omitempty"`
+	Conflicts *conflictsRequest `json:"conflicts,omitempty"`
+}
+
+// keyringRequest applies a keyring change signed with SignKeyringChange across
+// the cluster, or lists the node's keys if Change is empty
+type keyringRequest struct {
+	Change string `json:"change,omitempty"`
+}
+
+// conflictsRequest asks a load balancer for its current domain conflicts
+type conflictsRequest struct{}
+
+// controlResponse is returned over the control socket
+type controlResponse struct {
+	Keyring   *KeyringResult   `json:"keyring,omitempty"`
+	Conflicts *ConflictsResult `json:"conflicts,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// ConflictsResult lists the domain conflicts found on a load balancer's last
+// generator run
+type ConflictsResult struct {
+	Conflicts []ConflictSummary `json:"conflicts"`
+}
+
+// ConflictSummary describes a domain conflict by application name
+type ConflictSummary struct {
+	Domain     string   `json:"domain"`
+	ListenPort string   `json:"listen-port"`
+	Allowed    []string `json:"allowed"`
+	Excluded   []string `json:"excluded"`
+}
+
+func newConflictsResult(conflicts []DomainConflict) *ConflictsResult {
+	result := &ConflictsResult{}
+
+	for _, conflict := range conflicts {
+		summary := ConflictSummary{
+			Domain:     conflict.Domain,
+			ListenPort: conflict.ListenPort,
+		}
+
+		for _, app := range conflict.Allowed {
+			summary.Allowed = append(summary.Allowed, app.Name)
+		}
+
+		for _, app := range conflict.Excluded {
+			summary.Excluded = append(summary.Excluded, app.Name)
+		}
+
+		result.Conflicts = append(result.Conflicts, summary)
+	}
+
+	return result
+}
+
+// controlServer accepts keyring and conflict requests from the scrimplb CLI on
+// a unix socket, which is only accessible to local users with permission to
+// the socket path
+type controlServer struct {
+	node     *Node
+	path     string
+	listener net.Listener
+	done     chan struct{}
+}
+
+func startControlServer(node *Node, path string) (*controlServer, error) {
+	// remove a stale socket left behind by an unclean shutdown
+	err := os.Remove(path)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("couldn't remove stale control socket: %w", err)
+	}
+
+	// the socket is created in a private directory and only moved into place
+	// once its permissions are restricted, so that there's no window in which
+	// another user could connect to it
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".scrimplb-control")
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create directory for control socket: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "control.sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on control socket: %w", err)
+	}
+
+	// the socket is removed by its final path in Close instead
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, 0600)
+
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("couldn't set permissions on control socket: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("couldn't move control socket into place: %w", err)
+	}
+
+	server := &controlServer{
+		node:     node,
+		path:     path,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	go server.serve()
+
+	return server, nil
+}
+
+func (s *controlServer) serve() {
+	defer close(s.done)
+
+	for {
+		conn, err := s.listener.Accept()
+
+		if err != nil {
+			// the listener is closed on shutdown
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	err := conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err != nil {
+		log.Printf("couldn't set control connection deadline: %v\n", err)
+		return
+	}
+
+	var request controlRequest
+	var response controlResponse
+
+	err = json.NewDecoder(conn).Decode(&request)
+
+	if err != nil {
+		response.Error = fmt.Sprintf("couldn't parse request: %v", err)
+	} else {
+		switch {
+		case request.Keyring != nil && request.Keyring.Change != "":
+			response.Keyring, err = s.node.ChangeKeyring(request.Keyring.Change)
+
+		case request.Keyring != nil:
+			response.Keyring, err = s.node.ListKeys()
+
+		case request.Conflicts != nil:
+			response.Conflicts = newConflictsResult(s.node.Conflicts())
+
+		default:
+			err = errors.New("empty control request")
+		}
+
+		if err != nil {
+			response.Error = err.Error()
+		}
+	}
+
+	err = json.NewEncoder(conn).Encode(response)
+
+	if err != nil {
+		log.Printf("couldn't write control response: %v\n", err)
+	}
+}
+
+func (s *controlServer) Close() error {
+	err := s.listener.Close()
+	<-s.done
+
+	removeErr := os.Remove(s.path)
+
+	if err == nil && removeErr != nil && !os.IsNotExist(removeErr) {
+		err = fmt.Errorf("couldn't remove control socket: %w", removeErr)
+	}
+
+	return err
+}
+
+// KeyringRequest asks the node listening on the given control socket to apply
+// a change signed with SignKeyringChange across the cluster. An empty change
+// lists the node's keys instead.
+func KeyringRequest(socketPath string, change string) (*KeyringResult, error) {
+	response, err := sendControlRequest(socketPath, controlRequest{Keyring: &keyringRequest{change}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Keyring, nil
+}
+
+// ConflictsRequest asks the load balancer listening on the given control
+// socket for the domain conflicts found on its last generator run
+func ConflictsRequest(socketPath string) (*ConflictsResult, error) {
+	response, err := sendControlRequest(socketPath, controlRequest{Conflicts: &conflictsRequest{}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Conflicts, nil
+}
+
+func sendControlRequest(socketPath string, request controlRequest) (*controlResponse, error) {
+	conn, err := net.DialTimeout("unix", socketPath, controlTimeout)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to control socket: %w", err)
+	}
+
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.NewEncoder(conn).Encode(request)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't send control request: %w", err)
+	}
+
+	var response controlResponse
+
+	err = json.NewDecoder(conn).Decode(&response)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read control response: %w", err)
+	}
+
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	return &response, nil
+}
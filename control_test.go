@@ -0,0 +1,72 @@
+package scrimplb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlServerSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scrimplb.sock")
+
+	server, err := startControlServer(&Node{config: &ScrimpConfig{}}, path)
+
+	if err != nil {
+		t.Fatalf("couldn't start control server: %v", err)
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatalf("couldn't stat control socket: %v", err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a socket with mode 0600 but got %v", info.Mode())
+	}
+
+	_, err = KeyringRequest(path, "change")
+
+	if err == nil || err.Error() != "node hasn't been started" {
+		t.Errorf("expected the node's error to be returned over the socket but got %v", err)
+	}
+
+	server.node.conflictsLock.Lock()
+	server.node.conflicts = []DomainConflict{{
+		Domain:     "www.example.com",
+		ListenPort: "443",
+		Allowed:    []Application{{Name: "web"}},
+		Excluded:   []Application{{Name: "imposter"}},
+	}}
+	server.node.conflictsLock.Unlock()
+
+	result, err := ConflictsRequest(path)
+
+	if err != nil {
+		t.Fatalf("couldn't request conflicts: %v", err)
+	}
+
+	conflicts := result.Conflicts
+
+	if len(conflicts) != 1 || conflicts[0].Domain != "www.example.com" || conflicts[0].Allowed[0] != "web" || conflicts[0].Excluded[0] != "imposter" {
+		t.Errorf("unexpected conflicts %+v", conflicts)
+	}
+
+	err = server.Close()
+
+	if err != nil {
+		t.Fatalf("couldn't close control server: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		t.Fatalf("couldn't list socket directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		t.Errorf("expected nothing to be left behind but found %s", entry.Name())
+	}
+}
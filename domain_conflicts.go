@@ -0,0 +1,295 @@
+package scrimplb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DomainConflictFirstSeen keeps the application whose backends the load
+	// balancer saw first, and excludes the others
+	DomainConflictFirstSeen = "first-seen"
+
+	// DomainConflictRejectBoth excludes every application involved in a
+	// conflict
+	DomainConflictRejectBoth = "reject-both"
+
+	// DomainConflictAllowlist only allows the application named for a domain
+	// in the allowlist file to serve it. Conflicts over domains which aren't
+	// listed exclude every application involved.
+	DomainConflictAllowlist = "allowlist"
+)
+
+// DomainConflict describes applications on different backends which claim the
+// same domain and listen port. Excluded applications don't serve the domain on
+// any backend, but keep serving their other domains.
+type DomainConflict struct {
+	Domain     string
+	ListenPort string
+	Allowed    []Application
+	Excluded   []Application
+}
+
+func (c DomainConflict) String() string {
+	return fmt.Sprintf("%s:%s claimed by %s; excluded %s", c.Domain, c.ListenPort, describeApplications(c.Allowed, c.Excluded), describeApplications(c.Excluded))
+}
+
+func describeApplications(groups ...[]Application) string {
+	var names []string
+
+	for _, apps := range groups {
+		for _, app := range apps {
+			names = append(names, fmt.Sprintf("%s (port %s, %s)", app.Name, app.ApplicationPort, app.Protocol))
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// DomainPolicy decides which application may serve a domain and listen port
+// when more than one claims it
+type DomainPolicy struct {
+	Mode      string
+	Allowlist map[string]string
+}
+
+// NewDomainPolicy creates a policy for the given mode, reading a JSON object
+// mapping domains to application names from allowlistFile for the allowlist
+// mode
+func NewDomainPolicy(mode string, allowlistFile string) (*DomainPolicy, error) {
+	policy := &DomainPolicy{
+		Mode: strings.ToLower(mode),
+	}
+
+	if policy.Mode == "" {
+		policy.Mode = DomainConflictFirstSeen
+	}
+
+	switch policy.Mode {
+	case DomainConflictFirstSeen, DomainConflictRejectBoth:
+
+	case DomainConflictAllowlist:
+		if allowlistFile == "" {
+			return nil, fmt.Errorf("domain conflict policy '%s' requires a 'domain-allowlist-file'", policy.Mode)
+		}
+
+		data, err := ioutil.ReadFile(allowlistFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read domain allowlist: %w", err)
+		}
+
+		var allowlist map[string]string
+
+		err = json.Unmarshal(data, &allowlist)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse domain allowlist: %w", err)
+		}
+
+		policy.Allowlist = make(map[string]string, len(allowlist))
+
+		for domain, name := range allowlist {
+			policy.Allowlist[strings.ToLower(domain)] = name
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown domain conflict policy '%s'", mode)
+	}
+
+	return policy, nil
+}
+
+type domainClaim struct {
+	domain     string
+	listenPort string
+}
+
+// claimant is an application served by at least one backend, along with when
+// the earliest of those backends was first seen
+type claimant struct {
+	app       Application
+	firstSeen time.Time
+}
+
+// Resolve returns the topology with each excluded application's conflicting
+// domains removed, and a description of each conflict sorted by domain and
+// listen port. Applications left with no domains are removed entirely. A nil
+// policy allows every application.
+func (p *DomainPolicy) Resolve(topology Topology) (Topology, []DomainConflict) {
+	if p == nil {
+		return topology, nil
+	}
+
+	claims := make(map[domainClaim][]*claimant)
+
+	for _, upstream := range topology.Upstreams() {
+		joined, _ := topology.JoinedAt(upstream)
+
+		for _, app := range topology.Applications(upstream) {
+			for _, domain := range app.DomainSlice() {
+				key := domainClaim{strings.ToLower(domain), app.ListenPort}
+				claims[key] = addClaimant(claims[key], app, joined)
+			}
+		}
+	}
+
+	var conflicts []DomainConflict
+	excluded := make(map[Application]map[string]bool)
+
+	for key, claimants := range claims {
+		allowed, rejected := p.decide(key, claimants)
+
+		if len(rejected) == 0 {
+			continue
+		}
+
+		conflict := DomainConflict{
+			Domain:     key.domain,
+			ListenPort: key.listenPort,
+		}
+
+		for _, c := range allowed {
+			conflict.Allowed = append(conflict.Allowed, c.app)
+		}
+
+		for _, c := range rejected {
+			conflict.Excluded = append(conflict.Excluded, c.app)
+
+			if excluded[c.app] == nil {
+				excluded[c.app] = make(map[string]bool)
+			}
+
+			excluded[c.app][key.domain] = true
+		}
+
+		conflicts = append(conflicts, conflict)
+	}
+
+	if len(excluded) == 0 {
+		return topology, nil
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Domain != conflicts[j].Domain {
+			return conflicts[i].Domain < conflicts[j].Domain
+		}
+
+		return conflicts[i].ListenPort < conflicts[j].ListenPort
+	})
+
+	members := make(map[Upstream][]Application, topology.Len())
+
+	for _, upstream := range topology.Upstreams() {
+		var apps []Application
+
+		for _, app := range topology.Applications(upstream) {
+			app, ok := withoutDomains(app, excluded[app])
+
+			if ok {
+				apps = append(apps, app)
+			}
+		}
+
+		members[upstream] = apps
+	}
+
+	return newTopology(members, topology.joined), conflicts
+}
+
+// withoutDomains returns the application without the given lower case
+// domains, and false if it has no domains left
+func withoutDomains(app Application, domains map[string]bool) (Application, bool) {
+	if len(domains) == 0 {
+		return app, true
+	}
+
+	var kept []string
+
+	for _, domain := range app.DomainSlice() {
+		if !domains[strings.ToLower(domain)] {
+			kept = append(kept, domain)
+		}
+	}
+
+	app.domains = strings.Join(kept, " ")
+
+	return app, len(kept) > 0
+}
+
+func addClaimant(claimants []*claimant, app Application, joined time.Time) []*claimant {
+	for _, c := range claimants {
+		if c.app.Equal(app) {
+			if joined.Before(c.firstSeen) {
+				c.firstSeen = joined
+			}
+
+			return claimants
+		}
+	}
+
+	return append(claimants, &claimant{app, joined})
+}
+
+// decide splits the applications claiming a domain into those allowed to
+// serve it and those excluded
+func (p *DomainPolicy) decide(key domainClaim, claimants []*claimant) (allowed []*claimant, rejected []*claimant) {
+	if p.Mode == DomainConflictAllowlist {
+		if name, ok := p.Allowlist[key.domain]; ok {
+			for _, c := range claimants {
+				if c.app.Name == name {
+					allowed = append(allowed, c)
+				} else {
+					rejected = append(rejected, c)
+				}
+			}
+
+			// several versions of the allowed application still conflict
+			if len(allowed) > 1 {
+				winner, losers := firstSeen(allowed)
+				return []*claimant{winner}, append(rejected, losers...)
+			}
+
+			return allowed, rejected
+		}
+	}
+
+	if len(claimants) < 2 {
+		return claimants, nil
+	}
+
+	if p.Mode == DomainConflictFirstSeen {
+		winner, losers := firstSeen(claimants)
+		return []*claimant{winner}, losers
+	}
+
+	return nil, claimants
+}
+
+// firstSeen returns the earliest claimant, breaking ties so that the choice is
+// stable between runs, and the rest
+func firstSeen(claimants []*claimant) (*claimant, []*claimant) {
+	sorted := append([]*claimant(nil), claimants...)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].firstSeen.Equal(sorted[j].firstSeen) {
+			return sorted[i].firstSeen.Before(sorted[j].firstSeen)
+		}
+
+		if sorted[i].app.Name != sorted[j].app.Name {
+			return sorted[i].app.Name < sorted[j].app.Name
+		}
+
+		return sorted[i].app.ApplicationPort < sorted[j].app.ApplicationPort
+	})
+
+	return sorted[0], sorted[1:]
+}
@@ -0,0 +1,244 @@
+package scrimplb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+func newTestApplication(name string, domains ...string) Application {
+	app := JSONApplication{
+		Name:            name,
+		ListenPort:      "443",
+		ApplicationPort: "8443",
+		Protocol:        "https",
+		Domains:         domains,
+	}
+
+	return app.ToApplication()
+}
+
+// newTestConflictTopology puts each application on its own backend, which
+// were seen in the order given
+func newTestConflictTopology(apps ...Application) Topology {
+	members := make(map[Upstream][]Application)
+	joined := make(map[Upstream]time.Time)
+	now := time.Now()
+
+	for i, app := range apps {
+		upstream := Upstream{app.Name, "10.0.0.1"}
+		members[upstream] = []Application{app}
+		joined[upstream] = now.Add(time.Duration(i) * time.Second)
+	}
+
+	return newTopology(members, joined)
+}
+
+func newTestDomainPolicy(t *testing.T, mode string, allowlist string) *DomainPolicy {
+	t.Helper()
+
+	var allowlistFile string
+
+	if allowlist != "" {
+		allowlistFile = filepath.Join(t.TempDir(), "allowlist.json")
+
+		err := ioutil.WriteFile(allowlistFile, []byte(allowlist), 0600)
+
+		if err != nil {
+			t.Fatalf("couldn't write allowlist: %v", err)
+		}
+	}
+
+	policy, err := NewDomainPolicy(mode, allowlistFile)
+
+	if err != nil {
+		t.Fatalf("couldn't create policy: %v", err)
+	}
+
+	return policy
+}
+
+// assertServedDomains checks the domains each named application serves in
+// the topology; an application which isn't served at all is given no domains
+func assertServedDomains(t *testing.T, topology Topology, expected map[string][]string) {
+	t.Helper()
+
+	served := make(map[string][]string)
+
+	for _, upstream := range topology.Upstreams() {
+		for _, app := range topology.Applications(upstream) {
+			served[app.Name] = app.DomainSlice()
+		}
+	}
+
+	for name, domains := range expected {
+		if len(served[name]) != len(domains) {
+			t.Errorf("expected %s to serve %v but it serves %v", name, domains, served[name])
+			continue
+		}
+
+		for i := range domains {
+			if served[name][i] != domains[i] {
+				t.Errorf("expected %s to serve %v but it serves %v", name, domains, served[name])
+				break
+			}
+		}
+	}
+}
+
+func TestNewDomainPolicy(t *testing.T) {
+	_, err := NewDomainPolicy("coin-toss", "")
+
+	if err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+
+	_, err = NewDomainPolicy(DomainConflictAllowlist, "")
+
+	if err == nil {
+		t.Error("expected the allowlist policy to require an allowlist file")
+	}
+
+	policy := newTestDomainPolicy(t, "", "")
+
+	if policy.Mode != DomainConflictFirstSeen {
+		t.Errorf("expected the default policy to be %s but got %s", DomainConflictFirstSeen, policy.Mode)
+	}
+}
+
+func TestFirstSeenExcludesOnlyConflictingDomains(t *testing.T) {
+	policy := newTestDomainPolicy(t, DomainConflictFirstSeen, "")
+
+	topology := newTestConflictTopology(
+		newTestApplication("web", "www.example.com"),
+		newTestApplication("blog", "blog.example.com", "WWW.example.com"),
+	)
+
+	resolved, conflicts := policy.Resolve(topology)
+
+	if len(conflicts) != 1 || conflicts[0].Allowed[0].Name != "web" || conflicts[0].Excluded[0].Name != "blog" {
+		t.Errorf("expected the first seen application to win but got %v", conflicts)
+	}
+
+	assertServedDomains(t, resolved, map[string][]string{
+		"web":  {"www.example.com"},
+		"blog": {"blog.example.com"},
+	})
+}
+
+func TestRejectBothExcludesEveryClaimant(t *testing.T) {
+	policy := newTestDomainPolicy(t, DomainConflictRejectBoth, "")
+
+	topology := newTestConflictTopology(
+		newTestApplication("web", "www.example.com"),
+		newTestApplication("imposter", "www.example.com"),
+		newTestApplication("blog", "blog.example.com", "www.example.com"),
+		newTestApplication("shop", "shop.example.com"),
+	)
+
+	resolved, conflicts := policy.Resolve(topology)
+
+	if len(conflicts) != 1 || len(conflicts[0].Allowed) != 0 || len(conflicts[0].Excluded) != 3 {
+		t.Errorf("expected every application claiming the domain to be excluded but got %v", conflicts)
+	}
+
+	assertServedDomains(t, resolved, map[string][]string{
+		"web":      nil,
+		"imposter": nil,
+		"blog":     {"blog.example.com"},
+		"shop":     {"shop.example.com"},
+	})
+}
+
+func TestAllowlistPolicy(t *testing.T) {
+	policy := newTestDomainPolicy(t, DomainConflictAllowlist, `{"WWW.example.com": "web", "admin.example.com": "admin"}`)
+
+	topology := newTestConflictTopology(
+		newTestApplication("imposter", "www.example.com", "admin.example.com"),
+		newTestApplication("web", "www.example.com"),
+		newTestApplication("blog", "blog.example.com"),
+		newTestApplication("other-blog", "blog.example.com"),
+	)
+
+	resolved, conflicts := policy.Resolve(topology)
+
+	if len(conflicts) != 3 {
+		t.Fatalf("expected 3 conflicts but got %v", conflicts)
+	}
+
+	// a listed domain can only be served by its application, even without a
+	// conflict
+	if conflicts[0].Domain != "admin.example.com" || len(conflicts[0].Allowed) != 0 || conflicts[0].Excluded[0].Name != "imposter" {
+		t.Errorf("expected the unlisted application to be excluded from admin.example.com but got %v", conflicts[0])
+	}
+
+	// an unlisted domain which is claimed twice excludes both
+	if conflicts[1].Domain != "blog.example.com" || len(conflicts[1].Allowed) != 0 || len(conflicts[1].Excluded) != 2 {
+		t.Errorf("expected both blogs to be excluded but got %v", conflicts[1])
+	}
+
+	// the listed application wins even though it was seen last
+	if conflicts[2].Domain != "www.example.com" || conflicts[2].Allowed[0].Name != "web" || conflicts[2].Excluded[0].Name != "imposter" {
+		t.Errorf("expected the listed application to win but got %v", conflicts[2])
+	}
+
+	assertServedDomains(t, resolved, map[string][]string{
+		"web":        {"www.example.com"},
+		"imposter":   nil,
+		"blog":       nil,
+		"other-blog": nil,
+	})
+}
+
+func TestResolveConflictsReportsMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	metricsConfig := metrics.DefaultConfig("")
+	metricsConfig.EnableHostname = false
+	metricsConfig.EnableRuntimeMetrics = false
+
+	_, err := metrics.NewGlobal(metricsConfig, sink)
+
+	if err != nil {
+		t.Fatalf("couldn't set up metrics: %v", err)
+	}
+
+	t.Cleanup(func() { metrics.NewGlobal(metricsConfig, &metrics.BlackholeSink{}) })
+
+	node := &Node{
+		config: &ScrimpConfig{LoadBalancerConfig: &LoadBalancerConfig{
+			DomainPolicy: newTestDomainPolicy(t, DomainConflictRejectBoth, ""),
+		}},
+		events: NewEventBus(),
+	}
+
+	topology := newTestConflictTopology(
+		newTestApplication("web", "www.example.com"),
+		newTestApplication("imposter", "www.example.com"),
+	)
+
+	node.resolveConflicts(topology)
+	node.resolveConflicts(topology)
+
+	// the runs could straddle the end of an interval
+	var changed int
+	var conflicts, excluded float32
+
+	for _, interval := range sink.Data() {
+		interval.RLock()
+		changed += interval.Counters["scrimplb.domain_conflicts.changed"].Count
+		conflicts = interval.Gauges["scrimplb.domain_conflicts"].Value
+		excluded = interval.Gauges["scrimplb.domain_conflicts.excluded"].Value
+		interval.RUnlock()
+	}
+
+	if conflicts != 1 || excluded != 2 {
+		t.Errorf("expected 1 conflict and 2 excluded applications to be reported but got %v and %v", conflicts, excluded)
+	}
+
+	if changed != 1 {
+		t.Errorf("expected the conflicts to be reported as changed once but got %d", changed)
+	}
+}
@@ -0,0 +1,266 @@
+package scrimplb
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventType identifies what changed in an Event
+type EventType int
+
+const (
+	// EventBackendJoined is published when a backend joins the cluster
+	EventBackendJoined EventType = iota
+
+	// EventBackendLeft is published when a backend leaves or is declared dead
+	EventBackendLeft
+
+	// EventBackendUpdated is published when a backend changes its metadata
+	EventBackendUpdated
+
+	// EventApplicationAdded is published for every application a backend
+	// starts serving, including those it serves when it joins
+	EventApplicationAdded
+
+	// EventApplicationRemoved is published for every application a backend
+	// stops serving, including those it served when it leaves
+	EventApplicationRemoved
+
+	// EventGeneratorSucceeded is published after config is generated, written
+	// and the load balancer restarted
+	EventGeneratorSucceeded
+
+	// EventGeneratorFailed is published if any stage of a generator run fails
+	EventGeneratorFailed
+
+	// EventDomainConflictsChanged is published before a generator run if the
+	// set of conflicting domains has changed since the previous run
+	EventDomainConflictsChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventBackendJoined:
+		return "backend-joined"
+
+	case EventBackendLeft:
+		return "backend-left"
+
+	case EventBackendUpdated:
+		return "backend-updated"
+
+	case EventApplicationAdded:
+		return "application-added"
+
+	case EventApplicationRemoved:
+		return "application-removed"
+
+	case EventGeneratorSucceeded:
+		return "generator-succeeded"
+
+	case EventGeneratorFailed:
+		return "generator-failed"
+
+	case EventDomainConflictsChanged:
+		return "domain-conflicts-changed"
+
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a single change to a load balancer's view of the cluster.
+// Upstream is set for backend and application events, and Application for
+// application events. Old and New are the topology before and after the
+// change; for generator events both are the topology which was generated.
+// Err is set for EventGeneratorFailed, and Conflicts for
+// EventDomainConflictsChanged.
+type Event struct {
+	Type        EventType
+	Time        time.Time
+	Upstream    Upstream
+	Application Application
+	Old         Topology
+	New         Topology
+	Err         error
+	Conflicts   []DomainConflict
+}
+
+// Topology is an immutable snapshot of the backends known to a load balancer
+// and the applications each serves. The zero value is an empty topology.
+type Topology struct {
+	members map[Upstream][]Application
+	joined  map[Upstream]time.Time
+}
+
+func newTopology(memberMap map[Upstream][]Application, joined map[Upstream]time.Time) Topology {
+	members := make(map[Upstream][]Application, len(memberMap))
+	joinedCopy := make(map[Upstream]time.Time, len(memberMap))
+
+	for upstream, apps := range memberMap {
+		members[upstream] = append([]Application(nil), apps...)
+		joinedCopy[upstream] = joined[upstream]
+	}
+
+	return Topology{members, joinedCopy}
+}
+
+// Len returns the number of backends in the topology
+func (t Topology) Len() int {
+	return len(t.members)
+}
+
+// Upstreams returns every backend in the topology, sorted by name and address
+func (t Topology) Upstreams() []Upstream {
+	upstreams := make([]Upstream, 0, len(t.members))
+
+	for upstream := range t.members {
+		upstreams = append(upstreams, upstream)
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].Name != upstreams[j].Name {
+			return upstreams[i].Name < upstreams[j].Name
+		}
+
+		return upstreams[i].Address < upstreams[j].Address
+	})
+
+	return upstreams
+}
+
+// Applications returns a copy of the applications served by the given
+// backend, or nil if the backend isn't in the topology
+func (t Topology) Applications(upstream Upstream) []Application {
+	apps, ok := t.members[upstream]
+
+	if !ok {
+		return nil
+	}
+
+	return append([]Application(nil), apps...)
+}
+
+// Map returns a copy of the topology as a map, suitable for passing to a
+// Generator
+func (t Topology) Map() map[Upstream][]Application {
+	return newTopology(t.members, t.joined).members
+}
+
+// JoinedAt returns when the load balancer first saw the given backend, or when
+// the backend last restarted if that was later
+func (t Topology) JoinedAt(upstream Upstream) (time.Time, bool) {
+	joined, ok := t.joined[upstream]
+	return joined, ok
+}
+
+// EventBus fans events out to any number of subscribers. Events are delivered
+// without blocking the publisher, so a subscriber whose buffer is full misses
+// events rather than stalling cluster membership handling.
+type EventBus struct {
+	lock        sync.Mutex
+	nextID      int
+	closed      bool
+	subscribers map[int]chan Event
+}
+
+// NewEventBus creates an EventBus with no subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+// Subscribe returns a channel which receives every event published after the
+// call, buffered to the given size, and a function which unsubscribes and
+// closes the channel. Subscribing to a closed bus returns a closed channel.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch := make(chan Event, buffer)
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	id := b.nextID
+	b.nextID++
+
+	b.subscribers[id] = ch
+
+	return ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		// the channel may already have been closed by Close
+		if _, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends events to every subscriber in order. Events published after
+// the bus is closed are dropped.
+func (b *EventBus) Publish(events ...Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, event := range events {
+		for id, ch := range b.subscribers {
+			select {
+			case ch <- event:
+
+			default:
+				log.Printf("dropping %v event for slow subscriber %d\n", event.Type, id)
+			}
+		}
+	}
+}
+
+// Close closes every subscriber's channel. Events which were already
+// published stay buffered, so subscribers receive them before seeing the
+// channel close.
+func (b *EventBus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+
+	for id, ch := range b.subscribers {
+		delete(b.subscribers, id)
+		close(ch)
+	}
+}
+
+// diffApplications returns the applications in new but not old, and those in
+// old but not new
+func diffApplications(old []Application, new []Application) (added []Application, removed []Application) {
+	for _, app := range new {
+		if !containsApplication(old, app) {
+			added = append(added, app)
+		}
+	}
+
+	for _, app := range old {
+		if !containsApplication(new, app) {
+			removed = append(removed, app)
+		}
+	}
+
+	return added, removed
+}
+
+func containsApplication(apps []Application, app Application) bool {
+	for _, a := range apps {
+		if a.Equal(app) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,121 @@
+package scrimplb
+
+import (
+	"testing"
+	"time"
+)
+
+func receiveEvents(t *testing.T, events <-chan Event) []EventType {
+	t.Helper()
+
+	var received []EventType
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return received
+			}
+
+			received = append(received, event.Type)
+
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the event channel to close")
+			return nil
+		}
+	}
+}
+
+func assertEventTypes(t *testing.T, actual []EventType, expected ...EventType) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected events %v but got %v", expected, actual)
+	}
+
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected events %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestEventBusDeliversToEverySubscriber(t *testing.T) {
+	bus := NewEventBus()
+
+	first, _ := bus.Subscribe(4)
+	second, _ := bus.Subscribe(4)
+
+	bus.Publish(Event{Type: EventBackendJoined}, Event{Type: EventApplicationAdded})
+	bus.Close()
+
+	assertEventTypes(t, receiveEvents(t, first), EventBackendJoined, EventApplicationAdded)
+	assertEventTypes(t, receiveEvents(t, second), EventBackendJoined, EventApplicationAdded)
+}
+
+func TestEventBusDropsEventsForSlowSubscribers(t *testing.T) {
+	bus := NewEventBus()
+
+	slow, _ := bus.Subscribe(1)
+	fast, _ := bus.Subscribe(3)
+
+	bus.Publish(Event{Type: EventBackendJoined}, Event{Type: EventBackendUpdated}, Event{Type: EventBackendLeft})
+	bus.Close()
+
+	assertEventTypes(t, receiveEvents(t, slow), EventBackendJoined)
+	assertEventTypes(t, receiveEvents(t, fast), EventBackendJoined, EventBackendUpdated, EventBackendLeft)
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+
+	events, unsubscribe := bus.Subscribe(4)
+	bus.Publish(Event{Type: EventBackendJoined})
+
+	unsubscribe()
+	unsubscribe()
+
+	bus.Publish(Event{Type: EventBackendLeft})
+
+	assertEventTypes(t, receiveEvents(t, events), EventBackendJoined)
+
+	// closing the bus afterwards mustn't close the channel again
+	bus.Close()
+}
+
+func TestEventBusCloseFlushesBufferedEvents(t *testing.T) {
+	bus := NewEventBus()
+
+	events, unsubscribe := bus.Subscribe(4)
+
+	bus.Publish(Event{Type: EventBackendLeft}, Event{Type: EventGeneratorSucceeded})
+	bus.Close()
+
+	// events published after closing are dropped
+	bus.Publish(Event{Type: EventGeneratorFailed})
+
+	assertEventTypes(t, receiveEvents(t, events), EventBackendLeft, EventGeneratorSucceeded)
+
+	unsubscribe()
+
+	late, unsubscribeLate := bus.Subscribe(4)
+	assertEventTypes(t, receiveEvents(t, late))
+	unsubscribeLate()
+}
+
+func TestTopologyIsImmutable(t *testing.T) {
+	upstream := Upstream{Name: "backend1", Address: "10.0.0.1"}
+	memberMap := map[Upstream][]Application{upstream: {{Name: "app1"}}}
+
+	topology := newTopology(memberMap, nil)
+
+	memberMap[upstream][0].Name = "changed"
+	memberMap[Upstream{Name: "backend2"}] = nil
+
+	topology.Map()[upstream][0].Name = "changed"
+	topology.Applications(upstream)[0].Name = "changed"
+
+	if topology.Len() != 1 || topology.Applications(upstream)[0].Name != "app1" {
+		t.Errorf("expected the topology to be unaffected by changes to its source or copies, but got %v", topology.Map())
+	}
+}
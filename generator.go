@@ -1,11 +1,82 @@
 package scrimplb
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
 // Generator provides an interface for generating configuration values based on backend configuration
 type Generator interface {
 	GenerateConfig(map[Upstream][]Application, *ScrimpConfig) (string, error)
 	HandleRestart() error
 }
 
+// GeneratorFactory creates a Generator from the raw "generator-config" map,
+// which may be nil.
+type GeneratorFactory func(config map[string]interface{}) (Generator, error)
+
+var (
+	generatorRegistryLock sync.RWMutex
+	generatorRegistry     = make(map[string]GeneratorFactory)
+)
+
+func init() {
+	RegisterGenerator("dummy", func(config map[string]interface{}) (Generator, error) { return DummyGenerator{}, nil })
+	RegisterGenerator("nginx", func(config map[string]interface{}) (Generator, error) { return NewNginxGenerator(config) })
+}
+
+// RegisterGenerator makes a generator available under the given name, so that
+// it can be selected with "generator" in load balancer config. Names are case
+// insensitive. This is intended to be called from an init function, and
+// panics if factory is nil or if a generator is already registered with the
+// same name.
+func RegisterGenerator(name string, factory GeneratorFactory) {
+	generatorRegistryLock.Lock()
+	defer generatorRegistryLock.Unlock()
+
+	name = strings.ToLower(name)
+
+	if factory == nil {
+		panic("scrimplb: RegisterGenerator factory is nil for generator " + name)
+	}
+
+	if _, exists := generatorRegistry[name]; exists {
+		panic("scrimplb: RegisterGenerator called twice for generator " + name)
+	}
+
+	generatorRegistry[name] = factory
+}
+
+// RegisteredGenerators returns the sorted names of all registered generators.
+func RegisteredGenerators() []string {
+	generatorRegistryLock.RLock()
+	defer generatorRegistryLock.RUnlock()
+
+	var names []string
+	for name := range generatorRegistry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// NewGenerator creates the generator registered under the given name from its
+// config. An unknown name is an error which lists the registered generators.
+func NewGenerator(name string, config map[string]interface{}) (Generator, error) {
+	generatorRegistryLock.RLock()
+	factory, ok := generatorRegistry[strings.ToLower(name)]
+	generatorRegistryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown generator '%s'; registered generators are: %s", name, strings.Join(RegisteredGenerators(), ", "))
+	}
+
+	return factory(config)
+}
+
 // AddressesForApplication returns a string slice which details all backend addresses for the given application
 // in an UpstreamApplicationMap.
 func AddressesForApplication(upstreamMap map[Upstream][]Application, app Application) (addresses []string) {
@@ -0,0 +1,111 @@
+package scrimplb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sgtcodfish/scrimplb/resolver"
+	"github.com/sgtcodfish/scrimplb/seed"
+)
+
+// registryTestGenerator is registered by tests as a third-party generator
+type registryTestGenerator struct {
+	config map[string]interface{}
+}
+
+func (g registryTestGenerator) GenerateConfig(map[Upstream][]Application, *ScrimpConfig) (string, error) {
+	return "", nil
+}
+
+func (g registryTestGenerator) HandleRestart() error {
+	return nil
+}
+
+func TestRegisterGeneratorRejectsDuplicateNames(t *testing.T) {
+	for description, fn := range map[string]func(){
+		// names are case insensitive, so this clashes with the built in generator
+		"registering a generator twice": func() {
+			RegisterGenerator("NGINX", func(config map[string]interface{}) (Generator, error) { return DummyGenerator{}, nil })
+		},
+		"registering a nil factory": func() { RegisterGenerator("registry-test-nil", nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %s to panic", description)
+				}
+			}()
+
+			fn()
+		}()
+	}
+}
+
+func TestNewGeneratorRejectsUnknownName(t *testing.T) {
+	_, err := NewGenerator("no-such-generator", nil)
+
+	if err == nil {
+		t.Fatal("expected an unknown generator to be rejected")
+	}
+
+	if !strings.Contains(err.Error(), "no-such-generator") || !strings.Contains(err.Error(), "nginx") {
+		t.Errorf("expected the error to name the generator and list registered generators, but got: %v", err)
+	}
+}
+
+// each registry is extended from init, the same way an external package
+// importing scrimplb would add its own components
+func init() {
+	RegisterGenerator("registry-test-generator", func(config map[string]interface{}) (Generator, error) {
+		return registryTestGenerator{config}, nil
+	})
+
+	seed.Register("registry-test-provider", func(config map[string]interface{}) (seed.Provider, error) {
+		return seed.NewManualProvider(config)
+	})
+
+	resolver.Register("registry-test-resolver", func(config map[string]interface{}) (resolver.IPResolver, error) {
+		return resolver.NewDummyIPResolver(), nil
+	})
+}
+
+func TestThirdPartyRegistrationsFromConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+
+	err := ioutil.WriteFile(configFile, []byte(`{
+		"lb": true,
+		"provider": "Registry-Test-Provider",
+		"provider-config": {"ip": "10.0.0.1", "port": "9999"},
+		"resolver": "registry-test-resolver",
+		"load-balancer-config": {
+			"generator": "registry-test-generator",
+			"generator-config": {"option": "value"}
+		}
+	}`), 0600)
+
+	if err != nil {
+		t.Fatalf("couldn't write config: %v", err)
+	}
+
+	config, err := LoadScrimpConfig(configFile)
+
+	if err != nil {
+		t.Fatalf("couldn't load config using registered components: %v", err)
+	}
+
+	generator, ok := config.LoadBalancerConfig.Generator.(registryTestGenerator)
+
+	if !ok || generator.config["option"] != "value" {
+		t.Errorf("expected the registered generator with its config but got %#v", config.LoadBalancerConfig.Generator)
+	}
+
+	if _, ok := config.Provider.(*seed.ManualProvider); !ok {
+		t.Errorf("expected the registered provider but got %T", config.Provider)
+	}
+
+	if _, ok := config.Resolver.(resolver.DummyIPResolver); !ok {
+		t.Errorf("expected the registered resolver but got %T", config.Resolver)
+	}
+}
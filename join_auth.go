@@ -0,0 +1,283 @@
+package scrimplb
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// JoinClaims describe what a node holding a join token is allowed to do.
+// Tokens are signed by an operator-held ed25519 key and advertised in node
+// metadata, where anyone can copy them, so each token is bound to the node
+// name verified by mutual TLS.
+type JoinClaims struct {
+	// Identity names the holder of the token, and is used in logs and to
+	// look up per-identity domain policy
+	Identity string `json:"identity"`
+
+	// Node restricts the token to the node with the given name, which is
+	// taken from the node's TLS certificate
+	Node string `json:"node"`
+
+	// LoadBalancer allows the holder to join as a load balancer
+	LoadBalancer bool `json:"lb,omitempty"`
+
+	// Domains are the domains the holder may serve as a backend. A pattern
+	// starting with "*." matches any subdomain.
+	Domains []string `json:"domains,omitempty"`
+
+	// Expires, if set, is when the token stops being accepted
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// JoinAuthConfig configures verification of join tokens. If set, a node will
+// ignore any other node which doesn't present a valid token permitting its
+// role and every domain it advertises.
+type JoinAuthConfig struct {
+	PublicKeys []string            `json:"public-keys"`
+	Identities map[string][]string `json:"identities"`
+
+	publicKeys []ed25519.PublicKey
+}
+
+func initialiseJoinAuthConfig(config *ScrimpConfig) error {
+	if config.AuthTokenFile != "" {
+		token, err := ioutil.ReadFile(config.AuthTokenFile)
+
+		if err != nil {
+			return fmt.Errorf("couldn't read auth token file: %w", err)
+		}
+
+		config.AuthToken = string(token)
+	}
+
+	config.AuthToken = strings.TrimSpace(config.AuthToken)
+
+	if config.JoinAuth == nil {
+		return nil
+	}
+
+	// without verified node names, a token copied from any node's metadata
+	// could be replayed by another host under the same name
+	if config.TransportTLS == nil {
+		return errors.New("join-auth requires transport-tls, so that tokens are bound to a verified node name")
+	}
+
+	if len(config.JoinAuth.PublicKeys) == 0 {
+		return errors.New("join-auth requires at least one public key")
+	}
+
+	keys, err := parsePublicKeys(config.JoinAuth.PublicKeys, "join-auth")
+
+	if err != nil {
+		return err
+	}
+
+	config.JoinAuth.publicKeys = keys
+
+	return nil
+}
+
+// parsePublicKeys decodes base64 encoded ed25519 public keys, naming the
+// config they came from in any error
+func parsePublicKeys(rawKeys []string, source string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	for _, raw := range rawKeys {
+		key, err := base64.StdEncoding.DecodeString(raw)
+
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid %s public key '%s'", source, raw)
+		}
+
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+
+	return keys, nil
+}
+
+// GenerateJoinAuthKey returns a new base64 encoded ed25519 key pair for
+// signing join tokens. The public key goes in "join-auth" config.
+func GenerateJoinAuthKey() (publicKey string, privateKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't generate key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(private), nil
+}
+
+// IssueJoinToken signs the given claims with a base64 encoded ed25519
+// private key
+func IssueJoinToken(privateKey string, claims JoinClaims) (string, error) {
+	if claims.Identity == "" {
+		return "", errors.New("join token requires an identity")
+	}
+
+	if claims.Node == "" {
+		return "", errors.New("join token requires a node name")
+	}
+
+	return signPayload(privateKey, claims)
+}
+
+// verifyJoinToken checks the token's signature against each public key and
+// returns its claims if any key matches and the token hasn't expired
+func (c *JoinAuthConfig) verifyJoinToken(token string, now time.Time) (*JoinClaims, error) {
+	if token == "" {
+		return nil, errors.New("no join token")
+	}
+
+	payload, err := openSignedPayload(token, c.publicKeys, "join token")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var claims JoinClaims
+
+	err = json.Unmarshal(payload, &claims)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse join token claims: %w", err)
+	}
+
+	if !claims.Expires.IsZero() && now.After(claims.Expires) {
+		return nil, fmt.Errorf("join token for '%s' expired at %v", claims.Identity, claims.Expires)
+	}
+
+	return &claims, nil
+}
+
+// signPayload marshals v and signs it with a base64 encoded ed25519 private
+// key, returning the payload and signature joined by a dot
+func signPayload(privateKey string, v interface{}) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return "", errors.New("invalid private key")
+	}
+
+	payload, err := json.Marshal(v)
+
+	if err != nil {
+		return "", fmt.Errorf("couldn't marshal signed payload: %w", err)
+	}
+
+	signature := ed25519.Sign(ed25519.PrivateKey(key), payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// openSignedPayload returns the payload from the output of signPayload if it
+// was signed by any of the given keys. what describes the payload in errors.
+func openSignedPayload(signed string, keys []ed25519.PublicKey, what string) ([]byte, error) {
+	parts := strings.Split(signed, ".")
+
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed %s", what)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s", what)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s", what)
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, payload, signature) {
+			return payload, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s isn't signed by a trusted key", what)
+}
+
+// authorise returns an error if the node isn't allowed in the cluster with
+// the role and applications it advertises in meta. The node's name must
+// already have been checked against the identity verified by mutual TLS.
+func (c *JoinAuthConfig) authorise(node *memberlist.Node, meta *BackendMetadata, now time.Time) error {
+	claims, err := c.verifyJoinToken(meta.Token, now)
+
+	if err != nil {
+		return err
+	}
+
+	if claims.Node == "" {
+		return fmt.Errorf("join token for '%s' isn't bound to a node", claims.Identity)
+	}
+
+	if claims.Node != node.Name {
+		return fmt.Errorf("join token for '%s' is only valid for node '%s'", claims.Identity, claims.Node)
+	}
+
+	switch meta.Type {
+	case "load-balancer":
+		if !claims.LoadBalancer {
+			return fmt.Errorf("'%s' isn't allowed to join as a load balancer", claims.Identity)
+		}
+
+	case "backend":
+		for _, app := range meta.Applications {
+			for _, domain := range app.Domains {
+				if !c.allowsDomain(claims, domain) {
+					return fmt.Errorf("'%s' isn't allowed to serve '%s'", claims.Identity, domain)
+				}
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown node type '%s'", meta.Type)
+	}
+
+	return nil
+}
+
+// allowsDomain returns true if the domain is allowed both by the token and by
+// any local policy for the token's identity
+func (c *JoinAuthConfig) allowsDomain(claims *JoinClaims, domain string) bool {
+	if !matchesAnyDomain(claims.Domains, domain) {
+		return false
+	}
+
+	patterns, ok := c.Identities[claims.Identity]
+
+	if !ok {
+		return true
+	}
+
+	return matchesAnyDomain(patterns, domain)
+}
+
+func matchesAnyDomain(patterns []string, domain string) bool {
+	domain = strings.ToLower(domain)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+
+		if pattern == domain {
+			return true
+		}
+
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(domain, pattern[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,206 @@
+package scrimplb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// newTestJoinAuth returns join auth config trusting a new key, and the
+// matching private key
+func newTestJoinAuth(t *testing.T) (*JoinAuthConfig, string) {
+	t.Helper()
+
+	publicKey, privateKey := newTestOperatorKey(t)
+
+	config := &ScrimpConfig{
+		TransportTLS: &TransportTLSConfig{},
+		JoinAuth:     &JoinAuthConfig{PublicKeys: []string{publicKey}},
+	}
+
+	err := initialiseJoinAuthConfig(config)
+
+	if err != nil {
+		t.Fatalf("couldn't initialise join auth: %v", err)
+	}
+
+	return config.JoinAuth, privateKey
+}
+
+func issueTestJoinToken(t *testing.T, privateKey string, claims JoinClaims) string {
+	t.Helper()
+
+	token, err := IssueJoinToken(privateKey, claims)
+
+	if err != nil {
+		t.Fatalf("couldn't issue join token: %v", err)
+	}
+
+	return token
+}
+
+func TestInitialiseJoinAuthConfig(t *testing.T) {
+	publicKey, _ := newTestOperatorKey(t)
+
+	err := initialiseJoinAuthConfig(&ScrimpConfig{JoinAuth: &JoinAuthConfig{PublicKeys: []string{publicKey}}})
+
+	if err == nil {
+		t.Error("expected join-auth without transport-tls to be rejected")
+	}
+
+	err = initialiseJoinAuthConfig(&ScrimpConfig{TransportTLS: &TransportTLSConfig{}, JoinAuth: &JoinAuthConfig{}})
+
+	if err == nil {
+		t.Error("expected join-auth without public keys to be rejected")
+	}
+
+	err = initialiseJoinAuthConfig(&ScrimpConfig{TransportTLS: &TransportTLSConfig{}, JoinAuth: &JoinAuthConfig{PublicKeys: []string{"c2hvcnQ="}}})
+
+	if err == nil {
+		t.Error("expected an invalid public key to be rejected")
+	}
+}
+
+func TestIssueJoinTokenRequiresNode(t *testing.T) {
+	_, privateKey := newTestOperatorKey(t)
+
+	_, err := IssueJoinToken(privateKey, JoinClaims{Identity: "web"})
+
+	if err == nil {
+		t.Error("expected a token without a node name to be refused")
+	}
+}
+
+func TestVerifyJoinToken(t *testing.T) {
+	joinAuth, privateKey := newTestJoinAuth(t)
+	_, untrustedKey := newTestOperatorKey(t)
+
+	now := time.Now()
+	claims := JoinClaims{Identity: "web", Node: "web1", Expires: now.Add(time.Hour)}
+	token := issueTestJoinToken(t, privateKey, claims)
+
+	verified, err := joinAuth.verifyJoinToken(token, now)
+
+	if err != nil {
+		t.Fatalf("couldn't verify join token: %v", err)
+	}
+
+	if verified.Identity != "web" || verified.Node != "web1" {
+		t.Errorf("unexpected claims %+v", verified)
+	}
+
+	_, err = joinAuth.verifyJoinToken(token, now.Add(2*time.Hour))
+
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected an expired token to be rejected but got %v", err)
+	}
+
+	_, err = joinAuth.verifyJoinToken(issueTestJoinToken(t, untrustedKey, claims), now)
+
+	if err == nil || !strings.Contains(err.Error(), "trusted key") {
+		t.Errorf("expected a token signed by an untrusted key to be rejected but got %v", err)
+	}
+
+	// claims from one token with the signature of another
+	forged := issueTestJoinToken(t, untrustedKey, JoinClaims{Identity: "web", Node: "web1", LoadBalancer: true})
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+
+	_, err = joinAuth.verifyJoinToken(tampered, now)
+
+	if err == nil {
+		t.Error("expected a token with a mismatched signature to be rejected")
+	}
+
+	for _, malformed := range []string{"", "no-signature", "a.b.c", "!!.!!"} {
+		_, err = joinAuth.verifyJoinToken(malformed, now)
+
+		if err == nil {
+			t.Errorf("expected malformed token '%s' to be rejected", malformed)
+		}
+	}
+}
+
+func TestAuthorise(t *testing.T) {
+	joinAuth, privateKey := newTestJoinAuth(t)
+	joinAuth.Identities = map[string][]string{"web": {"*.example.org", "www.example.com"}}
+
+	now := time.Now()
+	node := &memberlist.Node{Name: "web1"}
+
+	backendToken := issueTestJoinToken(t, privateKey, JoinClaims{Identity: "web", Node: "web1", Domains: []string{"*.example.org", "www.example.com", "api.example.com"}})
+	lbToken := issueTestJoinToken(t, privateKey, JoinClaims{Identity: "lb", Node: "web1", LoadBalancer: true})
+
+	// IssueJoinToken refuses to make a token without a node name, but older
+	// tokens may not have one
+	unbound, err := signPayload(privateKey, JoinClaims{Identity: "web", Domains: []string{"www.example.com"}})
+
+	if err != nil {
+		t.Fatalf("couldn't sign unbound token: %v", err)
+	}
+
+	backend := func(token string, domains ...string) *BackendMetadata {
+		return &BackendMetadata{Type: "backend", Token: token, Applications: []JSONApplication{{Name: "web", Domains: domains}}}
+	}
+
+	tests := []struct {
+		name       string
+		node       *memberlist.Node
+		meta       *BackendMetadata
+		shouldPass bool
+	}{
+		{"allowed backend", node, backend(backendToken, "www.example.com", "a.example.org"), true},
+		{"backend joining as load balancer", node, &BackendMetadata{Type: "load-balancer", Token: backendToken}, false},
+		{"load balancer", node, &BackendMetadata{Type: "load-balancer", Token: lbToken}, true},
+		{"load balancer serving domains", node, backend(lbToken, "www.example.com"), false},
+		{"domain outside token", node, backend(backendToken, "evil.example.net"), false},
+		{"domain outside identity policy", node, backend(backendToken, "api.example.com"), false},
+		{"other node name", &memberlist.Node{Name: "web2"}, backend(backendToken, "www.example.com"), false},
+		{"token without node", node, backend(unbound, "www.example.com"), false},
+		{"unknown type", node, &BackendMetadata{Type: "database", Token: lbToken}, false},
+		{"no token", node, backend("", "www.example.com"), false},
+	}
+
+	for _, test := range tests {
+		err := joinAuth.authorise(test.node, test.meta, now)
+
+		if test.shouldPass && err != nil {
+			t.Errorf("%s: expected to be authorised but got %v", test.name, err)
+		}
+
+		if !test.shouldPass && err == nil {
+			t.Errorf("%s: expected not to be authorised", test.name)
+		}
+	}
+}
+
+func TestMatchesAnyDomain(t *testing.T) {
+	patterns := []string{"www.example.com", "*.Example.org"}
+
+	tests := []struct {
+		domain   string
+		expected bool
+	}{
+		{"www.example.com", true},
+		{"WWW.example.com", true},
+		{"example.com", false},
+		{"api.example.com", false},
+		{"a.example.org", true},
+		{"a.b.example.org", true},
+		{"A.EXAMPLE.ORG", true},
+		{"example.org", false},
+		{"badexample.org", false},
+		{"a.example.org.evil.net", false},
+	}
+
+	for _, test := range tests {
+		if matchesAnyDomain(patterns, test.domain) != test.expected {
+			t.Errorf("expected matching '%s' against %v to be %v", test.domain, patterns, test.expected)
+		}
+	}
+
+	if matchesAnyDomain(nil, "www.example.com") {
+		t.Error("expected no patterns to match nothing")
+	}
+}
@@ -0,0 +1,445 @@
+package scrimplb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// EncryptionKeysEnv can hold a comma-separated list of base64 encoded gossip
+// encryption keys, the first of which is the primary key. It's used if no keys
+// are given in config.
+const EncryptionKeysEnv = "SCRIMPLB_ENCRYPTION_KEYS"
+
+const (
+	// keyringMessagePrefix marks a user message between nodes as a signed
+	// keyring change. memberlist doesn't tell us which node sent a message,
+	// so changes are trusted for their signature rather than their sender.
+	keyringMessagePrefix byte = 'K'
+
+	// keyringChangeMaxAge is how long after being signed a keyring change
+	// can be applied
+	keyringChangeMaxAge = 5 * time.Minute
+
+	// KeyringOpList lists installed keys without changing anything
+	KeyringOpList = "list"
+
+	// KeyringOpInstall adds a key to the keyring, which is then used to try
+	// to decrypt incoming messages
+	KeyringOpInstall = "install"
+
+	// KeyringOpUse makes an installed key the primary key, which is used to
+	// encrypt outgoing messages
+	KeyringOpUse = "use"
+
+	// KeyringOpRemove removes a key which isn't the primary key
+	KeyringOpRemove = "remove"
+)
+
+// GenerateEncryptionKey returns a new random 32 byte key, base64 encoded as
+// expected by config
+func GenerateEncryptionKey() (string, error) {
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate encryption key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeEncryptionKey(raw string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	err = memberlist.ValidateKey(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	return key, nil
+}
+
+// initKeyring loads gossip encryption keys from, in order of preference, the
+// key file, the config file or the environment. If no keys are given, gossip
+// is unencrypted.
+func initKeyring(config *ScrimpConfig) error {
+	operatorKeys, err := parsePublicKeys(config.KeyringOperatorKeys, "keyring-operator-keys")
+
+	if err != nil {
+		return err
+	}
+
+	config.keyringOperatorKeys = operatorKeys
+
+	rawKeys := config.EncryptionKeys
+
+	if config.EncryptionKeyFile != "" {
+		fileKeys, err := readKeyFile(config.EncryptionKeyFile)
+
+		if err != nil {
+			return err
+		}
+
+		if len(fileKeys) > 0 {
+			rawKeys = fileKeys
+		}
+	}
+
+	if len(rawKeys) == 0 && os.Getenv(EncryptionKeysEnv) != "" {
+		rawKeys = strings.Split(os.Getenv(EncryptionKeysEnv), ",")
+	}
+
+	if len(rawKeys) == 0 {
+		if config.EncryptionKeyFile != "" {
+			return fmt.Errorf("no encryption keys found in %s", config.EncryptionKeyFile)
+		}
+
+		log.Println("Warning: No encryption keys given; gossip is unencrypted and any host can join")
+		return nil
+	}
+
+	var keys [][]byte
+
+	for _, raw := range rawKeys {
+		key, err := decodeEncryptionKey(raw)
+
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, key)
+	}
+
+	keyring, err := memberlist.NewKeyring(keys, keys[0])
+
+	if err != nil {
+		return fmt.Errorf("couldn't create keyring: %w", err)
+	}
+
+	config.Keyring = keyring
+	return nil
+}
+
+// readKeyFile reads base64 encoded keys, one per line, from the given path.
+// A missing file is treated as having no keys.
+func readKeyFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("couldn't read encryption key file: %w", err)
+	}
+
+	var keys []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keys = append(keys, line)
+	}
+
+	return keys, nil
+}
+
+// writeKeyFile atomically replaces the key file with the keyring's keys, so
+// that rotations survive a restart
+func writeKeyFile(path string, keyring *memberlist.Keyring) error {
+	var buf bytes.Buffer
+
+	for _, key := range keyring.GetKeys() {
+		buf.WriteString(base64.StdEncoding.EncodeToString(key))
+		buf.WriteString("\n")
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary key file: %w", err)
+	}
+
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(buf.Bytes())
+
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("couldn't write temporary key file: %w", err)
+	}
+
+	err = tmpFile.Close()
+
+	if err != nil {
+		return fmt.Errorf("couldn't close temporary key file: %w", err)
+	}
+
+	err = os.Rename(tmpFile.Name(), path)
+
+	if err != nil {
+		return fmt.Errorf("couldn't replace key file: %w", err)
+	}
+
+	return nil
+}
+
+// KeyringChange is a change to every node's keyring. It's signed with an
+// operator's private key by SignKeyringChange, and nodes only apply changes
+// signed by one of their keyring-operator-keys.
+type KeyringChange struct {
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`
+	Issued time.Time `json:"issued"`
+}
+
+// SignKeyringChange signs a keyring change with a base64 encoded ed25519
+// private key, as generated by GenerateJoinAuthKey
+func SignKeyringChange(privateKey string, op string, key string) (string, error) {
+	switch op {
+	case KeyringOpInstall, KeyringOpUse, KeyringOpRemove:
+
+	default:
+		return "", fmt.Errorf("unknown keyring operation '%s'", op)
+	}
+
+	_, err := decodeEncryptionKey(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	return signPayload(privateKey, KeyringChange{
+		Op:     op,
+		Key:    strings.TrimSpace(key),
+		Issued: time.Now().UTC(),
+	})
+}
+
+// verifyKeyringChange checks a signed change against the operator keys and
+// rejects it if it's stale or has been seen before. Every signed change can
+// only be applied once, so a change copied off the wire can't be replayed to
+// undo a later rotation.
+func (n *Node) verifyKeyringChange(signed string, now time.Time) (*KeyringChange, error) {
+	if len(n.config.keyringOperatorKeys) == 0 {
+		return nil, errors.New("keyring changes aren't accepted without keyring-operator-keys")
+	}
+
+	payload, err := openSignedPayload(signed, n.config.keyringOperatorKeys, "keyring change")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var change KeyringChange
+
+	err = json.Unmarshal(payload, &change)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse keyring change: %w", err)
+	}
+
+	if now.Sub(change.Issued) > keyringChangeMaxAge || change.Issued.Sub(now) > keyringChangeMaxAge {
+		return nil, fmt.Errorf("keyring change issued at %v is outside the allowed window of %v", change.Issued, keyringChangeMaxAge)
+	}
+
+	for seen, expires := range n.keyringSeen {
+		if now.After(expires) {
+			delete(n.keyringSeen, seen)
+		}
+	}
+
+	if _, ok := n.keyringSeen[signed]; ok {
+		return nil, errors.New("keyring change has already been received")
+	}
+
+	// changes are only accepted within keyringChangeMaxAge of being issued,
+	// so they needn't be remembered for any longer than that
+	n.keyringSeen[signed] = change.Issued.Add(keyringChangeMaxAge)
+
+	return &change, nil
+}
+
+// applyKeyringChange verifies a signed keyring change and applies it to this
+// node only, persisting the result to the key file
+func (n *Node) applyKeyringChange(signed string) (*KeyringChange, error) {
+	keyring := n.config.Keyring
+
+	if keyring == nil {
+		return nil, errors.New("gossip encryption isn't enabled on this node")
+	}
+
+	// keys loaded from config or the environment would be lost on restart,
+	// leaving the node unable to talk to a cluster which has rotated
+	if n.config.EncryptionKeyFile == "" {
+		return nil, errors.New("keyring changes aren't accepted without an encryption-key-file to persist them")
+	}
+
+	n.keyringLock.Lock()
+	defer n.keyringLock.Unlock()
+
+	change, err := n.verifyKeyringChange(signed, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodeEncryptionKey(change.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch change.Op {
+	case KeyringOpInstall:
+		err = keyring.AddKey(key)
+
+	case KeyringOpUse:
+		err = keyring.UseKey(key)
+
+	case KeyringOpRemove:
+		err = keyring.RemoveKey(key)
+
+	default:
+		return nil, fmt.Errorf("unknown keyring operation '%s'", change.Op)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't %s key: %w", change.Op, err)
+	}
+
+	log.Printf("applied keyring operation '%s'\n", change.Op)
+
+	err = writeKeyFile(n.config.EncryptionKeyFile, keyring)
+
+	if err != nil {
+		return nil, fmt.Errorf("applied keyring operation '%s' but couldn't persist it: %w", change.Op, err)
+	}
+
+	return change, nil
+}
+
+// KeyringResult describes the keys on this node after a keyring operation.
+// Delivered counts the nodes, including this one, to which a change was
+// delivered, and Errors maps the names of nodes it couldn't be delivered to
+// to the error. Other nodes verify and apply a change after it's delivered,
+// and only log any failure, so check their keys to confirm a rotation.
+type KeyringResult struct {
+	Keys       []string          `json:"keys"`
+	PrimaryKey string            `json:"primary-key"`
+	Delivered  int               `json:"delivered"`
+	Errors     map[string]string `json:"errors,omitempty"`
+}
+
+// ChangeKeyring applies a change signed with SignKeyringChange to this node,
+// and then sends it to every other member of the cluster. Delivery uses
+// memberlist's reliable (TCP) messaging.
+func (n *Node) ChangeKeyring(signed string) (*KeyringResult, error) {
+	n.lock.Lock()
+	list := n.list
+	n.lock.Unlock()
+
+	if list == nil {
+		return nil, errors.New("node hasn't been started")
+	}
+
+	_, err := n.applyKeyringChange(signed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &KeyringResult{
+		Delivered: 1,
+		Errors:    make(map[string]string),
+	}
+
+	msg := append([]byte{keyringMessagePrefix}, signed...)
+	localName := list.LocalNode().Name
+
+	for _, member := range list.Members() {
+		if member.Name == localName {
+			continue
+		}
+
+		err = list.SendReliable(member, msg)
+
+		if err != nil {
+			result.Errors[member.Name] = err.Error()
+			continue
+		}
+
+		result.Delivered++
+	}
+
+	n.listKeys(result)
+
+	return result, nil
+}
+
+// ListKeys returns the keys installed on this node
+func (n *Node) ListKeys() (*KeyringResult, error) {
+	if n.config.Keyring == nil {
+		return nil, errors.New("gossip encryption isn't enabled on this node")
+	}
+
+	result := &KeyringResult{}
+	n.listKeys(result)
+
+	return result, nil
+}
+
+func (n *Node) listKeys(result *KeyringResult) {
+	for _, k := range n.config.Keyring.GetKeys() {
+		result.Keys = append(result.Keys, base64.StdEncoding.EncodeToString(k))
+	}
+
+	result.PrimaryKey = base64.StdEncoding.EncodeToString(n.config.Keyring.GetPrimaryKey())
+}
+
+// nodeDelegate wraps a load balancer or backend delegate to handle messages
+// which are common to every node
+type nodeDelegate struct {
+	memberlist.Delegate
+	node *Node
+}
+
+// NotifyMsg applies keyring changes sent by other nodes, and passes any other
+// messages on to the wrapped delegate
+func (d *nodeDelegate) NotifyMsg(msg []byte) {
+	if len(msg) == 0 || msg[0] != keyringMessagePrefix {
+		d.Delegate.NotifyMsg(msg)
+		return
+	}
+
+	_, err := d.node.applyKeyringChange(string(msg[1:]))
+
+	if err != nil {
+		log.Printf("couldn't apply keyring change: %v\n", err)
+	}
+}
@@ -0,0 +1,273 @@
+package scrimplb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestOperatorKey(t *testing.T) (string, string) {
+	t.Helper()
+
+	publicKey, privateKey, err := GenerateJoinAuthKey()
+
+	if err != nil {
+		t.Fatalf("couldn't generate operator key: %v", err)
+	}
+
+	return publicKey, privateKey
+}
+
+func newTestEncryptionKey(t *testing.T) string {
+	t.Helper()
+
+	key, err := GenerateEncryptionKey()
+
+	if err != nil {
+		t.Fatalf("couldn't generate encryption key: %v", err)
+	}
+
+	return key
+}
+
+func signTestKeyringChange(t *testing.T, privateKey string, op string, key string) string {
+	t.Helper()
+
+	change, err := SignKeyringChange(privateKey, op, key)
+
+	if err != nil {
+		t.Fatalf("couldn't sign keyring change: %v", err)
+	}
+
+	return change
+}
+
+// newTestKeyringNode creates a node whose only encryption key comes from
+// config, which trusts changes signed by the given operator key
+func newTestKeyringNode(t *testing.T, key string, operatorKey string, keyFile string) *Node {
+	t.Helper()
+
+	return newTestNode(t, fmt.Sprintf(`{
+		"lb": true, "bind-address": "127.0.0.1", "port": "0", "resolver": "dummy", "leave-timeout": "1s",
+		"encryption-keys": [%q], "encryption-key-file": %q, "keyring-operator-keys": [%q]
+	}`, key, keyFile, operatorKey))
+}
+
+func assertKeyCount(t *testing.T, node *Node, expected int) {
+	t.Helper()
+
+	if keys := node.config.Keyring.GetKeys(); len(keys) != expected {
+		t.Errorf("expected %d keys but got %d", expected, len(keys))
+	}
+}
+
+func TestSignKeyringChange(t *testing.T) {
+	_, privateKey := newTestOperatorKey(t)
+	key := newTestEncryptionKey(t)
+
+	_, err := SignKeyringChange(privateKey, KeyringOpList, key)
+
+	if err == nil {
+		t.Error("expected listing keys not to be signable")
+	}
+
+	_, err = SignKeyringChange(privateKey, KeyringOpInstall, "not-a-key")
+
+	if err == nil {
+		t.Error("expected an invalid encryption key to be rejected")
+	}
+
+	_, err = SignKeyringChange("not-a-private-key", KeyringOpInstall, key)
+
+	if err == nil {
+		t.Error("expected an invalid private key to be rejected")
+	}
+}
+
+func TestVerifyKeyringChange(t *testing.T) {
+	publicKey, privateKey := newTestOperatorKey(t)
+	_, untrustedKey := newTestOperatorKey(t)
+	key := newTestEncryptionKey(t)
+
+	operatorKeys, err := parsePublicKeys([]string{publicKey}, "test")
+
+	if err != nil {
+		t.Fatalf("couldn't parse operator key: %v", err)
+	}
+
+	node := &Node{
+		config:      &ScrimpConfig{keyringOperatorKeys: operatorKeys},
+		keyringSeen: make(map[string]time.Time),
+	}
+
+	now := time.Now()
+	signed := signTestKeyringChange(t, privateKey, KeyringOpInstall, key)
+
+	change, err := node.verifyKeyringChange(signed, now)
+
+	if err != nil {
+		t.Fatalf("expected a change signed by an operator key to be accepted but got %v", err)
+	}
+
+	if change.Op != KeyringOpInstall || change.Key != key {
+		t.Errorf("unexpected keyring change %+v", change)
+	}
+
+	_, err = node.verifyKeyringChange(signed, now)
+
+	if err == nil {
+		t.Error("expected a replayed change to be rejected")
+	}
+
+	_, err = node.verifyKeyringChange(signed, now.Add(keyringChangeMaxAge+time.Second))
+
+	if err == nil {
+		t.Error("expected a stale change to be rejected")
+	}
+
+	_, err = node.verifyKeyringChange(signTestKeyringChange(t, privateKey, KeyringOpUse, key), now.Add(-keyringChangeMaxAge-time.Second))
+
+	if err == nil {
+		t.Error("expected a change issued in the future to be rejected")
+	}
+
+	_, err = node.verifyKeyringChange(signTestKeyringChange(t, untrustedKey, KeyringOpUse, key), now)
+
+	if err == nil {
+		t.Error("expected a change signed by an untrusted key to be rejected")
+	}
+
+	forged := strings.Split(signTestKeyringChange(t, untrustedKey, KeyringOpRemove, key), ".")
+	tampered := forged[0] + "." + strings.Split(signed, ".")[1]
+
+	_, err = node.verifyKeyringChange(tampered, now)
+
+	if err == nil {
+		t.Error("expected a change with another change's signature to be rejected")
+	}
+
+	node.config.keyringOperatorKeys = nil
+
+	_, err = node.verifyKeyringChange(signTestKeyringChange(t, privateKey, KeyringOpUse, key), now)
+
+	if err == nil {
+		t.Error("expected changes to be rejected without operator keys")
+	}
+}
+
+func TestKeyringChangeRequiresKeyFile(t *testing.T) {
+	publicKey, privateKey := newTestOperatorKey(t)
+
+	node := newTestKeyringNode(t, newTestEncryptionKey(t), publicKey, "")
+
+	_, err := node.applyKeyringChange(signTestKeyringChange(t, privateKey, KeyringOpInstall, newTestEncryptionKey(t)))
+
+	if err == nil {
+		t.Error("expected a keyring change to be refused without a key file")
+	}
+
+	assertKeyCount(t, node, 1)
+}
+
+func TestKeyringChangePersistsConfigKeys(t *testing.T) {
+	publicKey, privateKey := newTestOperatorKey(t)
+	oldKey := newTestEncryptionKey(t)
+	newKey := newTestEncryptionKey(t)
+	keyFile := filepath.Join(t.TempDir(), "keys")
+
+	// the key file doesn't exist yet, so the key is loaded from config
+	node := newTestKeyringNode(t, oldKey, publicKey, keyFile)
+
+	_, err := node.applyKeyringChange(signTestKeyringChange(t, privateKey, KeyringOpInstall, newKey))
+
+	if err != nil {
+		t.Fatalf("couldn't apply keyring change: %v", err)
+	}
+
+	keys, err := readKeyFile(keyFile)
+
+	if err != nil {
+		t.Fatalf("couldn't read key file: %v", err)
+	}
+
+	if len(keys) != 2 || keys[0] != oldKey || keys[1] != newKey {
+		t.Errorf("expected the config key and installed key to be persisted but got %v", keys)
+	}
+}
+
+func TestNotifyMsgIgnoresUnsignedKeyringChange(t *testing.T) {
+	publicKey, _ := newTestOperatorKey(t)
+	key := newTestEncryptionKey(t)
+
+	node := newTestKeyringNode(t, key, publicKey, filepath.Join(t.TempDir(), "keys"))
+	delegate := &nodeDelegate{node: node}
+
+	delegate.NotifyMsg([]byte(fmt.Sprintf(`K{"op": "install", "key": %q}`, newTestEncryptionKey(t))))
+
+	assertKeyCount(t, node, 1)
+}
+
+func TestChangeKeyringAcrossCluster(t *testing.T) {
+	publicKey, privateKey := newTestOperatorKey(t)
+	oldKey := newTestEncryptionKey(t)
+	newKey := newTestEncryptionKey(t)
+	dir := t.TempDir()
+
+	first := newTestKeyringNode(t, oldKey, publicKey, filepath.Join(dir, "first"))
+	first.memberlistConfig.Name = "first"
+
+	err := first.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start first node: %v", err)
+	}
+
+	t.Cleanup(func() { first.Stop(context.Background()) })
+
+	second := newTestNode(t, fmt.Sprintf(`{
+		"lb": true, "bind-address": "127.0.0.1", "port": "0", "resolver": "dummy", "leave-timeout": "1s",
+		"provider": "manual", "provider-config": {"ip": "127.0.0.1", "port": "%d"},
+		"encryption-keys": [%q], "encryption-key-file": %q, "keyring-operator-keys": [%q]
+	}`, first.LocalNode().Port, oldKey, filepath.Join(dir, "second"), publicKey))
+	second.memberlistConfig.Name = "second"
+
+	err = second.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start second node: %v", err)
+	}
+
+	t.Cleanup(func() { second.Stop(context.Background()) })
+
+	result, err := first.ChangeKeyring(signTestKeyringChange(t, privateKey, KeyringOpInstall, newKey))
+
+	if err != nil {
+		t.Fatalf("couldn't change keyring: %v", err)
+	}
+
+	if result.Delivered != 2 || len(result.Errors) != 0 || len(result.Keys) != 2 {
+		t.Errorf("unexpected keyring result %+v", result)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(second.config.Keyring.GetKeys()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assertKeyCount(t, second, 2)
+
+	newKeyBytes, err := base64.StdEncoding.DecodeString(newKey)
+
+	if err != nil {
+		t.Fatalf("couldn't decode key: %v", err)
+	}
+
+	if string(second.config.Keyring.GetKeys()[1]) != string(newKeyBytes) {
+		t.Error("expected the second node to install the new key")
+	}
+}
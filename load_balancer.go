@@ -16,14 +16,20 @@ import (
 
 // LoadBalancerConfig describes configuration options specific to load balancers.
 type LoadBalancerConfig struct {
-	PushPeriodRaw        string `json:"push-period"`
-	PushJitterRaw        string `json:"jitter"`
-	GeneratorType        string `json:"generator"`
-	GeneratorTarget      string `json:"generator-target"`
-	GeneratorPrintStdout bool   `json:"generator-stdout"`
-	TLSChainLocation     string `json:"tls-chain-location"`
-	TLSKeyLocation       string `json:"tls-key-location"`
+	PushPeriodRaw        string                 `json:"push-period"`
+	PushJitterRaw        string                 `json:"jitter"`
+	GeneratorType        string                 `json:"generator"`
+	GeneratorConfig      map[string]interface{} `json:"generator-config"`
+	GeneratorTarget      string                 `json:"generator-target"`
+	GeneratorPrintStdout bool                   `json:"generator-stdout"`
+	TLSChainLocation     string                 `json:"tls-chain-location"`
+	TLSKeyLocation       string                 `json:"tls-key-location"`
+	RemoveSeedOnShutdown bool                   `json:"remove-seed-on-shutdown"`
+	Webhooks             []*WebhookConfig       `json:"webhooks"`
+	DomainConflictPolicy string                 `json:"domain-conflict-policy"`
+	DomainAllowlistFile  string                 `json:"domain-allowlist-file"`
 	Generator            Generator
+	DomainPolicy         *DomainPolicy
 	PushPeriod           time.Duration
 	PushJitter           time.Duration
 }
@@ -75,19 +81,24 @@ func initialiseLoadBalancerConfig(config *ScrimpConfig) error {
 
 	config.LoadBalancerConfig.PushJitter = pushJitter
 
-	switch config.LoadBalancerConfig.GeneratorType {
-	case "dummy":
-		config.LoadBalancerConfig.Generator = DummyGenerator{}
+	config.LoadBalancerConfig.Generator, err = NewGenerator(config.LoadBalancerConfig.GeneratorType, config.LoadBalancerConfig.GeneratorConfig)
 
-	case "nginx":
-		config.LoadBalancerConfig.Generator = NginxGenerator{}
-
-	default:
-		err = fmt.Errorf("invalid generator type %s", config.LoadBalancerConfig.GeneratorType)
+	if err != nil {
+		return fmt.Errorf("couldn't create generator: %w", err)
 	}
 
+	config.LoadBalancerConfig.DomainPolicy, err = NewDomainPolicy(config.LoadBalancerConfig.DomainConflictPolicy, config.LoadBalancerConfig.DomainAllowlistFile)
+
 	if err != nil {
-		return fmt.Errorf("couldn't create generator: %w", err)
+		return err
+	}
+
+	for _, webhook := range config.LoadBalancerConfig.Webhooks {
+		err = initialiseWebhookConfig(webhook)
+
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -99,14 +110,24 @@ type LoadBalancerDelegate struct {
 	metadata []byte
 }
 
-// NewLoadBalancerDelegate creates a LoadBalancerDelegate from a channel which is used to receive work tasks
-func NewLoadBalancerDelegate(ch chan<- string) (*LoadBalancerDelegate, error) {
-	rawMetadata := []byte(`{"type": "load-balancer"}`)
+// NewLoadBalancerDelegate creates a LoadBalancerDelegate from a channel which
+// is used to receive work tasks, advertising the given cluster name and join
+// token if any
+func NewLoadBalancerDelegate(ch chan<- string, cluster string, token string) (*LoadBalancerDelegate, error) {
+	rawMetadata, err := json.Marshal(BackendMetadata{
+		Type:    "load-balancer",
+		Token:   token,
+		Cluster: cluster,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal load balancer metadata: %w", err)
+	}
 
 	var buf bytes.Buffer
 	gzipWriter := gzip.NewWriter(&buf)
 
-	_, err := gzipWriter.Write(rawMetadata)
+	_, err = gzipWriter.Write(rawMetadata)
 
 	if err != nil {
 		return nil, fmt.Errorf("couldn't compress load balancer metadata: %w", err)
@@ -118,6 +139,10 @@ func NewLoadBalancerDelegate(ch chan<- string) (*LoadBalancerDelegate, error) {
 		return nil, fmt.Errorf("couldn't close gzip writer: %w", err)
 	}
 
+	if buf.Len() > memberlist.MetaMaxSize {
+		return nil, fmt.Errorf("compressed load balancer metadata is %d bytes, more than memberlist's limit of %d", buf.Len(), memberlist.MetaMaxSize)
+	}
+
 	return &LoadBalancerDelegate{
 		ch,
 		buf.Bytes(),
@@ -154,6 +179,7 @@ func (d *LoadBalancerDelegate) MergeRemoteState(buf []byte, join bool) {
 type LoadBalancerState struct {
 	MemberMap  map[Upstream][]Application
 	memberLock sync.RWMutex
+	joined     map[Upstream]time.Time
 }
 
 // NewLoadBalancerState creates a load balancer state
@@ -161,21 +187,28 @@ func NewLoadBalancerState() LoadBalancerState {
 	return LoadBalancerState{
 		make(map[Upstream][]Application),
 		sync.RWMutex{},
+		make(map[Upstream]time.Time),
 	}
 }
 
 // LoadBalancerEventDelegate listens for events and updates load balancer state
-// based on node metadata
+// based on node metadata. Every change is published to Events, and a snapshot
+// of the new state is sent to UpstreamNotificationChannel for the generator.
+// The channel should have a buffer of one; a snapshot which hasn't been
+// received yet is replaced by the newer one, so sending never blocks
+// memberlist even before anything is receiving.
 type LoadBalancerEventDelegate struct {
 	State                       LoadBalancerState
-	UpstreamNotificationChannel chan<- *LoadBalancerState
+	UpstreamNotificationChannel chan Topology
+	Events                      *EventBus
 }
 
 // NewLoadBalancerEventDelegate creates a new LoadBalancerEventDelegate
-func NewLoadBalancerEventDelegate(notificationChannel chan<- *LoadBalancerState) LoadBalancerEventDelegate {
+func NewLoadBalancerEventDelegate(notificationChannel chan Topology, events *EventBus) LoadBalancerEventDelegate {
 	return LoadBalancerEventDelegate{
 		State:                       NewLoadBalancerState(),
 		UpstreamNotificationChannel: notificationChannel,
+		Events:                      events,
 	}
 }
 
@@ -212,6 +245,20 @@ func parseMetadata(node *memberlist.Node) (*BackendMetadata, error) {
 
 // NotifyJoin adds new nodes to load balancer state
 func (d *LoadBalancerEventDelegate) NotifyJoin(node *memberlist.Node) {
+	d.handleNode(node, EventBackendJoined)
+}
+
+// NotifyLeave removes existing nodes from load balancer state
+func (d *LoadBalancerEventDelegate) NotifyLeave(node *memberlist.Node) {
+	d.handleNode(node, EventBackendLeft)
+}
+
+// NotifyUpdate updates existing nodes in load balancer state
+func (d *LoadBalancerEventDelegate) NotifyUpdate(node *memberlist.Node) {
+	d.handleNode(node, EventBackendUpdated)
+}
+
+func (d *LoadBalancerEventDelegate) handleNode(node *memberlist.Node, eventType EventType) {
 	d.State.memberLock.Lock()
 	defer d.State.memberLock.Unlock()
 
@@ -222,73 +269,92 @@ func (d *LoadBalancerEventDelegate) NotifyJoin(node *memberlist.Node) {
 		return
 	}
 
-	if otherMeta.Type == "backend" {
-		key := Upstream{
-			node.Name,
-			node.Addr.String(),
-		}
+	if otherMeta.Type != "backend" {
+		return
+	}
 
-		var apps []Application
+	key := Upstream{
+		node.Name,
+		node.Addr.String(),
+	}
+
+	var apps []Application
 
+	if eventType != EventBackendLeft {
 		for _, v := range otherMeta.Applications {
 			apps = append(apps, v.ToApplication())
 		}
-
-		delete(d.State.MemberMap, key)
-		d.State.MemberMap[key] = apps
-		d.UpstreamNotificationChannel <- &d.State
 	}
-}
 
-// NotifyLeave removes existing nodes from load balancer state
-func (d *LoadBalancerEventDelegate) NotifyLeave(node *memberlist.Node) {
-	d.State.memberLock.Lock()
-	defer d.State.memberLock.Unlock()
+	oldState := newTopology(d.State.MemberMap, d.State.joined)
+	oldApps := d.State.MemberMap[key]
 
-	otherMeta, err := parseMetadata(node)
+	delete(d.State.MemberMap, key)
 
-	if err != nil {
-		log.Printf("couldn't parse node metadata: %v", err)
-		return
-	}
+	if eventType == EventBackendLeft {
+		delete(d.State.joined, key)
+	} else {
+		d.State.MemberMap[key] = apps
+
+		// a backend can't claim to have started before this load balancer
+		// first saw it, but a later start time means it has restarted
+		joined, ok := d.State.joined[key]
+
+		if !ok {
+			joined = time.Now()
+		}
 
-	if otherMeta.Type == "backend" {
-		key := Upstream{
-			node.Name,
-			node.Addr.String(),
+		if started := time.Unix(otherMeta.Started, 0); otherMeta.Started != 0 && started.After(joined) {
+			joined = started
 		}
 
-		delete(d.State.MemberMap, key)
-		d.UpstreamNotificationChannel <- &d.State
+		d.State.joined[key] = joined
 	}
-}
 
-// NotifyUpdate updates existing nodes in load balancer state
-func (d *LoadBalancerEventDelegate) NotifyUpdate(node *memberlist.Node) {
-	d.State.memberLock.Lock()
-	defer d.State.memberLock.Unlock()
+	newState := newTopology(d.State.MemberMap, d.State.joined)
 
-	otherMeta, err := parseMetadata(node)
+	if d.Events != nil {
+		now := time.Now()
+		events := []Event{{
+			Type:     eventType,
+			Time:     now,
+			Upstream: key,
+			Old:      oldState,
+			New:      newState,
+		}}
 
-	if err != nil {
-		log.Printf("couldn't parse node metadata: %v", err)
-		return
-	}
+		added, removed := diffApplications(oldApps, apps)
 
-	if otherMeta.Type == "backend" {
-		key := Upstream{
-			node.Name,
-			node.Addr.String(),
+		for _, app := range added {
+			events = append(events, Event{Type: EventApplicationAdded, Time: now, Upstream: key, Application: app, Old: oldState, New: newState})
 		}
 
-		var apps []Application
-
-		for _, v := range otherMeta.Applications {
-			apps = append(apps, v.ToApplication())
+		for _, app := range removed {
+			events = append(events, Event{Type: EventApplicationRemoved, Time: now, Upstream: key, Application: app, Old: oldState, New: newState})
 		}
 
-		delete(d.State.MemberMap, key)
-		d.State.MemberMap[key] = apps
-		d.UpstreamNotificationChannel <- &d.State
+		d.Events.Publish(events...)
+	}
+
+	d.notifyUpstream(newState)
+}
+
+// notifyUpstream sends the topology without blocking, replacing any topology
+// which hasn't been received yet. It's only called with memberLock held, so
+// there's never another sender to fill the channel after it's drained.
+func (d *LoadBalancerEventDelegate) notifyUpstream(topology Topology) {
+	select {
+	case d.UpstreamNotificationChannel <- topology:
+		return
+
+	default:
 	}
+
+	select {
+	case <-d.UpstreamNotificationChannel:
+
+	default:
+	}
+
+	d.UpstreamNotificationChannel <- topology
 }
@@ -0,0 +1,72 @@
+package scrimplb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func newTestBackendNode(t *testing.T, name string, started time.Time, domain string) *memberlist.Node {
+	t.Helper()
+
+	raw, err := json.Marshal(BackendMetadata{
+		Type: "backend",
+		Applications: []JSONApplication{{
+			Name:            name,
+			ListenPort:      "443",
+			ApplicationPort: "8443",
+			Protocol:        "https",
+			Domains:         []string{domain},
+		}},
+		Started: started.Unix(),
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't marshal metadata: %v", err)
+	}
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	gzipWriter.Write(raw)
+	gzipWriter.Close()
+
+	return &memberlist.Node{Name: name, Addr: net.ParseIP("10.0.0.1"), Meta: buf.Bytes()}
+}
+
+func TestFirstSeenIgnoresClaimedStartTimes(t *testing.T) {
+	now := time.Now()
+
+	policy, err := NewDomainPolicy(DomainConflictFirstSeen, "")
+
+	if err != nil {
+		t.Fatalf("couldn't create policy: %v", err)
+	}
+
+	delegate := NewLoadBalancerEventDelegate(make(chan Topology, 1), nil)
+
+	delegate.NotifyJoin(newTestBackendNode(t, "web", now.Add(-time.Minute), "www.example.com"))
+	time.Sleep(time.Millisecond)
+
+	// a backend which joins later can't win by claiming to be older
+	delegate.NotifyJoin(newTestBackendNode(t, "imposter", now.Add(-24*time.Hour), "www.example.com"))
+
+	_, conflicts := policy.Resolve(<-delegate.UpstreamNotificationChannel)
+
+	if len(conflicts) != 1 || len(conflicts[0].Allowed) != 1 || conflicts[0].Allowed[0].Name != "web" {
+		t.Errorf("expected the backend seen first to win but got %v", conflicts)
+	}
+
+	// a backend which restarts goes to the back of the queue
+	delegate.NotifyUpdate(newTestBackendNode(t, "web", time.Now().Add(time.Minute), "www.example.com"))
+
+	_, conflicts = policy.Resolve(<-delegate.UpstreamNotificationChannel)
+
+	if len(conflicts) != 1 || len(conflicts[0].Allowed) != 1 || conflicts[0].Allowed[0].Name != "imposter" {
+		t.Errorf("expected a restarted backend to lose but got %v", conflicts)
+	}
+}
@@ -2,10 +2,16 @@ package scrimplb
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
+	"sort"
+	"strings"
 	"text/template"
+
+	"github.com/mitchellh/mapstructure"
 )
 
 const rawExtraConfig = `ssl_protocols TLSv1.2;
@@ -67,22 +73,202 @@ const defaultConfig = `server {
 // NginxGenerator produces nginx upstream blocks for use for by an nginx
 // load balancer
 type NginxGenerator struct {
+	// UpstreamTLS applies to every https application
+	UpstreamTLS UpstreamTLSOptions `mapstructure:"upstream-tls"`
+
+	// ApplicationUpstreamTLS applies to https applications with the given
+	// name, taking precedence over UpstreamTLS and options advertised by
+	// backends
+	ApplicationUpstreamTLS map[string]UpstreamTLSOptions `mapstructure:"application-upstream-tls"`
 }
 
-// GenerateConfig returns nginx upstream config for the given UpstreamApplicationMap
-func (n NginxGenerator) GenerateConfig(upstreamMap map[Upstream][]Application, config *ScrimpConfig) (string, error) {
-	// TODO: this should be another template in the long term
-	extraConfig := fmt.Sprintf(rawExtraConfig, config.LoadBalancerConfig.TLSChainLocation, config.LoadBalancerConfig.TLSKeyLocation)
+// UpstreamTLSOptions control how nginx connects to https applications.
+// Verification can be turned on by the load balancer or requested by a
+// backend, but not turned off by either, and requires a trusted certificate.
+type UpstreamTLSOptions struct {
+	Verify             bool
+	VerifyDepth        int    `mapstructure:"verify-depth"`
+	TrustedCertificate string `mapstructure:"trusted-certificate"`
+	ServerName         string `mapstructure:"server-name"`
+	ClientCertificate  string `mapstructure:"client-certificate"`
+	ClientKey          string `mapstructure:"client-key"`
+}
+
+// NewNginxGenerator creates an NginxGenerator from "generator-config", which
+// may be nil
+func NewNginxGenerator(config map[string]interface{}) (*NginxGenerator, error) {
+	var generator NginxGenerator
+
+	err := mapstructure.Decode(config, &generator)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse nginx generator config: %w", err)
+	}
 
-	applicationToAddress := make(map[Application][]string)
+	err = generator.UpstreamTLS.validate()
 
-	for upstream, apps := range upstreamMap {
-		for _, app := range apps {
-			applicationToAddress[app] = append(applicationToAddress[app], upstream.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream-tls: %w", err)
+	}
+
+	for name, options := range generator.ApplicationUpstreamTLS {
+		err = options.validate()
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream-tls for application '%s': %w", name, err)
 		}
 	}
 
-	if len(upstreamMap) == 0 {
+	return &generator, nil
+}
+
+func (o UpstreamTLSOptions) validate() error {
+	if (o.ClientCertificate == "") != (o.ClientKey == "") {
+		return errors.New("'client-certificate' and 'client-key' must be given together")
+	}
+
+	if o.VerifyDepth < 0 {
+		return errors.New("'verify-depth' can't be negative")
+	}
+
+	if o.ServerName != "" && !validHostname(o.ServerName) {
+		return fmt.Errorf("'server-name' %q isn't a valid host name", o.ServerName)
+	}
+
+	return nil
+}
+
+// validHostname returns true if name is made of dot separated labels of
+// letters, digits and hyphens, and so is safe to render into nginx config
+func validHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// upstreamTLSFor merges the options for an application, in increasing order
+// of precedence: the load balancer's defaults, those advertised by the backend
+// and the load balancer's options for the application
+func (n NginxGenerator) upstreamTLSFor(app Application) (UpstreamTLSOptions, error) {
+	options := n.UpstreamTLS
+	options.Verify = options.Verify || app.UpstreamVerify
+
+	if app.UpstreamServerName != "" {
+		if !validHostname(app.UpstreamServerName) {
+			return options, fmt.Errorf("backends advertise an invalid server-name %q", app.UpstreamServerName)
+		}
+
+		options.ServerName = app.UpstreamServerName
+	}
+
+	if override, ok := n.ApplicationUpstreamTLS[app.Name]; ok {
+		options.Verify = options.Verify || override.Verify
+
+		if override.VerifyDepth != 0 {
+			options.VerifyDepth = override.VerifyDepth
+		}
+
+		if override.TrustedCertificate != "" {
+			options.TrustedCertificate = override.TrustedCertificate
+		}
+
+		if override.ServerName != "" {
+			options.ServerName = override.ServerName
+		}
+
+		if override.ClientCertificate != "" {
+			options.ClientCertificate = override.ClientCertificate
+			options.ClientKey = override.ClientKey
+		}
+	}
+
+	if options.Verify && options.TrustedCertificate == "" {
+		return options, errors.New("upstream verification needs a 'trusted-certificate' in generator config")
+	}
+
+	return options, nil
+}
+
+// mergeApplications groups applications by name, since each name becomes a
+// single nginx upstream, returning the names in order, the application for
+// each and the address and port of every server for each. Upstreams are
+// visited in order of address so the result doesn't depend on map ordering.
+// Backends can only share an upstream if everything but their application
+// port matches, so a backend whose application differs from the first
+// backend's is logged and left out.
+func mergeApplications(upstreamMap map[Upstream][]Application) ([]string, map[string]Application, map[string][]string) {
+	upstreams := make([]Upstream, 0, len(upstreamMap))
+
+	for upstream := range upstreamMap {
+		upstreams = append(upstreams, upstream)
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].Address != upstreams[j].Address {
+			return upstreams[i].Address < upstreams[j].Address
+		}
+
+		return upstreams[i].Name < upstreams[j].Name
+	})
+
+	var names []string
+	applications := make(map[string]Application)
+	sources := make(map[string]Upstream)
+	servers := make(map[string][]string)
+
+	for _, upstream := range upstreams {
+		for _, app := range upstreamMap[upstream] {
+			merged, ok := applications[app.Name]
+
+			if !ok {
+				names = append(names, app.Name)
+				applications[app.Name] = app
+				sources[app.Name] = upstream
+			} else if !sameServer(merged, app) {
+				log.Printf("leaving backend %s out of application '%s': its listen port, protocol, domains or upstream TLS options differ from those on %s\n", upstream.Name, app.Name, sources[app.Name].Name)
+				continue
+			}
+
+			servers[app.Name] = append(servers[app.Name], net.JoinHostPort(upstream.Address, app.ApplicationPort))
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, applications, servers
+}
+
+// sameServer returns true if the applications only differ in their
+// application port, so that they can share an upstream and server block
+func sameServer(a Application, b Application) bool {
+	b.ApplicationPort = a.ApplicationPort
+	return a.Equal(b)
+}
+
+// GenerateConfig returns nginx upstream config for the given UpstreamApplicationMap.
+// Applications whose upstream TLS options are unusable are logged and left
+// out, rather than failing the whole config.
+func (n NginxGenerator) GenerateConfig(upstreamMap map[Upstream][]Application, config *ScrimpConfig) (string, error) {
+	// TODO: this should be another template in the long term
+	extraConfig := fmt.Sprintf(rawExtraConfig, config.LoadBalancerConfig.TLSChainLocation, config.LoadBalancerConfig.TLSKeyLocation)
+
+	names, applications, servers := mergeApplications(upstreamMap)
+
+	if len(names) == 0 {
 		// if there's no upstream, use default config.
 		// the default config is hardcoded for now
 
@@ -90,8 +276,8 @@ func (n NginxGenerator) GenerateConfig(upstreamMap map[Upstream][]Application, c
 	}
 
 	tmpl := template.New("upstream")
-	upstreamTemplate, err := tmpl.Parse(`upstream {{.Name}} { {{range .Addresses}}
-	server {{.}}:{{$.ApplicationPort}};{{end}}
+	upstreamTemplate, err := tmpl.Parse(`upstream {{.Name}} { {{range .Servers}}
+	server {{.}};{{end}}
 }
 `)
 
@@ -112,7 +298,16 @@ func (n NginxGenerator) GenerateConfig(upstreamMap map[Upstream][]Application, c
 	server_tokens off;
 
 	location / {
-		proxy_pass {{.Protocol}}://{{.Name}};
+		proxy_pass {{.Protocol}}://{{.Name}};{{with .UpstreamTLS}}
+		proxy_ssl_protocols TLSv1.2 TLSv1.3;
+		proxy_ssl_session_reuse on;{{if .ServerName}}
+		proxy_ssl_server_name on;
+		proxy_ssl_name {{.ServerName}};{{end}}{{if .Verify}}
+		proxy_ssl_verify on;
+		proxy_ssl_trusted_certificate {{.TrustedCertificate}};{{if .VerifyDepth}}
+		proxy_ssl_verify_depth {{.VerifyDepth}};{{end}}{{end}}{{if .ClientCertificate}}
+		proxy_ssl_certificate {{.ClientCertificate}};
+		proxy_ssl_certificate_key {{.ClientKey}};{{end}}{{end}}
 	}
 }
 
@@ -126,15 +321,28 @@ func (n NginxGenerator) GenerateConfig(upstreamMap map[Upstream][]Application, c
 	upstreamBuf := new(bytes.Buffer)
 	serverBuf := new(bytes.Buffer)
 
-	for application, addresses := range applicationToAddress {
+	for _, name := range names {
+		application := applications[name]
+
+		var upstreamTLS *UpstreamTLSOptions
+
+		if application.Protocol == "https" {
+			options, err := n.upstreamTLSFor(application)
+
+			if err != nil {
+				log.Printf("skipping application '%s': %v\n", name, err)
+				continue
+			}
+
+			upstreamTLS = &options
+		}
+
 		err := upstreamTemplate.Execute(upstreamBuf, struct {
-			Name            string
-			ApplicationPort string
-			Addresses       []string
+			Name    string
+			Servers []string
 		}{
-			application.Name,
-			application.ApplicationPort,
-			addresses,
+			name,
+			servers[name],
 		})
 
 		if err != nil {
@@ -145,13 +353,18 @@ func (n NginxGenerator) GenerateConfig(upstreamMap map[Upstream][]Application, c
 			Application
 			TLSConfig    string
 			DomainString string
-		}{application, extraConfig, application.DomainString(" ")})
+			UpstreamTLS  *UpstreamTLSOptions
+		}{application, extraConfig, application.DomainString(" "), upstreamTLS})
 
 		if err != nil {
 			return "", err
 		}
 	}
 
+	if serverBuf.Len() == 0 {
+		return httpConfig + "\n\n" + fmt.Sprintf(defaultConfig, extraConfig), nil
+	}
+
 	return httpConfig + "\n\n" + upstreamBuf.String() + "\n\n" + serverBuf.String(), nil
 }
 
@@ -0,0 +1,138 @@
+package scrimplb
+
+import (
+	"strings"
+	"testing"
+)
+
+func generateTestNginxConfig(t *testing.T, generatorConfig map[string]interface{}, upstreamMap map[Upstream][]Application) string {
+	t.Helper()
+
+	generator, err := NewNginxGenerator(generatorConfig)
+
+	if err != nil {
+		t.Fatalf("couldn't create generator: %v", err)
+	}
+
+	config, err := generator.GenerateConfig(upstreamMap, &ScrimpConfig{LoadBalancerConfig: &LoadBalancerConfig{}})
+
+	if err != nil {
+		t.Fatalf("couldn't generate config: %v", err)
+	}
+
+	return config
+}
+
+func TestNginxGeneratorMergesApplications(t *testing.T) {
+	web := JSONApplication{
+		Name:            "web",
+		ListenPort:      "443",
+		ApplicationPort: "8443",
+		Protocol:        "https",
+		Domains:         []string{"www.example.com"},
+		UpstreamTLS:     &JSONUpstreamTLS{Verify: true, ServerName: "web.internal"},
+	}
+
+	otherPort := web
+	otherPort.ApplicationPort = "9443"
+
+	config := generateTestNginxConfig(t, map[string]interface{}{
+		"upstream-tls": map[string]interface{}{"trusted-certificate": "/etc/scrimplb/ca.pem"},
+	}, map[Upstream][]Application{
+		{Name: "backend1", Address: "10.0.0.1"}: {otherPort.ToApplication()},
+		{Name: "backend2", Address: "10.0.0.2"}: {web.ToApplication()},
+	})
+
+	if count := strings.Count(config, "upstream web {"); count != 1 {
+		t.Errorf("expected one upstream block for web but got %d:\n%s", count, config)
+	}
+
+	for _, expected := range []string{"server 10.0.0.1:9443;", "server 10.0.0.2:8443;", "proxy_ssl_verify on;", "proxy_ssl_name web.internal;"} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected config to contain %q:\n%s", expected, config)
+		}
+	}
+}
+
+func TestNginxGeneratorLeavesOutDifferingBackends(t *testing.T) {
+	web := JSONApplication{
+		Name:            "web",
+		ListenPort:      "443",
+		ApplicationPort: "8443",
+		Protocol:        "https",
+		Domains:         []string{"www.example.com"},
+	}
+
+	otherListenPort := web
+	otherListenPort.ListenPort = "8443"
+
+	otherProtocol := web
+	otherProtocol.Protocol = "http"
+
+	otherDomains := web
+	otherDomains.Domains = []string{"www.example.com", "evil.example.com"}
+
+	verified := web
+	verified.UpstreamTLS = &JSONUpstreamTLS{Verify: true}
+
+	config := generateTestNginxConfig(t, map[string]interface{}{
+		"upstream-tls": map[string]interface{}{"trusted-certificate": "/etc/scrimplb/ca.pem"},
+	}, map[Upstream][]Application{
+		{Name: "backend1", Address: "10.0.0.1"}: {web.ToApplication()},
+		{Name: "backend2", Address: "10.0.0.2"}: {otherListenPort.ToApplication()},
+		{Name: "backend3", Address: "10.0.0.3"}: {otherProtocol.ToApplication()},
+		{Name: "backend4", Address: "10.0.0.4"}: {otherDomains.ToApplication()},
+		{Name: "backend5", Address: "10.0.0.5"}: {verified.ToApplication()},
+		{Name: "backend6", Address: "10.0.0.6"}: {web.ToApplication()},
+	})
+
+	for _, expected := range []string{"server 10.0.0.1:8443;", "server 10.0.0.6:8443;", "listen 443 ssl"} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected config to contain %q:\n%s", expected, config)
+		}
+	}
+
+	for _, unexpected := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "listen 8443", "evil.example.com", "proxy_ssl_verify on;"} {
+		if strings.Contains(config, unexpected) {
+			t.Errorf("expected config not to contain %q:\n%s", unexpected, config)
+		}
+	}
+}
+
+func TestNginxGeneratorSkipsUnusableApplications(t *testing.T) {
+	apps := []JSONApplication{
+		{Name: "api", ListenPort: "443", ApplicationPort: "8443", Protocol: "https", Domains: []string{"api.example.com"}, UpstreamTLS: &JSONUpstreamTLS{Verify: true}},
+		{Name: "admin", ListenPort: "443", ApplicationPort: "8444", Protocol: "https", Domains: []string{"admin.example.com"}, UpstreamTLS: &JSONUpstreamTLS{ServerName: "x; proxy_pass http://evil"}},
+		{Name: "web", ListenPort: "443", ApplicationPort: "8080", Protocol: "http", Domains: []string{"www.example.com"}},
+	}
+
+	var converted []Application
+
+	for _, app := range apps {
+		converted = append(converted, app.ToApplication())
+	}
+
+	config := generateTestNginxConfig(t, nil, map[Upstream][]Application{
+		{Name: "backend1", Address: "10.0.0.1"}: converted,
+	})
+
+	if !strings.Contains(config, "upstream web {") {
+		t.Errorf("expected web to be generated:\n%s", config)
+	}
+
+	if strings.Contains(config, "api") || strings.Contains(config, "admin") || strings.Contains(config, "evil") {
+		t.Errorf("expected api and admin to be skipped:\n%s", config)
+	}
+}
+
+func TestNewNginxGeneratorRejectsInvalidServerName(t *testing.T) {
+	_, err := NewNginxGenerator(map[string]interface{}{
+		"application-upstream-tls": map[string]interface{}{
+			"api": map[string]interface{}{"server-name": "api.internal;"},
+		},
+	})
+
+	if err == nil {
+		t.Error("expected an invalid server-name to be rejected")
+	}
+}
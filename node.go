@@ -0,0 +1,617 @@
+package scrimplb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/memberlist"
+	"github.com/sgtcodfish/scrimplb/seed"
+)
+
+const (
+	// seedJoinAttempts is how many times joining from a seed is tried, as we
+	// could be hitting a race condition during init on system boot
+	seedJoinAttempts = 3
+	seedJoinBackoff  = 5 * time.Second
+
+	// generatorDebounce is how long to wait between generator runs
+	generatorDebounce = 5 * time.Second
+)
+
+// Node is a single member of a scrimplb cluster - either a load balancer or a
+// backend, depending on config. It owns the memberlist instance and, for load
+// balancers, the seed pusher and config generator loop. A Node can be
+// embedded into other programs; see cmd/scrimplb for an example.
+type Node struct {
+	config           *ScrimpConfig
+	memberlistConfig *memberlist.Config
+	eventDelegate    *LoadBalancerEventDelegate
+	events           *EventBus
+
+	lock     sync.Mutex
+	started  bool
+	stopped  bool
+	list     *memberlist.Memberlist
+	pushTask *PushTask
+	webhooks *WebhookDispatcher
+	control  *controlServer
+
+	conflictsLock sync.Mutex
+	conflicts     []DomainConflict
+
+	keyringLock sync.Mutex
+	keyringSeen map[string]time.Time
+
+	upstreamNotificationChannel chan Topology
+	upstreamHandlerDone         chan struct{}
+	upstreamHandlerFinished     chan struct{}
+}
+
+// New creates a Node from the given config, which would usually be loaded with
+// LoadScrimpConfig. The node doesn't join a cluster until Start is called.
+func New(config *ScrimpConfig) (*Node, error) {
+	if config == nil {
+		return nil, errors.New("config is required to create a node")
+	}
+
+	memberlistConfig := memberlist.DefaultLANConfig()
+
+	memberlistConfig.BindAddr = config.BindAddress
+	memberlistConfig.BindPort = config.Port
+	// we tweak some timeouts to reasonably minimise the time between
+	// a node being suspected to being declared dead - otherwise we have ~15s
+	// after a node dies where we might still route traffic to it
+	memberlistConfig.TCPTimeout = 5 * time.Second
+	memberlistConfig.SuspicionMult = 2
+	memberlistConfig.SuspicionMaxTimeoutMult = 3
+	memberlistConfig.RetransmitMult = 2
+
+	memberlistConfig.Keyring = config.Keyring
+
+	if config.TransportTLS != nil {
+		if config.TransportTLS.tlsConfig == nil {
+			err := initialiseTransportTLSConfig(config.TransportTLS)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// the node is known by the identity in its certificate
+		memberlistConfig.Name = config.TransportTLS.identity
+	}
+
+	node := &Node{
+		config:                  config,
+		memberlistConfig:        memberlistConfig,
+		events:                  NewEventBus(),
+		keyringSeen:             make(map[string]time.Time),
+		upstreamHandlerDone:     make(chan struct{}),
+		upstreamHandlerFinished: make(chan struct{}),
+	}
+
+	if config.IsLoadBalancer {
+		delegate, err := NewLoadBalancerDelegate(make(chan<- string), config.ClusterName, config.AuthToken)
+
+		if err != nil {
+			return nil, err
+		}
+
+		memberlistConfig.Delegate = delegate
+
+		node.upstreamNotificationChannel = make(chan Topology, 1)
+		eventDelegate := NewLoadBalancerEventDelegate(node.upstreamNotificationChannel, node.events)
+		node.eventDelegate = &eventDelegate
+		memberlistConfig.Events = node.eventDelegate
+	} else {
+		delegate, err := NewBackendDelegate(config.BackendConfig, config.ClusterName, config.AuthToken)
+
+		if err != nil {
+			return nil, err
+		}
+
+		memberlistConfig.Delegate = delegate
+	}
+
+	memberlistConfig.Delegate = &nodeDelegate{memberlistConfig.Delegate, node}
+
+	if config.ClusterName != "" || config.JoinAuth != nil || config.TransportTLS != nil {
+		var peers *peerIdentities
+
+		if config.TransportTLS != nil {
+			peers = config.TransportTLS.peers
+		}
+
+		admission := &admissionDelegate{config.ClusterName, config.JoinAuth, memberlistConfig.Name, peers}
+		memberlistConfig.Alive = admission
+		memberlistConfig.Merge = admission
+	}
+
+	return node, nil
+}
+
+// Start creates the local memberlist, joins the cluster using the configured
+// seed provider and, for load balancers, starts pushing seeds and generating
+// config. Cancelling ctx aborts joining; it has no effect once Start returns.
+func (n *Node) Start(ctx context.Context) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.started {
+		return errors.New("node has already been started")
+	}
+
+	// webhooks are started first so they see backends joining during startup
+	if n.config.IsLoadBalancer && len(n.config.LoadBalancerConfig.Webhooks) > 0 {
+		log.Printf("starting %d webhooks", len(n.config.LoadBalancerConfig.Webhooks))
+		n.webhooks = NewWebhookDispatcher(n.config.LoadBalancerConfig.Webhooks)
+		n.webhooks.Start(n.events)
+	}
+
+	if n.config.TransportTLS != nil {
+		transport, err := NewTLSTransport(n.config.TransportTLS, n.config.BindAddress, n.config.Port)
+
+		if err != nil {
+			n.stopWebhooks()
+			return err
+		}
+
+		n.memberlistConfig.Transport = transport
+	}
+
+	list, err := memberlist.Create(n.memberlistConfig)
+
+	if err != nil {
+		if n.memberlistConfig.Transport != nil {
+			n.memberlistConfig.Transport.Shutdown()
+			n.memberlistConfig.Transport = nil
+		}
+
+		n.stopWebhooks()
+		return fmt.Errorf("couldn't create memberlist: %w", err)
+	}
+
+	localNode := list.LocalNode()
+	log.Println("listening as", localNode.Name, localNode.Addr)
+
+	if n.config.ProviderName == "" {
+		log.Printf("Warning: No provider given; this node may be orphaned")
+	} else {
+		log.Printf("joining cluster with provider '%s'\n", n.config.ProviderName)
+
+		err = n.joinFromSeed(ctx, list)
+
+		if err != nil {
+			shutdownErr := list.Shutdown()
+
+			if shutdownErr != nil {
+				log.Printf("failed to shut down memberlist: %v\n", shutdownErr)
+			}
+
+			n.stopWebhooks()
+			return err
+		}
+	}
+
+	n.list = list
+	n.started = true
+
+	if n.config.ControlSocket != "" {
+		n.control, err = startControlServer(n, n.config.ControlSocket)
+
+		if err != nil {
+			log.Printf("Warning: Control socket unavailable, keys can't be rotated: %v\n", err)
+		}
+	}
+
+	if n.config.IsLoadBalancer {
+		log.Println("initializing load balancer")
+
+		if n.config.ProviderName == "" {
+			log.Println("not starting pusher as no provider given")
+		} else {
+			if announcer, ok := n.config.Provider.(seed.Announcer); ok {
+				err = announcer.Announce(n.config.Resolver, n.config.PortRaw)
+
+				if err != nil {
+					log.Printf("Warning: couldn't announce seed, will retry on next push: %v\n", err)
+				}
+			}
+
+			log.Printf("initializing '%s' pusher", n.config.ProviderName)
+			n.pushTask = NewPushTask(n.config)
+			go n.pushTask.Loop()
+		}
+
+		// generate initial config even if no backends have joined yet
+		go n.handleUpstreamNotification(&Topology{})
+	} else {
+		log.Println("initializing backend")
+		close(n.upstreamHandlerFinished)
+	}
+
+	return nil
+}
+
+// Stop stops pushing seeds, optionally removes this load balancer's seed,
+// closes the seed provider, leaves the cluster and waits for any pending
+// generator run to complete. The cluster is left within the configured leave
+// timeout, or before ctx's deadline if that's sooner. Every step is attempted
+// even if earlier steps fail, and any errors are combined in the returned
+// error. Stopping a node which has already been stopped does nothing.
+func (n *Node) Stop(ctx context.Context) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.started {
+		return errors.New("node hasn't been started")
+	}
+
+	if n.stopped {
+		return nil
+	}
+
+	n.stopped = true
+
+	var errs []string
+
+	if n.control != nil {
+		err := n.control.Close()
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to close control socket: %v", err))
+		}
+	}
+
+	if n.pushTask != nil {
+		log.Println("stopping pusher")
+		n.pushTask.Stop()
+	}
+
+	if n.config.IsLoadBalancer && n.config.LoadBalancerConfig.RemoveSeedOnShutdown && n.config.Provider != nil {
+		log.Printf("removing seed from '%s' provider\n", n.config.ProviderName)
+		err := n.config.Provider.RemoveSeed(n.config.Resolver, n.config.PortRaw)
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to remove seed: %v", err))
+		}
+	}
+
+	if closer, ok := n.config.Provider.(io.Closer); ok {
+		err := closer.Close()
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to close '%s' provider: %v", n.config.ProviderName, err))
+		}
+	}
+
+	leaveTimeout := n.config.LeaveTimeout
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < leaveTimeout {
+		leaveTimeout = time.Until(deadline)
+	}
+
+	// a cancelled context still leaves, but doesn't wait for the leave to
+	// propagate
+	if ctx.Err() != nil || leaveTimeout < 0 {
+		leaveTimeout = 0
+	}
+
+	log.Printf("leaving cluster with a timeout of %v\n", leaveTimeout)
+	err := n.list.Leave(leaveTimeout)
+
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("failed to leave cluster cleanly: %v", err))
+	}
+
+	err = n.list.Shutdown()
+
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("failed to shut down memberlist: %v", err))
+	}
+
+	close(n.upstreamHandlerDone)
+
+	select {
+	case <-n.upstreamHandlerFinished:
+
+	case <-ctx.Done():
+		// the generator may have finished just as ctx was done
+		select {
+		case <-n.upstreamHandlerFinished:
+
+		default:
+			errs = append(errs, fmt.Sprintf("gave up waiting for generator to finish: %v", ctx.Err()))
+		}
+	}
+
+	// subscribers see the final generator run before their channels close
+	n.events.Close()
+
+	if n.webhooks != nil {
+		err = n.webhooks.Flush(ctx)
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("gave up delivering webhooks: %v", err))
+		}
+	}
+
+	n.stopWebhooks()
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	log.Println("shutdown complete")
+	return nil
+}
+
+func (n *Node) stopWebhooks() {
+	if n.webhooks != nil {
+		n.webhooks.Stop()
+		n.webhooks = nil
+	}
+}
+
+// Config returns the config the node was created with
+func (n *Node) Config() *ScrimpConfig {
+	return n.config
+}
+
+// LocalNode returns the memberlist node for this node, or nil if the node
+// hasn't been started
+func (n *Node) LocalNode() *memberlist.Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.list == nil {
+		return nil
+	}
+
+	return n.list.LocalNode()
+}
+
+// Members returns every live member of the cluster known to this node,
+// including this node itself, or nil if the node hasn't been started
+func (n *Node) Members() []*memberlist.Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.list == nil {
+		return nil
+	}
+
+	return n.list.Members()
+}
+
+// Topology returns a snapshot of the backends known to a load balancer and
+// the applications each serves. It's always empty for a backend.
+func (n *Node) Topology() Topology {
+	if n.eventDelegate == nil {
+		return Topology{}
+	}
+
+	n.eventDelegate.State.memberLock.RLock()
+	defer n.eventDelegate.State.memberLock.RUnlock()
+
+	return newTopology(n.eventDelegate.State.MemberMap, n.eventDelegate.State.joined)
+}
+
+// Conflicts returns the domain conflicts found on the last generator run. The
+// excluded applications weren't passed to the generator.
+func (n *Node) Conflicts() []DomainConflict {
+	n.conflictsLock.Lock()
+	defer n.conflictsLock.Unlock()
+
+	return append([]DomainConflict(nil), n.conflicts...)
+}
+
+// Subscribe returns a channel of events describing changes to a load
+// balancer's topology and the results of generator runs, and a function which
+// unsubscribes. The channel is buffered to the given size; events which don't
+// fit are dropped. It's closed when the node stops, after the events from the
+// final generator run. A backend never publishes any events.
+func (n *Node) Subscribe(buffer int) (<-chan Event, func()) {
+	return n.events.Subscribe(buffer)
+}
+
+func (n *Node) joinFromSeed(ctx context.Context, list *memberlist.Memberlist) error {
+	var err error
+
+	for i := 0; i < seedJoinAttempts; i++ {
+		err = n.initFromSeed(list)
+
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("attempt %d to initialise from seed failed: %v\n", i, err)
+
+		select {
+		case <-time.After(seedJoinBackoff):
+
+		case <-ctx.Done():
+			return fmt.Errorf("gave up initialising from seed: %w", ctx.Err())
+		}
+	}
+
+	return fmt.Errorf("failed to initialise from seed: %w", err)
+}
+
+func (n *Node) initFromSeed(list *memberlist.Memberlist) error {
+	seedList, err := n.config.Provider.FetchSeed()
+
+	if err != nil {
+		return fmt.Errorf("failed to fetch seed during initialization: %w", err)
+	}
+
+	var ips []string
+	for _, s := range seedList.Seeds {
+		ips = append(ips, s.Address+":"+s.Port)
+	}
+
+	_, err = list.Join(ips)
+
+	if err != nil {
+		return fmt.Errorf("couldn't join cluster: %w", err)
+	}
+
+	return nil
+}
+
+// handleUpstreamNotification runs the generator for state changes until the
+// node is stopped, at which point any pending state change is flushed through
+// the generator. pending, if non-nil, is generated first.
+// State changes are sent without blocking, so any received after the handler
+// starts replace the initial pending state, and only the latest is generated
+// at most once per generatorDebounce.
+func (n *Node) handleUpstreamNotification(pending *Topology) {
+	defer close(n.upstreamHandlerFinished)
+
+	ticker := time.NewTicker(generatorDebounce)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case val := <-n.upstreamNotificationChannel:
+			pending = &val
+
+		case <-ticker.C:
+			if pending != nil {
+				n.runGenerator(*pending)
+				pending = nil
+			}
+
+		case <-n.upstreamHandlerDone:
+			select {
+			case val := <-n.upstreamNotificationChannel:
+				pending = &val
+
+			default:
+			}
+
+			if pending != nil {
+				log.Println("flushing pending generator run before exit")
+				n.runGenerator(*pending)
+			}
+
+			return
+		}
+	}
+}
+
+func (n *Node) runGenerator(topology Topology) {
+	topology = n.resolveConflicts(topology)
+	err := n.generate(topology)
+
+	event := Event{
+		Type: EventGeneratorSucceeded,
+		Time: time.Now(),
+		Old:  topology,
+		New:  topology,
+	}
+
+	if err != nil {
+		log.Println(err)
+		event.Type = EventGeneratorFailed
+		event.Err = err
+	}
+
+	n.events.Publish(event)
+}
+
+// resolveConflicts applies the domain conflict policy to the topology, logging
+// and publishing an event if the conflicts have changed since the last run
+func (n *Node) resolveConflicts(topology Topology) Topology {
+	policy := n.config.LoadBalancerConfig.DomainPolicy
+	resolved, conflicts := policy.Resolve(topology)
+
+	n.conflictsLock.Lock()
+	changed := !sameConflicts(n.conflicts, conflicts)
+	n.conflicts = conflicts
+	n.conflictsLock.Unlock()
+
+	excluded := 0
+
+	for _, conflict := range conflicts {
+		excluded += len(conflict.Excluded)
+	}
+
+	metrics.SetGauge([]string{"scrimplb", "domain_conflicts"}, float32(len(conflicts)))
+	metrics.SetGauge([]string{"scrimplb", "domain_conflicts", "excluded"}, float32(excluded))
+
+	if !changed {
+		return resolved
+	}
+
+	metrics.IncrCounter([]string{"scrimplb", "domain_conflicts", "changed"}, 1)
+
+	if len(conflicts) == 0 {
+		log.Println("all domain conflicts resolved")
+	}
+
+	for _, conflict := range conflicts {
+		log.Printf("domain conflict (%s policy): %v\n", policy.Mode, conflict)
+	}
+
+	n.events.Publish(Event{
+		Type:      EventDomainConflictsChanged,
+		Time:      time.Now(),
+		Old:       topology,
+		New:       resolved,
+		Conflicts: conflicts,
+	})
+
+	return resolved
+}
+
+func sameConflicts(a []DomainConflict, b []DomainConflict) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *Node) generate(topology Topology) error {
+	config := n.config
+	txt, err := config.LoadBalancerConfig.Generator.GenerateConfig(topology.Map(), config)
+
+	if err != nil {
+		return fmt.Errorf("couldn't generate config: %w", err)
+	}
+
+	if config.LoadBalancerConfig.GeneratorPrintStdout {
+		fmt.Println(txt)
+	}
+
+	if config.LoadBalancerConfig.GeneratorTarget != "" {
+		err = ioutil.WriteFile(config.LoadBalancerConfig.GeneratorTarget, []byte(txt), 0664)
+
+		if err != nil {
+			return fmt.Errorf("couldn't write config file: %w", err)
+		}
+
+		err = config.LoadBalancerConfig.Generator.HandleRestart()
+
+		if err != nil {
+			return fmt.Errorf("couldn't restart after writing generated config: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package scrimplb
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestNode creates a load balancer node from the given JSON config, which
+// listens on an automatically chosen port on loopback
+func newTestNode(t *testing.T, rawConfig string) *Node {
+	t.Helper()
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+
+	err := ioutil.WriteFile(configFile, []byte(rawConfig), 0600)
+
+	if err != nil {
+		t.Fatalf("couldn't write config: %v", err)
+	}
+
+	config, err := LoadScrimpConfig(configFile)
+
+	if err != nil {
+		t.Fatalf("couldn't load config: %v", err)
+	}
+
+	node, err := New(config)
+
+	if err != nil {
+		t.Fatalf("couldn't create node: %v", err)
+	}
+
+	return node
+}
+
+const testNodeConfig = `{"lb": true, "bind-address": "127.0.0.1", "port": "0", "resolver": "dummy", "leave-timeout": "1s"}`
+
+func TestNewRequiresConfig(t *testing.T) {
+	_, err := New(nil)
+
+	if err == nil {
+		t.Error("expected creating a node without config to fail")
+	}
+}
+
+func TestNodeStartAndStop(t *testing.T) {
+	node := newTestNode(t, testNodeConfig)
+
+	if node.LocalNode() != nil || node.Members() != nil {
+		t.Error("expected no local node or members before starting")
+	}
+
+	err := node.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start node: %v", err)
+	}
+
+	if local := node.LocalNode(); local == nil || local.Addr.String() != "127.0.0.1" {
+		t.Errorf("expected the local node to listen on loopback but got %v", local)
+	}
+
+	if members := node.Members(); len(members) != 1 {
+		t.Errorf("expected the node to be the only member but got %d members", len(members))
+	}
+
+	err = node.Start(context.Background())
+
+	if err == nil {
+		t.Error("expected starting a running node to fail")
+	}
+
+	err = node.Stop(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't stop node: %v", err)
+	}
+
+	err = node.Start(context.Background())
+
+	if err == nil {
+		t.Error("expected restarting a stopped node to fail")
+	}
+}
+
+func TestNodeStopIsIdempotent(t *testing.T) {
+	node := newTestNode(t, testNodeConfig)
+
+	err := node.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start node: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = node.Stop(context.Background())
+
+		if err != nil {
+			t.Fatalf("couldn't stop node on attempt %d: %v", i, err)
+		}
+	}
+}
+
+func TestNodeStopBeforeStart(t *testing.T) {
+	node := newTestNode(t, testNodeConfig)
+
+	err := node.Stop(context.Background())
+
+	if err == nil {
+		t.Fatal("expected stopping a node which hasn't started to fail")
+	}
+
+	// the node is left untouched and can still be started
+	err = node.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start node after an early stop: %v", err)
+	}
+
+	err = node.Stop(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't stop node: %v", err)
+	}
+}
+
+func TestNodeStopDeliversFinalEventsToSubscribers(t *testing.T) {
+	node := newTestNode(t, testNodeConfig)
+	events, _ := node.Subscribe(8)
+
+	err := node.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start node: %v", err)
+	}
+
+	// the initial generator run is still pending, and is flushed by Stop
+	err = node.Stop(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't stop node: %v", err)
+	}
+
+	assertEventTypes(t, receiveEvents(t, events), EventGeneratorSucceeded)
+}
+
+// shutdownTestGenerator counts generator runs, each of which waits until
+// release is closed
+type shutdownTestGenerator struct {
+	release chan struct{}
+	runs    chan struct{}
+}
+
+func (g shutdownTestGenerator) GenerateConfig(map[Upstream][]Application, *ScrimpConfig) (string, error) {
+	<-g.release
+	g.runs <- struct{}{}
+	return "", nil
+}
+
+func (g shutdownTestGenerator) HandleRestart() error {
+	return nil
+}
+
+// newShutdownTestNode starts a load balancer which removes its seed from a
+// file provider on shutdown, and which has pushed its seed
+func newShutdownTestNode(t *testing.T, generator shutdownTestGenerator) *Node {
+	t.Helper()
+
+	seedFile := filepath.Join(t.TempDir(), "seeds.json")
+
+	node := newTestNode(t, `{
+		"lb": true,
+		"bind-address": "127.0.0.1",
+		"port": "0",
+		"resolver": "dummy",
+		"leave-timeout": "1s",
+		"provider": "file",
+		"provider-config": {"path": "`+seedFile+`"},
+		"load-balancer-config": {"remove-seed-on-shutdown": true}
+	}`)
+
+	node.config.LoadBalancerConfig.Generator = generator
+
+	err := node.Start(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't start node: %v", err)
+	}
+
+	// as the pusher would have done by the time the node is stopped
+	err = node.config.Provider.PushSeed(node.config.Resolver, node.config.PortRaw)
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	return node
+}
+
+func assertSeedCount(t *testing.T, node *Node, expected int) {
+	t.Helper()
+
+	seeds, err := node.config.Provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	if len(seeds.Seeds) != expected {
+		t.Errorf("expected %d seeds but got %v", expected, seeds.Seeds)
+	}
+}
+
+func TestNodeStopRemovesSeedAndFlushesGenerator(t *testing.T) {
+	generator := shutdownTestGenerator{make(chan struct{}), make(chan struct{}, 2)}
+	close(generator.release)
+
+	node := newShutdownTestNode(t, generator)
+	assertSeedCount(t, node, 1)
+
+	if len(generator.runs) != 0 {
+		t.Fatal("expected the initial generator run to still be pending")
+	}
+
+	err := node.Stop(context.Background())
+
+	if err != nil {
+		t.Fatalf("couldn't stop node: %v", err)
+	}
+
+	if len(generator.runs) != 1 {
+		t.Errorf("expected the pending generator run to be flushed before Stop returned, but got %d runs", len(generator.runs))
+	}
+
+	assertSeedCount(t, node, 0)
+}
+
+func TestNodeStopWithCancelledContext(t *testing.T) {
+	generator := shutdownTestGenerator{make(chan struct{}), make(chan struct{}, 2)}
+
+	node := newShutdownTestNode(t, generator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := node.Stop(ctx)
+
+	if err == nil || !strings.Contains(err.Error(), "gave up waiting for generator") {
+		t.Errorf("expected Stop to give up on the blocked generator run, but got: %v", err)
+	}
+
+	// the seed is still removed, since that doesn't depend on ctx
+	assertSeedCount(t, node, 0)
+
+	// the abandoned run still finishes in the background
+	close(generator.release)
+
+	select {
+	case <-generator.runs:
+
+	case <-time.After(5 * time.Second):
+		t.Error("expected the abandoned generator run to finish once released")
+	}
+}
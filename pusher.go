@@ -12,6 +12,8 @@ type PushTask struct {
 	sleepTime    time.Duration
 	maxJitter    time.Duration
 	failureCount int
+	stop         chan struct{}
+	done         chan struct{}
 }
 
 // NewPushTask creates a new PushTask with the given config
@@ -21,22 +23,35 @@ func NewPushTask(config *ScrimpConfig) *PushTask {
 		config.LoadBalancerConfig.PushPeriod,
 		config.LoadBalancerConfig.PushJitter,
 		0,
+		make(chan struct{}),
+		make(chan struct{}),
 	}
 }
 
 // Loop should be called in/as a goroutine and will regularly push state
+// until Stop is called
 func (p *PushTask) Loop() {
+	defer close(p.done)
+
 	for {
 		if p.failureCount > 0 {
 			backoffSleep := time.Second * 5 * time.Duration(p.failureCount)
 			log.Printf("sleeping for %v extra due to previous failure\n", backoffSleep)
-			time.Sleep(backoffSleep)
+
+			if !p.sleep(backoffSleep) {
+				return
+			}
 		}
 
-		time.Sleep(p.sleepTime)
+		if !p.sleep(p.sleepTime) {
+			return
+		}
 
 		randSleep := time.Duration(rand.Int63n(p.maxJitter.Nanoseconds())).Round(time.Millisecond)
-		time.Sleep(randSleep)
+
+		if !p.sleep(randSleep) {
+			return
+		}
 
 		err := p.config.Provider.PushSeed(p.config.Resolver, p.config.PortRaw)
 
@@ -48,3 +63,25 @@ func (p *PushTask) Loop() {
 		}
 	}
 }
+
+// Stop signals Loop to return and waits until it has done so, which
+// guarantees that no more seeds will be pushed after Stop returns.
+func (p *PushTask) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// sleep waits for the given duration, returning false if the task was stopped
+// in the meantime
+func (p *PushTask) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-p.stop:
+		return false
+	}
+}
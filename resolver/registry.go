@@ -0,0 +1,72 @@
+package resolver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates an IPResolver from the raw "resolver-config" map, which may
+// be nil.
+type Factory func(config map[string]interface{}) (IPResolver, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+func init() {
+	Register("dummy", func(config map[string]interface{}) (IPResolver, error) { return NewDummyIPResolver(), nil })
+	Register("ec2", func(config map[string]interface{}) (IPResolver, error) { return NewEC2IPResolver(), nil })
+	Register("ipv6", func(config map[string]interface{}) (IPResolver, error) { return NewIPv6UnicastResolver() })
+}
+
+// Register makes a resolver available under the given name, so that it can be
+// selected with "resolver" in config. Names are case insensitive. This is
+// intended to be called from an init function, and panics if factory is nil
+// or if a resolver is already registered with the same name.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	name = strings.ToLower(name)
+
+	if factory == nil {
+		panic("resolver: Register factory is nil for resolver " + name)
+	}
+
+	if _, exists := registry[name]; exists {
+		panic("resolver: Register called twice for resolver " + name)
+	}
+
+	registry[name] = factory
+}
+
+// Registered returns the sorted names of all registered resolvers.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// NewResolver creates the resolver registered under the given name from its
+// config. An unknown name is an error which lists the registered resolvers.
+func NewResolver(name string, config map[string]interface{}) (IPResolver, error) {
+	registryLock.RLock()
+	factory, ok := registry[strings.ToLower(name)]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown resolver '%s'; registered resolvers are: %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return factory(config)
+}
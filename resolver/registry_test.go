@@ -0,0 +1,77 @@
+package resolver
+
+import (
+	"strings"
+	"testing"
+)
+
+func assertPanics(t *testing.T, description string, fn func()) {
+	t.Helper()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected %s to panic", description)
+		}
+	}()
+
+	fn()
+}
+
+func TestRegisterRejectsDuplicateNames(t *testing.T) {
+	factory := func(config map[string]interface{}) (IPResolver, error) { return NewDummyIPResolver(), nil }
+
+	// names are case insensitive, so this clashes with the built in resolver
+	assertPanics(t, "registering a resolver twice", func() { Register("EC2", factory) })
+	assertPanics(t, "registering a nil factory", func() { Register("registry-test-nil", nil) })
+}
+
+func TestNewResolverRejectsUnknownName(t *testing.T) {
+	_, err := NewResolver("no-such-resolver", nil)
+
+	if err == nil {
+		t.Fatal("expected an unknown resolver to be rejected")
+	}
+
+	if !strings.Contains(err.Error(), "no-such-resolver") || !strings.Contains(err.Error(), "ipv6") {
+		t.Errorf("expected the error to name the resolver and list registered resolvers, but got: %v", err)
+	}
+}
+
+// registryTestResolver is registered as a third-party resolver, returning the
+// address from its config
+type registryTestResolver string
+
+func (r registryTestResolver) ResolveIP() (string, error) {
+	return string(r), nil
+}
+
+// registering from init mirrors how an external package would add a resolver
+func init() {
+	Register("registry-test-resolver", func(config map[string]interface{}) (IPResolver, error) {
+		return registryTestResolver(config["ip"].(string)), nil
+	})
+}
+
+func TestRegisterThirdPartyResolver(t *testing.T) {
+	resolver, err := NewResolver("Registry-Test-Resolver", map[string]interface{}{"ip": "10.0.0.1"})
+
+	if err != nil {
+		t.Fatalf("couldn't create registered resolver: %v", err)
+	}
+
+	ip, err := resolver.ResolveIP()
+
+	if err != nil || ip != "10.0.0.1" {
+		t.Errorf("expected the registered resolver to resolve the configured address but got %q, %v", ip, err)
+	}
+
+	found := false
+
+	for _, name := range Registered() {
+		found = found || name == "registry-test-resolver"
+	}
+
+	if !found {
+		t.Errorf("expected the registered resolver to be listed but got %v", Registered())
+	}
+}
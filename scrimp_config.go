@@ -1,15 +1,19 @@
 package scrimplb
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/sgtcodfish/scrimplb/constants"
 	"github.com/sgtcodfish/scrimplb/resolver"
 	"github.com/sgtcodfish/scrimplb/seed"
@@ -18,23 +22,43 @@ import (
 const (
 	defaultPushPeriod       = "60s"
 	defaultPushJitter       = "5s"
+	defaultLeaveTimeout     = "10s"
 	defaultTLSChainLocation = "/etc/ssl/chain.pem"
 	defaultTLSKeyLocation   = "/etc/ssl/key.pem"
 )
 
+// clusterNamePattern restricts cluster names to those which are valid in every
+// seed provider's keys and service names
+var clusterNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
 // ScrimpConfig describes JSON configuration options for Scrimp overall.
 type ScrimpConfig struct {
-	IsLoadBalancer     bool                   `json:"lb"`
-	BindAddress        string                 `json:"bind-address"`
-	PortRaw            string                 `json:"port"`
-	ProviderName       string                 `json:"provider"`
-	ProviderConfig     map[string]interface{} `json:"provider-config"`
-	ResolverName       string                 `json:"resolver"`
-	LoadBalancerConfig *LoadBalancerConfig    `json:"load-balancer-config"`
-	BackendConfig      *BackendConfig         `json:"backend-config"`
-	Port               int
-	Provider           seed.Provider
-	Resolver           resolver.IPResolver
+	IsLoadBalancer      bool                   `json:"lb"`
+	ClusterName         string                 `json:"cluster-name"`
+	BindAddress         string                 `json:"bind-address"`
+	PortRaw             string                 `json:"port"`
+	ProviderName        string                 `json:"provider"`
+	ProviderConfig      map[string]interface{} `json:"provider-config"`
+	ResolverName        string                 `json:"resolver"`
+	ResolverConfig      map[string]interface{} `json:"resolver-config"`
+	LeaveTimeoutRaw     string                 `json:"leave-timeout"`
+	LoadBalancerConfig  *LoadBalancerConfig    `json:"load-balancer-config"`
+	BackendConfig       *BackendConfig         `json:"backend-config"`
+	EncryptionKeys      []string               `json:"encryption-keys"`
+	EncryptionKeyFile   string                 `json:"encryption-key-file"`
+	KeyringOperatorKeys []string               `json:"keyring-operator-keys"`
+	ControlSocket       string                 `json:"control-socket"`
+	AuthToken           string                 `json:"auth-token"`
+	AuthTokenFile       string                 `json:"auth-token-file"`
+	JoinAuth            *JoinAuthConfig        `json:"join-auth"`
+	TransportTLS        *TransportTLSConfig    `json:"transport-tls"`
+	Port                int
+	LeaveTimeout        time.Duration
+	Provider            seed.Provider
+	Resolver            resolver.IPResolver
+	Keyring             *memberlist.Keyring `json:"-"`
+
+	keyringOperatorKeys []ed25519.PublicKey
 }
 
 // LoadScrimpConfig loads the given config file and parses fields which need to be parsed
@@ -46,9 +70,10 @@ func LoadScrimpConfig(configFile string) (*ScrimpConfig, error) {
 	}
 
 	config := ScrimpConfig{
-		BindAddress:    "0.0.0.0",
-		PortRaw:        constants.DefaultPort,
-		IsLoadBalancer: false,
+		BindAddress:     "0.0.0.0",
+		PortRaw:         constants.DefaultPort,
+		IsLoadBalancer:  false,
+		LeaveTimeoutRaw: defaultLeaveTimeout,
 	}
 	err = json.Unmarshal(data, &config)
 
@@ -56,6 +81,10 @@ func LoadScrimpConfig(configFile string) (*ScrimpConfig, error) {
 		return nil, err
 	}
 
+	if config.ClusterName != "" && !clusterNamePattern.MatchString(config.ClusterName) {
+		return nil, fmt.Errorf("invalid cluster name '%s'; use lower case letters, digits and hyphens", config.ClusterName)
+	}
+
 	if config.IsLoadBalancer {
 		err = initialiseLoadBalancerConfig(&config)
 	} else {
@@ -76,6 +105,14 @@ func LoadScrimpConfig(configFile string) (*ScrimpConfig, error) {
 		}
 	}
 
+	if config.IsLoadBalancer && config.Provider != nil {
+		err = validateSeedTTL(&config)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// a load balancer needs a resolver of some kind
 	config.ResolverName = strings.ToLower(config.ResolverName)
 	if config.IsLoadBalancer && config.ResolverName == "" {
@@ -97,27 +134,41 @@ func LoadScrimpConfig(configFile string) (*ScrimpConfig, error) {
 	}
 
 	config.Port = intPort
-	return &config, nil
-}
 
-func initResolver(config *ScrimpConfig) error {
-	var resolverObject resolver.IPResolver
-	var err error
+	leaveTimeout, err := time.ParseDuration(config.LeaveTimeoutRaw)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid leave timeout: %w", err)
+	}
+
+	config.LeaveTimeout = leaveTimeout
 
-	switch config.ResolverName {
-	case "dummy":
-		resolverObject = resolver.NewDummyIPResolver()
+	err = initKeyring(&config)
 
-	case "ec2":
-		resolverObject = resolver.NewEC2IPResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	err = initialiseJoinAuthConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
 
-	case "ipv6":
-		resolverObject, err = resolver.NewIPv6UnicastResolver()
+	if config.TransportTLS != nil {
+		err = initialiseTransportTLSConfig(config.TransportTLS)
 
-	default:
-		return fmt.Errorf("invalid resolver '%s'", config.ResolverName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	return &config, nil
+}
+
+func initResolver(config *ScrimpConfig) error {
+	resolverObject, err := resolver.NewResolver(config.ResolverName, config.ResolverConfig)
+
 	if err != nil {
 		return fmt.Errorf("couldn't create IP resolver: %w", err)
 	}
@@ -127,25 +178,32 @@ func initResolver(config *ScrimpConfig) error {
 }
 
 func initProvider(config *ScrimpConfig) error {
-	var providerObject seed.Provider
-	var err error
+	providerObject, err := seed.NewProvider(config.ProviderName, seed.WithClusterName(config.ProviderConfig, config.ClusterName))
+
+	if err != nil {
+		return fmt.Errorf("couldn't initialise provider '%s': %w", config.ProviderName, err)
+	}
 
-	switch config.ProviderName {
-	case "dummy":
-		providerObject, err = seed.NewDummyProvider(config.ProviderConfig)
+	config.Provider = providerObject
+	return nil
+}
 
-	case "manual":
-		providerObject, err = seed.NewManualProvider(config.ProviderConfig)
+// validateSeedTTL rejects a provider whose seeds expire before a load balancer
+// is guaranteed to have pushed again, since live load balancers would then be
+// pruned from the seed source between pushes
+func validateSeedTTL(config *ScrimpConfig) error {
+	ttlProvider, ok := config.Provider.(seed.TTLProvider)
 
-	case "s3":
-		providerObject, err = seed.NewS3Provider(config.ProviderConfig)
+	if !ok || ttlProvider.TTL() == 0 {
+		return nil
 	}
 
-	if err != nil {
-		return fmt.Errorf("couldn't initialise provider '%s': %w", config.ProviderName, err)
+	maxInterval := config.LoadBalancerConfig.PushPeriod + config.LoadBalancerConfig.PushJitter
+
+	if ttlProvider.TTL() <= maxInterval {
+		return fmt.Errorf("provider 'seed-ttl' of %v must be longer than 'push-period' plus 'jitter' (%v)", ttlProvider.TTL(), maxInterval)
 	}
 
-	config.Provider = providerObject
 	return nil
 }
 
@@ -0,0 +1,69 @@
+package seed
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AWSSessionConfig holds the provider config shared by every AWS-based
+// provider. It's embedded into each provider and decoded from the same
+// provider config map.
+// "region" is required.
+// "endpoint" is optional, and is needed for AWS-compatible services or local
+// stand-ins.
+// "profile" selects a profile from the shared AWS config files, while
+// "access-key-id" and "secret-access-key" (and optionally "session-token")
+// give static credentials. If neither is given, the default AWS credential
+// chain is used.
+type AWSSessionConfig struct {
+	Region          string
+	Endpoint        string
+	Profile         string
+	AccessKeyID     string `mapstructure:"access-key-id"`
+	SecretAccessKey string `mapstructure:"secret-access-key"`
+	SessionToken    string `mapstructure:"session-token"`
+}
+
+// newSession validates the config and creates a session from it. Sessions
+// are safe to share, so this should be called once per provider.
+func (c *AWSSessionConfig) newSession() (*session.Session, error) {
+	if c.Region == "" {
+		return nil, errors.New("missing required 'region' in provider config")
+	}
+
+	if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+		return nil, errors.New("'access-key-id' and 'secret-access-key' must be given together in provider config")
+	}
+
+	if c.AccessKeyID != "" && c.Profile != "" {
+		return nil, errors.New("only one of 'profile' and static credentials can be given in provider config")
+	}
+
+	awsConfig := aws.Config{
+		Region: aws.String(c.Region),
+	}
+
+	if c.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(c.Endpoint)
+	}
+
+	if c.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, c.SessionToken)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create AWS session: %w", err)
+	}
+
+	return sess, nil
+}
@@ -0,0 +1,389 @@
+package seed
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const azureStorageAPIVersion = "2019-12-12"
+
+// AzureBlobProvider stores seeds in a single block blob in an Azure Storage
+// container. Updates are made conditionally on the blob's ETag so that
+// concurrent pushes from several load balancers can't overwrite each other.
+// Either a SAS token or a shared account key is required; a SAS token for a
+// load balancer needs read, create and write permissions on the blob, while
+// one for an application server needs only read.
+type AzureBlobProvider struct {
+	Account     string
+	Container   string
+	Blob        string
+	SASToken    string `mapstructure:"sas-token"`
+	AccountKey  string `mapstructure:"account-key"`
+	Endpoint    string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL    time.Duration
+	accountKey []byte
+	client     *http.Client
+}
+
+// NewAzureBlobProvider creates a new Azure Blob Storage seed provider from the
+// given config.
+// "blob" is optional and defaults to the default key.
+// "endpoint" is optional and defaults to the public blob endpoint for the
+// account; it can be set to e.g. "http://127.0.0.1:10000/devstoreaccount1" to
+// use Azurite.
+func NewAzureBlobProvider(config map[string]interface{}) (*AzureBlobProvider, error) {
+	var provider AzureBlobProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse azure-blob provider config: %w", err)
+	}
+
+	if provider.Account == "" {
+		return nil, errors.New("missing required 'account' in provider config")
+	}
+
+	if provider.Container == "" {
+		return nil, errors.New("missing required 'container' in provider config")
+	}
+
+	if provider.Blob == "" {
+		provider.Blob = constants.DefaultKey
+	}
+
+	provider.Blob = namespaced(provider.Blob, provider.ClusterName)
+
+	if (provider.SASToken == "") == (provider.AccountKey == "") {
+		return nil, errors.New("exactly one of 'sas-token' and 'account-key' must be given in provider config")
+	}
+
+	if provider.AccountKey != "" {
+		provider.accountKey, err = base64.StdEncoding.DecodeString(provider.AccountKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode 'account-key' in provider config: %w", err)
+		}
+	}
+
+	provider.SASToken = strings.TrimPrefix(provider.SASToken, "?")
+
+	if provider.Endpoint == "" {
+		provider.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", provider.Account)
+	}
+
+	provider.Endpoint = strings.TrimSuffix(provider.Endpoint, "/")
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	provider.client = &http.Client{Timeout: 30 * time.Second}
+
+	return &provider, nil
+}
+
+// FetchSeed downloads the seed blob
+func (a *AzureBlobProvider) FetchSeed() (Seeds, error) {
+	seeds, _, err := a.download()
+
+	if err != nil {
+		return Seeds{}, err
+	}
+
+	return seeds, nil
+}
+
+// PushSeed adds the local node to the seed blob, pruning any stale seeds,
+// retrying if another node updates the blob at the same time
+func (a *AzureBlobProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	err = retryOnConflict("azure-blob", func() error {
+		seeds, etag, err := a.download()
+
+		if err != nil {
+			return err
+		}
+
+		pushSeed(&seeds, ip, port, a.seedTTL)
+
+		return a.upload(seeds, etag)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("successfully pushed seed to azure blob storage")
+
+	return nil
+}
+
+// RemoveSeed removes the local node from the seed blob
+func (a *AzureBlobProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	return retryOnConflict("azure-blob", func() error {
+		seeds, etag, err := a.download()
+
+		if err != nil {
+			return err
+		}
+
+		if !seeds.Remove(ip, port) {
+			log.Println("skipping seed removal as address is not published")
+			return nil
+		}
+
+		err = a.upload(seeds, etag)
+
+		if err != nil {
+			return err
+		}
+
+		log.Println("successfully removed seed from azure blob storage")
+
+		return nil
+	})
+}
+
+// download fetches the seed blob and its ETag. A missing blob is treated as
+// empty with an empty ETag, but a blob which can't be parsed is an error so
+// that other load balancers' seeds aren't overwritten.
+func (a *AzureBlobProvider) download() (Seeds, string, error) {
+	req, err := a.newRequest(http.MethodGet, nil)
+
+	if err != nil {
+		return Seeds{}, "", err
+	}
+
+	resp, err := a.client.Do(req)
+
+	if err != nil {
+		return Seeds{}, "", fmt.Errorf("unable to download seed from azure blob storage: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Seeds{}, "", nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return Seeds{}, "", fmt.Errorf("unable to read seed from azure blob storage: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Seeds{}, "", fmt.Errorf("unexpected status downloading seed from azure blob storage: %s: %s", resp.Status, string(body))
+	}
+
+	etag := resp.Header.Get("ETag")
+
+	var seeds Seeds
+
+	err = json.Unmarshal(body, &seeds)
+
+	if err != nil {
+		return Seeds{}, "", fmt.Errorf("unable to parse seed blob from azure blob storage: %w", err)
+	}
+
+	return seeds, etag, nil
+}
+
+// upload writes the seed blob if it still has the given ETag, or if it
+// doesn't exist when etag is empty, and otherwise fails with errConflict
+func (a *AzureBlobProvider) upload(seeds Seeds, etag string) error {
+	out, err := json.Marshal(seeds)
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal output for azure blob storage: %w", err)
+	}
+
+	req, err := a.newRequest(http.MethodPut, out)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	if etag == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", etag)
+	}
+
+	err = a.sign(req)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("couldn't upload azure blob storage content: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	// a failed If-Match gives 412, while a failed If-None-Match: * can give 409
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		return errConflict
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status uploading seed to azure blob storage: %s: %s", resp.Status, string(body))
+	}
+
+	return nil
+}
+
+// newRequest creates a request for the seed blob. GET requests are signed
+// immediately, while PUT requests must be signed by the caller once all
+// headers have been set.
+func (a *AzureBlobProvider) newRequest(method string, body []byte) (*http.Request, error) {
+	// slashes in blob names are virtual directories, and are left unescaped
+	var blobPath []string
+	for _, segment := range strings.Split(a.Blob, "/") {
+		blobPath = append(blobPath, url.PathEscape(segment))
+	}
+
+	blobURL := fmt.Sprintf("%s/%s/%s", a.Endpoint, url.PathEscape(a.Container), strings.Join(blobPath, "/"))
+
+	if a.SASToken != "" {
+		blobURL += "?" + a.SASToken
+	}
+
+	req, err := http.NewRequest(method, blobURL, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create azure blob storage request: %w", err)
+	}
+
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureStorageAPIVersion)
+
+	if method == http.MethodGet {
+		err = a.sign(req)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+// sign adds a SharedKey Authorization header to the request if an account key
+// was configured. Requests using a SAS token are already authorised by the
+// query string.
+func (a *AzureBlobProvider) sign(req *http.Request) error {
+	if a.accountKey == nil {
+		return nil
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name, values := range req.Header {
+		lowerName := strings.ToLower(name)
+
+		if strings.HasPrefix(lowerName, "x-ms-") {
+			msHeaders = append(msHeaders, lowerName+":"+strings.Join(values, ","))
+		}
+	}
+
+	sort.Strings(msHeaders)
+
+	canonicalizedResource := "/" + a.Account + req.URL.EscapedPath()
+
+	query := req.URL.Query()
+	var queryNames []string
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+
+	sort.Strings(queryNames)
+
+	for _, name := range queryNames {
+		values := query[name]
+		sort.Strings(values)
+		canonicalizedResource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; we use x-ms-date instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(msHeaders, "\n") + "\n" + canonicalizedResource
+
+	mac := hmac.New(sha256.New, a.accountKey)
+
+	_, err := mac.Write([]byte(stringToSign))
+
+	if err != nil {
+		return fmt.Errorf("couldn't sign azure blob storage request: %w", err)
+	}
+
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.Account, signature))
+
+	return nil
+}
+
+// TTL returns how long a seed can stay in the blob without being re-pushed
+func (a *AzureBlobProvider) TTL() time.Duration {
+	return a.seedTTL
+}
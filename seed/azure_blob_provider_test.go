@@ -0,0 +1,374 @@
+package seed
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	azuriteAccount = "devstoreaccount1"
+	// azuriteKey is the well known account key for Azurite and the Azure
+	// storage emulator
+	azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeAzureBlob implements conditional GET and PUT of block blobs for a
+// path style (Azurite) endpoint, checking either a SAS token or a SharedKey
+// signature on every request
+type fakeAzureBlob struct {
+	t        *testing.T
+	key      []byte
+	sasToken string
+
+	lock         sync.Mutex
+	blobs        map[string][]byte
+	etags        map[string]int
+	beforeUpload func()
+}
+
+func newFakeAzureBlob(t *testing.T) (*fakeAzureBlob, *httptest.Server) {
+	key, err := base64.StdEncoding.DecodeString(azuriteKey)
+
+	if err != nil {
+		t.Fatalf("couldn't decode account key: %v", err)
+	}
+
+	fake := &fakeAzureBlob{
+		t:     t,
+		key:   key,
+		blobs: make(map[string][]byte),
+		etags: make(map[string]int),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func (f *fakeAzureBlob) write(name string, body []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.blobs[name] = body
+	f.etags[name]++
+}
+
+func (f *fakeAzureBlob) read(name string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.blobs[name]
+}
+
+func (f *fakeAzureBlob) etag(name string) string {
+	return `"0x` + strconv.Itoa(f.etags[name]) + `"`
+}
+
+// authorised checks the request's SAS token or SharedKey signature, building
+// the string to sign as described in the Azure Storage REST API reference
+func (f *fakeAzureBlob) authorised(r *http.Request) bool {
+	if f.sasToken != "" {
+		return r.URL.RawQuery == f.sasToken && r.Header.Get("Authorization") == ""
+	}
+
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+
+	stringToSign := r.Method + "\n" +
+		r.Header.Get("Content-Encoding") + "\n" +
+		r.Header.Get("Content-Language") + "\n" +
+		contentLength + "\n" +
+		r.Header.Get("Content-MD5") + "\n" +
+		r.Header.Get("Content-Type") + "\n" +
+		r.Header.Get("Date") + "\n" +
+		r.Header.Get("If-Modified-Since") + "\n" +
+		r.Header.Get("If-Match") + "\n" +
+		r.Header.Get("If-None-Match") + "\n" +
+		r.Header.Get("If-Unmodified-Since") + "\n" +
+		r.Header.Get("Range") + "\n"
+
+	var msHeaders []string
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			msHeaders = append(msHeaders, strings.ToLower(name))
+		}
+	}
+
+	sort.Strings(msHeaders)
+
+	for _, name := range msHeaders {
+		stringToSign += name + ":" + r.Header.Get(name) + "\n"
+	}
+
+	// path style endpoints include the account name in the path as well
+	stringToSign += "/" + azuriteAccount + r.URL.EscapedPath()
+
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(stringToSign))
+
+	expected := "SharedKey " + azuriteAccount + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return r.Header.Get("Authorization") == expected
+}
+
+func (f *fakeAzureBlob) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authorised(r) {
+		http.Error(w, "AuthenticationFailed", http.StatusForbidden)
+		return
+	}
+
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		f.t.Errorf("missing x-ms-version or x-ms-date on %s %s", r.Method, r.URL)
+	}
+
+	prefix := "/" + azuriteAccount + "/seeds/"
+
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "ContainerNotFound", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+
+	switch r.Method {
+	case http.MethodGet:
+		f.lock.Lock()
+		body, ok := f.blobs[name]
+		etag := f.etag(name)
+		f.lock.Unlock()
+
+		if !ok {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Write(body)
+
+	case http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			f.t.Errorf("expected a block blob upload but got %q", r.Header.Get("x-ms-blob-type"))
+		}
+
+		if f.beforeUpload != nil {
+			beforeUpload := f.beforeUpload
+			f.beforeUpload = nil
+			beforeUpload()
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			f.t.Errorf("couldn't read upload body: %v", err)
+		}
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		_, exists := f.blobs[name]
+
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			http.Error(w, "BlobAlreadyExists", http.StatusConflict)
+			return
+		}
+
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != f.etag(name) {
+			http.Error(w, "ConditionNotMet", http.StatusPreconditionFailed)
+			return
+		}
+
+		f.blobs[name] = body
+		f.etags[name]++
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestAzureBlobProvider(t *testing.T, server *httptest.Server, extra map[string]interface{}) *AzureBlobProvider {
+	t.Helper()
+
+	config := map[string]interface{}{
+		"account":   azuriteAccount,
+		"container": "seeds",
+		"endpoint":  server.URL + "/" + azuriteAccount,
+	}
+
+	for k, v := range extra {
+		config[k] = v
+	}
+
+	provider, err := NewAzureBlobProvider(config)
+
+	if err != nil {
+		t.Fatalf("couldn't create azure-blob provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestAzureBlobProviderContract(t *testing.T) {
+	_, server := newFakeAzureBlob(t)
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestAzureBlobProvider(t, server, map[string]interface{}{"account-key": azuriteKey})
+	})
+}
+
+func TestAzureBlobProviderKeepsUnparseableBlob(t *testing.T) {
+	fake, server := newFakeAzureBlob(t)
+	provider := newTestAzureBlobProvider(t, server, map[string]interface{}{"account-key": azuriteKey})
+
+	fake.write("scrimplb", []byte("not json"))
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Error("expected pushing to an unparseable seed blob to fail")
+	}
+
+	if body := fake.read("scrimplb"); string(body) != "not json" {
+		t.Errorf("expected the unparseable seed blob to be left alone but got %s", body)
+	}
+}
+
+func TestAzureBlobProviderWrongKey(t *testing.T) {
+	_, server := newFakeAzureBlob(t)
+	wrongKey := base64.StdEncoding.EncodeToString([]byte("not the account key"))
+	provider := newTestAzureBlobProvider(t, server, map[string]interface{}{"account-key": wrongKey})
+
+	_, err := provider.FetchSeed()
+
+	if err == nil {
+		t.Fatal("expected fetching with the wrong account key to fail")
+	}
+}
+
+func TestAzureBlobProviderSASToken(t *testing.T) {
+	fake, server := newFakeAzureBlob(t)
+	fake.sasToken = "sv=2019-12-12&sr=b&sp=rcw&sig=test"
+
+	provider := newTestAzureBlobProvider(t, server, map[string]interface{}{"sas-token": "?" + fake.sasToken})
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+}
+
+func TestAzureBlobProviderRetriesConflictingPush(t *testing.T) {
+	fake, server := newFakeAzureBlob(t)
+	provider := newTestAzureBlobProvider(t, server, map[string]interface{}{"account-key": azuriteKey})
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push first seed: %v", err)
+	}
+
+	fake.beforeUpload = func() {
+		concurrent, _ := json.Marshal(Seeds{Seeds: []Seed{{Address: "10.0.0.1", Port: "9999"}, {Address: "10.0.0.3", Port: "9999"}}})
+		fake.write("scrimplb", concurrent)
+	}
+
+	err = provider.PushSeed(staticResolver("10.0.0.2"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push second seed: %v", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(fake.read("scrimplb"), &seeds)
+
+	if err != nil {
+		t.Fatalf("couldn't parse seed blob: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.2:9999", "10.0.0.3:9999")
+}
+
+// TestAzureBlobProviderSignature checks the SharedKey signature of a
+// conditional upload against a string to sign written out by hand
+func TestAzureBlobProviderSignature(t *testing.T) {
+	provider, err := NewAzureBlobProvider(map[string]interface{}{
+		"account":     "myaccount",
+		"container":   "seeds",
+		"blob":        "lb/scrimplb",
+		"account-key": azuriteKey,
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create azure-blob provider: %v", err)
+	}
+
+	req, err := provider.newRequest(http.MethodPut, []byte(`{"seeds":[]}`))
+
+	if err != nil {
+		t.Fatalf("couldn't create request: %v", err)
+	}
+
+	req.Header.Set("x-ms-date", "Mon, 19 Oct 2026 00:00:00 GMT")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("If-Match", `"0x1"`)
+
+	err = provider.sign(req)
+
+	if err != nil {
+		t.Fatalf("couldn't sign request: %v", err)
+	}
+
+	stringToSign := "PUT\n" +
+		"\n" + // Content-Encoding
+		"\n" + // Content-Language
+		"12\n" + // Content-Length
+		"\n" + // Content-MD5
+		"application/json\n" +
+		"\n" + // Date
+		"\n" + // If-Modified-Since
+		"\"0x1\"\n" +
+		"\n" + // If-None-Match
+		"\n" + // If-Unmodified-Since
+		"\n" + // Range
+		"x-ms-blob-type:BlockBlob\n" +
+		"x-ms-date:Mon, 19 Oct 2026 00:00:00 GMT\n" +
+		"x-ms-version:" + azureStorageAPIVersion + "\n" +
+		"/myaccount/seeds/lb/scrimplb"
+
+	mac := hmac.New(sha256.New, provider.accountKey)
+	mac.Write([]byte(stringToSign))
+
+	expected := "SharedKey myaccount:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if req.Header.Get("Authorization") != expected {
+		t.Errorf("expected Authorization %q but got %q", expected, req.Header.Get("Authorization"))
+	}
+
+	if req.URL.String() != "https://myaccount.blob.core.windows.net/seeds/lb/scrimplb" {
+		t.Errorf("unexpected blob URL %s", req.URL)
+	}
+}
@@ -0,0 +1,231 @@
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const (
+	chainModeMerge = "merge"
+	chainModeFirst = "first"
+)
+
+// ChainProvider wraps several other providers. Seeds are pushed to and
+// removed from every wrapped provider, and are fetched either by merging the
+// seeds from all of them or by taking the seeds from the first which returns
+// any. This is useful when migrating from one seed store to another, or to
+// tolerate one seed store being unavailable.
+type ChainProvider struct {
+	Mode      string
+	Providers []struct {
+		Name   string
+		Config map[string]interface{}
+	}
+	ClusterName string `mapstructure:"cluster-name"`
+
+	names     []string
+	providers []Provider
+}
+
+// NewChainProvider creates a new chain provider from the given config.
+// "providers" is a required list of objects, each with a "name" and a
+// "config" which are interpreted in the same way as "provider" and
+// "provider-config" at the top level.
+// "mode" is one of "merge" or "first" and defaults to "merge".
+func NewChainProvider(config map[string]interface{}) (*ChainProvider, error) {
+	var provider ChainProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse chain provider config: %w", err)
+	}
+
+	provider.Mode = strings.ToLower(provider.Mode)
+
+	switch provider.Mode {
+	case "":
+		provider.Mode = chainModeMerge
+
+	case chainModeMerge, chainModeFirst:
+
+	default:
+		return nil, fmt.Errorf("invalid 'mode' %s in provider config", provider.Mode)
+	}
+
+	if len(provider.Providers) == 0 {
+		return nil, errors.New("missing required 'providers' in provider config")
+	}
+
+	for i, wrapped := range provider.Providers {
+		name := strings.ToLower(wrapped.Name)
+
+		if name == "" {
+			return nil, fmt.Errorf("missing 'name' for chained provider %d", i)
+		}
+
+		wrappedProvider, err := NewProvider(name, WithClusterName(wrapped.Config, provider.ClusterName))
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't initialise chained provider '%s': %w", name, err)
+		}
+
+		provider.names = append(provider.names, name)
+		provider.providers = append(provider.providers, wrappedProvider)
+	}
+
+	return &provider, nil
+}
+
+// FetchSeed fetches seeds from the wrapped providers in order. In "merge" mode
+// every provider is asked and the results are de-duplicated, while in "first"
+// mode the seeds from the first provider to return any are used. Failing
+// providers are skipped unless every provider fails.
+func (c *ChainProvider) FetchSeed() (Seeds, error) {
+	var errs []string
+	merged := Seeds{}
+	found := make(map[string]bool)
+
+	for i, provider := range c.providers {
+		seeds, err := provider.FetchSeed()
+
+		if err != nil {
+			log.Printf("chain: couldn't fetch seeds from '%s': %v\n", c.names[i], err)
+			errs = append(errs, fmt.Sprintf("%s: %v", c.names[i], err))
+			continue
+		}
+
+		if c.Mode == chainModeFirst && len(seeds.Seeds) > 0 {
+			return seeds, nil
+		}
+
+		for _, seed := range seeds.Seeds {
+			key := seed.Address + ":" + seed.Port
+
+			if found[key] {
+				continue
+			}
+
+			found[key] = true
+			merged.Seeds = append(merged.Seeds, seed)
+		}
+	}
+
+	if len(errs) == len(c.providers) {
+		return Seeds{}, fmt.Errorf("all chained providers failed: %s", strings.Join(errs, "; "))
+	}
+
+	return merged, nil
+}
+
+// PushSeed pushes to every wrapped provider. Failing providers are logged and
+// skipped, since the seed is still published by the others, and an error is
+// only returned if every provider fails.
+func (c *ChainProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	errs := c.forEach("push", func(provider Provider) error {
+		return provider.PushSeed(resolver, port)
+	})
+
+	if len(errs) == len(c.providers) {
+		return fmt.Errorf("all chained providers failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// RemoveSeed removes from every wrapped provider, returning an error if any
+// fail
+func (c *ChainProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	errs := c.forEach("remove", func(provider Provider) error {
+		return provider.RemoveSeed(resolver, port)
+	})
+
+	return c.combine("remove", errs)
+}
+
+// Announce announces with every wrapped provider which can, returning an error
+// if any fail
+func (c *ChainProvider) Announce(resolver resolver.IPResolver, port string) error {
+	errs := c.forEach("announce", func(provider Provider) error {
+		announcer, ok := provider.(Announcer)
+
+		if !ok {
+			return nil
+		}
+
+		return announcer.Announce(resolver, port)
+	})
+
+	return c.combine("announce", errs)
+}
+
+// Close closes every wrapped provider which holds resources, returning an
+// error if any fail
+func (c *ChainProvider) Close() error {
+	errs := c.forEach("close", func(provider Provider) error {
+		closer, ok := provider.(io.Closer)
+
+		if !ok {
+			return nil
+		}
+
+		return closer.Close()
+	})
+
+	return c.combine("close", errs)
+}
+
+// TTL returns the shortest TTL of any wrapped provider which expires seeds, or
+// zero if none do
+func (c *ChainProvider) TTL() time.Duration {
+	var shortest time.Duration
+
+	for _, provider := range c.providers {
+		ttlProvider, ok := provider.(TTLProvider)
+
+		if !ok {
+			continue
+		}
+
+		ttl := ttlProvider.TTL()
+
+		if ttl > 0 && (shortest == 0 || ttl < shortest) {
+			shortest = ttl
+		}
+	}
+
+	return shortest
+}
+
+// forEach calls fn for every wrapped provider, even if some fail, logging and
+// returning any errors
+func (c *ChainProvider) forEach(operation string, fn func(Provider) error) []string {
+	var errs []string
+
+	for i, provider := range c.providers {
+		err := fn(provider)
+
+		if err != nil {
+			log.Printf("chain: couldn't %s seed with '%s': %v\n", operation, c.names[i], err)
+			errs = append(errs, fmt.Sprintf("%s: %v", c.names[i], err))
+		}
+	}
+
+	return errs
+}
+
+// combine returns an error listing errs if there are any
+func (c *ChainProvider) combine(operation string, errs []string) error {
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't %s seed with %d of %d chained providers: %s", operation, len(errs), len(c.providers), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package seed
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestChainProvider(t *testing.T, paths ...string) *ChainProvider {
+	t.Helper()
+
+	var providers []map[string]interface{}
+
+	for _, path := range paths {
+		providers = append(providers, map[string]interface{}{
+			"name":   "file",
+			"config": map[string]interface{}{"path": path},
+		})
+	}
+
+	provider, err := NewChainProvider(map[string]interface{}{"providers": providers})
+
+	if err != nil {
+		t.Fatalf("couldn't create chain provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestChainProviderPushToleratesPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing", "seeds.json")
+
+	provider := newTestChainProvider(t, filepath.Join(dir, "seeds.json"), missing)
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("expected a push which reached one provider to succeed, but got: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+
+	failing := newTestChainProvider(t, missing, filepath.Join(dir, "also-missing", "seeds.json"))
+
+	err = failing.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Fatal("expected a push which reached no providers to fail")
+	}
+}
@@ -0,0 +1,52 @@
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// errConflict is returned by a conditional write which failed because
+// another node updated the seeds between them being read and written
+var errConflict = errors.New("seeds were modified concurrently")
+
+// maxUpdateAttempts is how many times a conflicting conditional update will
+// be attempted before giving up
+const maxUpdateAttempts = 5
+
+// retryOnConflict runs update until it succeeds, fails with an error other
+// than errConflict or runs out of attempts. update is expected to read the
+// current seeds, modify them and write them back conditionally.
+func retryOnConflict(name string, update func() error) error {
+	var err error
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err = update()
+
+		if !errors.Is(err, errConflict) {
+			return err
+		}
+
+		backoff := time.Duration(100+rand.Int63n(400)) * time.Millisecond * time.Duration(i+1)
+		log.Printf("%s: conflicting seed update, retrying in %v\n", name, backoff)
+		time.Sleep(backoff)
+	}
+
+	return fmt.Errorf("%s: giving up after %d attempts: %w", name, maxUpdateAttempts, err)
+}
+
+// pushSeed adds or refreshes the seed for the given address and port and
+// prunes any seeds older than ttl.
+func pushSeed(seeds *Seeds, address string, port string, ttl time.Duration) {
+	now := time.Now()
+
+	seeds.Upsert(address, port, now)
+
+	pruned := seeds.Prune(ttl, now)
+
+	if pruned > 0 {
+		log.Printf("pruned %d stale seeds older than %v\n", pruned, ttl)
+	}
+}
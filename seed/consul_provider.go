@@ -0,0 +1,402 @@
+package seed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const (
+	consulModeKV      = "kv"
+	consulModeCatalog = "catalog"
+
+	defaultConsulAddress = "http://127.0.0.1:8500"
+	defaultConsulKey     = "scrimplb/seeds"
+	defaultConsulService = "scrimplb"
+)
+
+// ConsulProvider stores seeds in Consul. In "kv" mode the seeds document is
+// kept under a single key and updated using check-and-set, so concurrent
+// pushes from several load balancers can't overwrite each other. In "catalog"
+// mode each load balancer registers itself as an instance of a service with
+// a TTL health check which is passed on every push, and seeds are fetched
+// from the healthy instances of that service.
+type ConsulProvider struct {
+	Address     string
+	Token       string
+	Datacenter  string
+	Mode        string
+	Key         string
+	Service     string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *http.Client
+}
+
+// NewConsulProvider creates a new Consul seed provider from the given config.
+// "address" is the Consul HTTP API address and defaults to the local agent.
+// "mode" is one of "kv" or "catalog" and defaults to "kv".
+// "key" is used in "kv" mode, and "service" in "catalog" mode.
+// "seed-ttl" controls how long a seed which hasn't been re-pushed is kept for;
+// in "catalog" mode this is the TTL of the health check.
+func NewConsulProvider(config map[string]interface{}) (*ConsulProvider, error) {
+	var provider ConsulProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse consul provider config: %w", err)
+	}
+
+	if provider.Address == "" {
+		provider.Address = defaultConsulAddress
+	}
+
+	provider.Address = strings.TrimSuffix(provider.Address, "/")
+
+	provider.Mode = strings.ToLower(provider.Mode)
+
+	switch provider.Mode {
+	case "":
+		provider.Mode = consulModeKV
+
+	case consulModeKV, consulModeCatalog:
+
+	default:
+		return nil, fmt.Errorf("invalid 'mode' %s in provider config", provider.Mode)
+	}
+
+	if provider.Key == "" {
+		provider.Key = defaultConsulKey
+	}
+
+	if provider.Service == "" {
+		provider.Service = defaultConsulService
+	}
+
+	provider.Key = namespaced(provider.Key, provider.ClusterName)
+	provider.Service = namespaced(provider.Service, provider.ClusterName)
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	provider.client = &http.Client{Timeout: 30 * time.Second}
+
+	return &provider, nil
+}
+
+// FetchSeed reads seeds from the KV store or the service catalog
+func (c *ConsulProvider) FetchSeed() (Seeds, error) {
+	if c.Mode == consulModeCatalog {
+		return c.fetchCatalog()
+	}
+
+	seeds, _, err := c.readKV()
+
+	if err != nil {
+		return Seeds{}, err
+	}
+
+	return seeds, nil
+}
+
+// PushSeed adds the local node to the KV store, or registers it in the
+// service catalog and passes its health check
+func (c *ConsulProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	if c.Mode == consulModeCatalog {
+		err = c.register(ip, port)
+	} else {
+		err = retryOnConflict("consul", func() error {
+			seeds, index, err := c.readKV()
+
+			if err != nil {
+				return err
+			}
+
+			pushSeed(&seeds, ip, port, c.seedTTL)
+
+			return c.writeKV(seeds, index)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("successfully pushed seed to consul %s\n", c.Mode)
+
+	return nil
+}
+
+// RemoveSeed removes the local node from the KV store, or deregisters it from
+// the service catalog
+func (c *ConsulProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	if c.Mode == consulModeCatalog {
+		_, err = c.do(http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(c.serviceID(ip, port)), nil, nil)
+
+		if err != nil {
+			return fmt.Errorf("couldn't deregister consul service: %w", err)
+		}
+
+		log.Println("successfully deregistered seed from consul catalog")
+		return nil
+	}
+
+	return retryOnConflict("consul", func() error {
+		seeds, index, err := c.readKV()
+
+		if err != nil {
+			return err
+		}
+
+		if !seeds.Remove(ip, port) {
+			log.Println("skipping seed removal as address is not published")
+			return nil
+		}
+
+		err = c.writeKV(seeds, index)
+
+		if err != nil {
+			return err
+		}
+
+		log.Println("successfully removed seed from consul kv")
+
+		return nil
+	})
+}
+
+// readKV reads the seeds key along with its ModifyIndex for check-and-set. A
+// missing key is treated as empty with index 0, which Consul interprets as
+// "the key must not exist" for check-and-set. A key which can't be parsed is
+// an error, so that it isn't overwritten along with other load balancers'
+// seeds.
+func (c *ConsulProvider) readKV() (Seeds, uint64, error) {
+	var entries []struct {
+		ModifyIndex uint64
+		Value       []byte
+	}
+
+	status, err := c.do(http.MethodGet, "/v1/kv/"+c.Key, nil, &entries)
+
+	if status == http.StatusNotFound {
+		return Seeds{}, 0, nil
+	}
+
+	if err != nil {
+		return Seeds{}, 0, fmt.Errorf("unable to read seed from consul kv: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return Seeds{}, 0, nil
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(entries[0].Value, &seeds)
+
+	if err != nil {
+		return Seeds{}, 0, fmt.Errorf("unable to parse seed from consul kv: %w", err)
+	}
+
+	return seeds, entries[0].ModifyIndex, nil
+}
+
+// writeKV writes the seeds key if its ModifyIndex still matches index, and
+// otherwise fails with errConflict
+func (c *ConsulProvider) writeKV(seeds Seeds, index uint64) error {
+	out, err := json.Marshal(seeds)
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal output for consul kv: %w", err)
+	}
+
+	var succeeded bool
+
+	_, err = c.do(http.MethodPut, "/v1/kv/"+c.Key+"?cas="+strconv.FormatUint(index, 10), out, &succeeded)
+
+	if err != nil {
+		return fmt.Errorf("couldn't write seed to consul kv: %w", err)
+	}
+
+	if !succeeded {
+		return errConflict
+	}
+
+	return nil
+}
+
+// register registers the local node with the local agent and passes its TTL
+// check. Registration is idempotent, so this is safe to repeat on every push
+// and recovers from the agent having lost the registration.
+func (c *ConsulProvider) register(ip string, port string) error {
+	intPort, err := strconv.Atoi(port)
+
+	if err != nil {
+		return fmt.Errorf("invalid port %s for consul service: %w", port, err)
+	}
+
+	serviceID := c.serviceID(ip, port)
+
+	registration := map[string]interface{}{
+		"ID":      serviceID,
+		"Name":    c.Service,
+		"Address": strings.Trim(ip, "[]"),
+		"Port":    intPort,
+		"Check": map[string]interface{}{
+			"CheckID":                        serviceID,
+			"TTL":                            c.seedTTL.String(),
+			"DeregisterCriticalServiceAfter": c.seedTTL.String(),
+		},
+	}
+
+	out, err := json.Marshal(registration)
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal consul service registration: %w", err)
+	}
+
+	_, err = c.do(http.MethodPut, "/v1/agent/service/register", out, nil)
+
+	if err != nil {
+		return fmt.Errorf("couldn't register consul service: %w", err)
+	}
+
+	_, err = c.do(http.MethodPut, "/v1/agent/check/pass/"+url.PathEscape(serviceID), nil, nil)
+
+	if err != nil {
+		return fmt.Errorf("couldn't pass consul check: %w", err)
+	}
+
+	return nil
+}
+
+// fetchCatalog returns a seed for each healthy instance of the service
+func (c *ConsulProvider) fetchCatalog() (Seeds, error) {
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+
+	_, err := c.do(http.MethodGet, "/v1/health/service/"+url.PathEscape(c.Service)+"?passing=true", nil, &entries)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to fetch seeds from consul catalog: %w", err)
+	}
+
+	seeds := Seeds{}
+
+	for _, entry := range entries {
+		address := entry.Service.Address
+
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+			address = fmt.Sprintf("[%s]", address)
+		}
+
+		seeds.Seeds = append(seeds.Seeds, Seed{
+			Address: address,
+			Port:    strconv.Itoa(entry.Service.Port),
+		})
+	}
+
+	return seeds, nil
+}
+
+func (c *ConsulProvider) serviceID(ip string, port string) string {
+	return c.Service + "-" + strings.NewReplacer("[", "", "]", "", ":", "-").Replace(ip) + "-" + port
+}
+
+// do makes a request to the Consul HTTP API, decoding any JSON response into
+// result if it's non-nil. The response status is returned even on error.
+func (c *ConsulProvider) do(method string, path string, body []byte, result interface{}) (int, error) {
+	req, err := http.NewRequest(method, c.Address+path, bytes.NewReader(body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	if c.Datacenter != "" {
+		query := req.URL.Query()
+		query.Set("dc", c.Datacenter)
+		req.URL.RawQuery = query.Encode()
+	}
+
+	resp, err := c.client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("unexpected status from consul: %s: %s", resp.Status, string(raw))
+	}
+
+	if result != nil {
+		err = json.Unmarshal(raw, result)
+
+		if err != nil {
+			return resp.StatusCode, fmt.Errorf("couldn't parse response from consul: %w", err)
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// TTL returns the seed TTL, which is also the TTL of the service's health check
+func (c *ConsulProvider) TTL() time.Duration {
+	return c.seedTTL
+}
@@ -0,0 +1,335 @@
+package seed
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeConsulService struct {
+	ID      string
+	Service string
+	Address string
+	Port    int
+	Passing bool
+}
+
+// fakeConsul implements the KV, agent service and health endpoints of the
+// Consul HTTP API which are used by the Consul provider
+type fakeConsul struct {
+	t     *testing.T
+	token string
+	dc    string
+
+	lock        sync.Mutex
+	index       uint64
+	kv          map[string][]byte
+	kvIndex     map[string]uint64
+	services    map[string]*fakeConsulService
+	beforeWrite func()
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *httptest.Server) {
+	fake := &fakeConsul{
+		t:        t,
+		token:    "consul-token",
+		dc:       "dc1",
+		kv:       make(map[string][]byte),
+		kvIndex:  make(map[string]uint64),
+		services: make(map[string]*fakeConsulService),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+// put stores a key as another client would
+func (f *fakeConsul) put(key string, value []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.index++
+	f.kv[key] = value
+	f.kvIndex[key] = f.index
+}
+
+func (f *fakeConsul) get(key string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.kv[key]
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != f.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("dc") != f.dc {
+		f.t.Errorf("expected dc %s on %s", f.dc, r.URL)
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == http.MethodPut && f.beforeWrite != nil {
+		beforeWrite := f.beforeWrite
+		f.beforeWrite = nil
+		beforeWrite()
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+
+	case r.URL.Path == "/v1/agent/service/register" && r.Method == http.MethodPut:
+		var registration struct {
+			ID      string
+			Name    string
+			Address string
+			Port    int
+			Check   struct {
+				CheckID string
+				TTL     string
+			}
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&registration)
+
+		if err != nil || registration.Check.TTL == "" || registration.Check.CheckID != registration.ID {
+			http.Error(w, "invalid registration", http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := f.services[registration.ID]; !ok {
+			f.services[registration.ID] = &fakeConsulService{}
+		}
+
+		service := f.services[registration.ID]
+		service.ID = registration.ID
+		service.Service = registration.Name
+		service.Address = registration.Address
+		service.Port = registration.Port
+
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/") && r.Method == http.MethodPut:
+		service, ok := f.services[strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/")]
+
+		if !ok {
+			http.Error(w, "unknown check", http.StatusNotFound)
+			return
+		}
+
+		service.Passing = true
+
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/") && r.Method == http.MethodPut:
+		delete(f.services, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/") && r.Method == http.MethodGet:
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		passingOnly := r.URL.Query().Get("passing") == "true"
+
+		type entry struct {
+			Node struct {
+				Address string
+			}
+			Service struct {
+				Address string
+				Port    int
+			}
+		}
+
+		entries := []entry{}
+
+		for _, service := range f.services {
+			if service.Service != name || (passingOnly && !service.Passing) {
+				continue
+			}
+
+			var e entry
+			e.Node.Address = "192.0.2.1"
+			e.Service.Address = service.Address
+			e.Service.Port = service.Port
+
+			entries = append(entries, e)
+		}
+
+		json.NewEncoder(w).Encode(entries)
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request, key string) {
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := f.kv[key]
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode([]map[string]interface{}{{
+			"Key":         key,
+			"ModifyIndex": f.kvIndex[key],
+			"Value":       value,
+		}})
+
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			f.t.Errorf("couldn't read kv body: %v", err)
+		}
+
+		if cas := r.URL.Query().Get("cas"); cas != "" {
+			index, err := strconv.ParseUint(cas, 10, 64)
+
+			if err != nil {
+				http.Error(w, "invalid cas", http.StatusBadRequest)
+				return
+			}
+
+			if index != f.kvIndex[key] {
+				w.Write([]byte("false"))
+				return
+			}
+		}
+
+		f.index++
+		f.kv[key] = value
+		f.kvIndex[key] = f.index
+
+		w.Write([]byte("true"))
+
+	default:
+		f.t.Errorf("unexpected kv request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestConsulProvider(t *testing.T, server *httptest.Server, extra map[string]interface{}) *ConsulProvider {
+	t.Helper()
+
+	config := map[string]interface{}{
+		"address":    server.URL,
+		"token":      "consul-token",
+		"datacenter": "dc1",
+	}
+
+	for k, v := range extra {
+		config[k] = v
+	}
+
+	provider, err := NewConsulProvider(config)
+
+	if err != nil {
+		t.Fatalf("couldn't create consul provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestConsulProviderKVContract(t *testing.T) {
+	_, server := newFakeConsul(t)
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestConsulProvider(t, server, nil)
+	})
+}
+
+func TestConsulProviderKVKeepsUnparseableKey(t *testing.T) {
+	fake, server := newFakeConsul(t)
+	provider := newTestConsulProvider(t, server, nil)
+
+	fake.put("scrimplb/seeds", []byte("not json"))
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Error("expected pushing to an unparseable seeds key to fail")
+	}
+
+	if value := fake.get("scrimplb/seeds"); string(value) != "not json" {
+		t.Errorf("expected the unparseable seeds key to be left alone but got %s", value)
+	}
+}
+
+func TestConsulProviderKVRetriesConflictingPush(t *testing.T) {
+	fake, server := newFakeConsul(t)
+	provider := newTestConsulProvider(t, server, nil)
+
+	fake.beforeWrite = func() {
+		concurrent, _ := json.Marshal(Seeds{Seeds: []Seed{{Address: "10.0.0.2", Port: "9999"}}})
+		fake.put("scrimplb/seeds", concurrent)
+	}
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(fake.get("scrimplb/seeds"), &seeds)
+
+	if err != nil {
+		t.Fatalf("couldn't parse seeds key: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.2:9999")
+}
+
+func TestConsulProviderCatalogContract(t *testing.T) {
+	_, server := newFakeConsul(t)
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestConsulProvider(t, server, map[string]interface{}{"mode": "catalog"})
+	})
+}
+
+func TestConsulProviderCatalogSkipsUnhealthyInstances(t *testing.T) {
+	fake, server := newFakeConsul(t)
+	provider := newTestConsulProvider(t, server, map[string]interface{}{"mode": "catalog"})
+
+	err := provider.PushSeed(staticResolver("[fd00::2]"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	// a registered instance which hasn't passed its check isn't a seed
+	fake.lock.Lock()
+	fake.services["unhealthy"] = &fakeConsulService{ID: "unhealthy", Service: "scrimplb", Address: "10.0.0.3", Port: 9999}
+	fake.lock.Unlock()
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "[fd00::2]:9999")
+}
+
+func TestConsulProviderWrongToken(t *testing.T) {
+	_, server := newFakeConsul(t)
+	provider := newTestConsulProvider(t, server, map[string]interface{}{"token": "wrong"})
+
+	_, err := provider.FetchSeed()
+
+	if err == nil {
+		t.Fatal("expected fetching with the wrong token to fail")
+	}
+}
@@ -0,0 +1,325 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const (
+	dnsRecordTypeSRV  = "srv"
+	dnsRecordTypeAAAA = "aaaa"
+	dnsRecordTypeA    = "a"
+
+	defaultDNSRecordTTL = "60s"
+)
+
+// DNSProvider resolves seeds from DNS records. SRV records give both the
+// address and port of each seed, while AAAA or A records give only an address
+// and the configured port is used.
+// If an update server is configured, PushSeed and RemoveSeed publish the local
+// node using RFC 2136 dynamic updates, optionally signed with TSIG. DNS has no
+// concept of when a record was last pushed, so stale seeds aren't pruned and
+// load balancers should remove their seeds on shutdown.
+type DNSProvider struct {
+	Name          string
+	RecordType    string `mapstructure:"record-type"`
+	Port          string
+	Nameserver    string
+	UpdateServer  string `mapstructure:"update-server"`
+	Zone          string
+	Target        string
+	RecordTTL     string `mapstructure:"record-ttl"`
+	TSIGKeyName   string `mapstructure:"tsig-key-name"`
+	TSIGSecret    string `mapstructure:"tsig-secret"`
+	TSIGAlgorithm string `mapstructure:"tsig-algorithm"`
+
+	recordTTL uint32
+	resolver  *net.Resolver
+}
+
+// NewDNSProvider creates a new DNS seed provider from the given config.
+// "name" is the DNS name to look up, and is required.
+// "record-type" is one of "srv", "aaaa" or "a" and defaults to "srv".
+// "port" is used for "aaaa" and "a" records and defaults to the default port.
+// "nameserver" is optional and overrides the system resolver with the given
+// "host:port".
+// "update-server" enables dynamic updates, and requires "zone". For SRV
+// records, "target" must also be given as the host name of this load balancer
+// since SRV records can't point directly at an address.
+func NewDNSProvider(config map[string]interface{}) (*DNSProvider, error) {
+	var provider DNSProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse dns provider config: %w", err)
+	}
+
+	if provider.Name == "" {
+		return nil, errors.New("missing required 'name' in provider config")
+	}
+
+	provider.RecordType = strings.ToLower(provider.RecordType)
+
+	switch provider.RecordType {
+	case "":
+		provider.RecordType = dnsRecordTypeSRV
+
+	case dnsRecordTypeSRV, dnsRecordTypeAAAA, dnsRecordTypeA:
+
+	default:
+		return nil, fmt.Errorf("invalid 'record-type' %s in provider config", provider.RecordType)
+	}
+
+	if provider.Port == "" {
+		provider.Port = constants.DefaultPort
+	}
+
+	if provider.UpdateServer != "" {
+		if provider.Zone == "" {
+			return nil, errors.New("missing required 'zone' for 'update-server' in provider config")
+		}
+
+		if provider.RecordType == dnsRecordTypeSRV && provider.Target == "" {
+			return nil, errors.New("missing required 'target' for SRV updates in provider config")
+		}
+
+		if (provider.TSIGKeyName == "") != (provider.TSIGSecret == "") {
+			return nil, errors.New("'tsig-key-name' and 'tsig-secret' must be given together in provider config")
+		}
+	}
+
+	if provider.TSIGAlgorithm == "" {
+		provider.TSIGAlgorithm = dns.HmacSHA256
+	}
+
+	if provider.RecordTTL == "" {
+		provider.RecordTTL = defaultDNSRecordTTL
+	}
+
+	recordTTL, err := time.ParseDuration(provider.RecordTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'record-ttl' in provider config: %w", err)
+	}
+
+	provider.recordTTL = uint32(recordTTL.Seconds())
+
+	provider.resolver = net.DefaultResolver
+
+	if provider.Nameserver != "" {
+		nameserver := provider.Nameserver
+		provider.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, nameserver)
+			},
+		}
+	}
+
+	return &provider, nil
+}
+
+// FetchSeed looks up the configured name and returns a seed for each record
+func (d *DNSProvider) FetchSeed() (Seeds, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	seeds := Seeds{}
+
+	if d.RecordType == dnsRecordTypeSRV {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.Name)
+
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				return Seeds{}, nil
+			}
+
+			return Seeds{}, fmt.Errorf("couldn't look up SRV records for %s: %w", d.Name, err)
+		}
+
+		for _, record := range records {
+			seeds.Seeds = append(seeds.Seeds, Seed{
+				Address: strings.TrimSuffix(record.Target, "."),
+				Port:    strconv.Itoa(int(record.Port)),
+			})
+		}
+
+		return seeds, nil
+	}
+
+	addresses, err := d.resolver.LookupIPAddr(ctx, d.Name)
+
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return Seeds{}, nil
+		}
+
+		return Seeds{}, fmt.Errorf("couldn't look up addresses for %s: %w", d.Name, err)
+	}
+
+	for _, address := range addresses {
+		isIPv4 := address.IP.To4() != nil
+
+		if isIPv4 && d.RecordType == dnsRecordTypeA {
+			seeds.Seeds = append(seeds.Seeds, Seed{
+				Address: address.IP.String(),
+				Port:    d.Port,
+			})
+		} else if !isIPv4 && d.RecordType == dnsRecordTypeAAAA {
+			seeds.Seeds = append(seeds.Seeds, Seed{
+				Address: fmt.Sprintf("[%s]", address.IP.String()),
+				Port:    d.Port,
+			})
+		}
+	}
+
+	return seeds, nil
+}
+
+// PushSeed adds a record for the local node using a dynamic update, if an
+// update server is configured
+func (d *DNSProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	if d.UpdateServer == "" {
+		return nil
+	}
+
+	record, err := d.localRecord(resolver, port)
+
+	if err != nil {
+		return err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(d.Zone))
+	msg.Insert([]dns.RR{record})
+
+	err = d.sendUpdate(msg)
+
+	if err != nil {
+		return fmt.Errorf("couldn't push seed with dns update: %w", err)
+	}
+
+	log.Println("successfully pushed seed with dns update")
+
+	return nil
+}
+
+// RemoveSeed removes the record for the local node using a dynamic update, if
+// an update server is configured
+func (d *DNSProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	if d.UpdateServer == "" {
+		return nil
+	}
+
+	record, err := d.localRecord(resolver, port)
+
+	if err != nil {
+		return err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(d.Zone))
+	msg.Remove([]dns.RR{record})
+
+	err = d.sendUpdate(msg)
+
+	if err != nil {
+		return fmt.Errorf("couldn't remove seed with dns update: %w", err)
+	}
+
+	log.Println("successfully removed seed with dns update")
+
+	return nil
+}
+
+// localRecord builds the resource record which advertises the local node
+func (d *DNSProvider) localRecord(resolver resolver.IPResolver, port string) (dns.RR, error) {
+	header := dns.RR_Header{
+		Name:  dns.Fqdn(d.Name),
+		Class: dns.ClassINET,
+		Ttl:   d.recordTTL,
+	}
+
+	if d.RecordType == dnsRecordTypeSRV {
+		intPort, err := strconv.ParseUint(port, 10, 16)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s for SRV record: %w", port, err)
+		}
+
+		header.Rrtype = dns.TypeSRV
+
+		return &dns.SRV{
+			Hdr:    header,
+			Port:   uint16(intPort),
+			Target: dns.Fqdn(d.Target),
+		}, nil
+	}
+
+	if port != d.Port {
+		log.Printf("warning: dns provider publishes addresses only, and clients will use port %s rather than %s\n", d.Port, port)
+	}
+
+	rawIP, err := resolver.ResolveIP()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.Trim(rawIP, "[]"))
+
+	if ip == nil {
+		return nil, fmt.Errorf("couldn't parse resolved ip %s", rawIP)
+	}
+
+	isIPv4 := ip.To4() != nil
+
+	switch {
+	case d.RecordType == dnsRecordTypeA && isIPv4:
+		header.Rrtype = dns.TypeA
+		return &dns.A{Hdr: header, A: ip}, nil
+
+	case d.RecordType == dnsRecordTypeAAAA && !isIPv4:
+		header.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: header, AAAA: ip}, nil
+
+	default:
+		return nil, fmt.Errorf("resolved ip %s can't be published as a %s record", rawIP, d.RecordType)
+	}
+}
+
+func (d *DNSProvider) sendUpdate(msg *dns.Msg) error {
+	client := new(dns.Client)
+	client.Net = "tcp"
+
+	if d.TSIGKeyName != "" {
+		keyName := dns.Fqdn(d.TSIGKeyName)
+		client.TsigSecret = map[string]string{keyName: d.TSIGSecret}
+		msg.SetTsig(keyName, dns.Fqdn(d.TSIGAlgorithm), 300, time.Now().Unix())
+	}
+
+	reply, _, err := client.Exchange(msg, d.UpdateServer)
+
+	if err != nil {
+		return err
+	}
+
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update rejected by %s: %s", d.UpdateServer, dns.RcodeToString[reply.Rcode])
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+package seed
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGKeyName = "scrimplb."
+	testTSIGSecret  = "c2NyaW1wbGIgdGVzdCB0c2lnIHNlY3JldA=="
+)
+
+// fakeDNS is an authoritative server for a single zone which answers queries
+// and applies RFC 2136 updates signed with the test TSIG key
+type fakeDNS struct {
+	t    *testing.T
+	zone string
+	addr string
+
+	lock    sync.Mutex
+	records []dns.RR
+}
+
+func newFakeDNS(t *testing.T, zone string) *fakeDNS {
+	fake := &fakeDNS{
+		t:    t,
+		zone: dns.Fqdn(zone),
+	}
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("couldn't listen for dns over udp: %v", err)
+	}
+
+	fake.addr = packetConn.LocalAddr().String()
+
+	listener, err := net.Listen("tcp", fake.addr)
+
+	if err != nil {
+		packetConn.Close()
+		t.Fatalf("couldn't listen for dns over tcp: %v", err)
+	}
+
+	tsigSecret := map[string]string{testTSIGKeyName: testTSIGSecret}
+
+	// the default accept func rejects updates as not implemented
+	acceptAll := func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+
+	servers := []*dns.Server{
+		{PacketConn: packetConn, Handler: fake, TsigSecret: tsigSecret, MsgAcceptFunc: acceptAll},
+		{Listener: listener, Handler: fake, TsigSecret: tsigSecret, MsgAcceptFunc: acceptAll},
+	}
+
+	for _, server := range servers {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+
+		go server.ActivateAndServe()
+		<-started
+
+		server := server
+		t.Cleanup(func() { server.Shutdown() })
+	}
+
+	return fake
+}
+
+func (f *fakeDNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Authoritative = true
+
+	if req.Opcode == dns.OpcodeUpdate {
+		reply.Rcode = f.update(w, req)
+
+		if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+			reply.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, int64(tsig.TimeSigned))
+		}
+
+		w.WriteMsg(reply)
+		return
+	}
+
+	f.lock.Lock()
+	for _, question := range req.Question {
+		for _, record := range f.records {
+			header := record.Header()
+
+			if header.Name == question.Name && header.Rrtype == question.Qtype {
+				reply.Answer = append(reply.Answer, dns.Copy(record))
+			}
+		}
+	}
+	f.lock.Unlock()
+
+	if len(reply.Answer) == 0 {
+		reply.Rcode = dns.RcodeNameError
+	}
+
+	w.WriteMsg(reply)
+}
+
+func (f *fakeDNS) update(w dns.ResponseWriter, req *dns.Msg) int {
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		return dns.RcodeRefused
+	}
+
+	if len(req.Question) != 1 || req.Question[0].Name != f.zone {
+		return dns.RcodeNotZone
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, record := range req.Ns {
+		switch record.Header().Class {
+		case dns.ClassINET:
+			// as in RFC 2136 section 3.4.2.2, adding a record which already
+			// exists only replaces it
+			var kept []dns.RR
+
+			for _, existing := range f.records {
+				if !sameRecord(existing, record) {
+					kept = append(kept, existing)
+				}
+			}
+
+			f.records = append(kept, record)
+
+		case dns.ClassNONE:
+			var kept []dns.RR
+
+			for _, existing := range f.records {
+				if !sameRecord(existing, record) {
+					kept = append(kept, existing)
+				}
+			}
+
+			f.records = kept
+
+		default:
+			f.t.Errorf("unexpected update record %v", record)
+			return dns.RcodeNotImplemented
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// sameRecord compares records ignoring their class and TTL, which differ
+// between an added record and a request to delete it
+func sameRecord(a dns.RR, b dns.RR) bool {
+	a = dns.Copy(a)
+	b = dns.Copy(b)
+
+	a.Header().Class, a.Header().Ttl = dns.ClassINET, 0
+	b.Header().Class, b.Header().Ttl = dns.ClassINET, 0
+
+	return dns.IsDuplicate(a, b)
+}
+
+func newTestDNSProvider(t *testing.T, fake *fakeDNS, extra map[string]interface{}) *DNSProvider {
+	t.Helper()
+
+	config := map[string]interface{}{
+		"name":          "seeds.scrimplb.test",
+		"nameserver":    fake.addr,
+		"update-server": fake.addr,
+		"zone":          "scrimplb.test",
+		"tsig-key-name": testTSIGKeyName,
+		"tsig-secret":   testTSIGSecret,
+	}
+
+	for k, v := range extra {
+		config[k] = v
+	}
+
+	provider, err := NewDNSProvider(config)
+
+	if err != nil {
+		t.Fatalf("couldn't create dns provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestDNSProviderSRVRecords(t *testing.T) {
+	fake := newFakeDNS(t, "scrimplb.test")
+
+	first := newTestDNSProvider(t, fake, map[string]interface{}{"target": "lb1.scrimplb.test"})
+	second := newTestDNSProvider(t, fake, map[string]interface{}{"target": "lb2.scrimplb.test"})
+
+	seeds, err := first.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch missing records: %v", err)
+	}
+
+	assertAddresses(t, seeds)
+
+	err = first.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push first seed: %v", err)
+	}
+
+	err = second.PushSeed(staticResolver("10.0.0.2"), "9998")
+
+	if err != nil {
+		t.Fatalf("couldn't push second seed: %v", err)
+	}
+
+	seeds, err = first.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "lb1.scrimplb.test:9999", "lb2.scrimplb.test:9998")
+
+	err = first.RemoveSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't remove seed: %v", err)
+	}
+
+	seeds, err = first.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds after removal: %v", err)
+	}
+
+	assertAddresses(t, seeds, "lb2.scrimplb.test:9998")
+}
+
+func TestDNSProviderContract(t *testing.T) {
+	fake := newFakeDNS(t, "scrimplb.test")
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestDNSProvider(t, fake, map[string]interface{}{
+			"record-type": "a",
+			"port":        "9999",
+		})
+	})
+}
+
+func TestDNSProviderAAAARecords(t *testing.T) {
+	fake := newFakeDNS(t, "scrimplb.test")
+
+	provider := newTestDNSProvider(t, fake, map[string]interface{}{
+		"record-type": "aaaa",
+		"port":        "9999",
+	})
+
+	err := provider.PushSeed(staticResolver("[fd00::1]"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push aaaa seed: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch aaaa seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "[fd00::1]:9999")
+}
+
+func TestDNSProviderRejectedUpdate(t *testing.T) {
+	fake := newFakeDNS(t, "scrimplb.test")
+
+	provider := newTestDNSProvider(t, fake, map[string]interface{}{
+		"record-type": "a",
+		"port":        "9999",
+		"tsig-secret": "d3Jvbmcgc2VjcmV0",
+	})
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Fatal("expected an update with the wrong TSIG secret to fail")
+	}
+
+	if len(fake.records) != 0 {
+		t.Errorf("expected no records after a rejected update but got %d", len(fake.records))
+	}
+}
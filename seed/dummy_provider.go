@@ -24,3 +24,9 @@ func (d *DummyProvider) PushSeed(resolver resolver.IPResolver, port string) erro
 	log.Println("dummy provider: PushSeed")
 	return nil
 }
+
+// RemoveSeed does nothing and returns no error
+func (d *DummyProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	log.Println("dummy provider: RemoveSeed")
+	return nil
+}
@@ -0,0 +1,224 @@
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+// Attribute names used in the DynamoDB seeds table. The table must have a
+// string partition key named "cluster" and a string sort key named "seed",
+// and TTL should be enabled on the "expires" attribute so that seeds of dead
+// load balancers are deleted automatically.
+const (
+	dynamoDBClusterAttribute  = "cluster"
+	dynamoDBSeedAttribute     = "seed"
+	dynamoDBAddressAttribute  = "address"
+	dynamoDBPortAttribute     = "port"
+	dynamoDBLastSeenAttribute = "last-seen"
+	dynamoDBExpiresAttribute  = "expires"
+)
+
+// DynamoDBProvider stores each load balancer's seed as its own item in a
+// DynamoDB table. Writes are conditional on never moving a seed's last-seen
+// time backwards, and each item carries a TTL attribute so that DynamoDB
+// expires the seeds of dead load balancers.
+// Required permissions for a load balancer are: dynamodb:PutItem, dynamodb:DeleteItem, dynamodb:Query
+// Required permissions for an application server are: dynamodb:Query
+type DynamoDBProvider struct {
+	AWSSessionConfig `mapstructure:",squash"`
+
+	Table       string
+	Cluster     string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *dynamodb.DynamoDB
+}
+
+// NewDynamoDBProvider creates a new DynamoDB seed provider from the given
+// config.
+// "table" is required.
+// "cluster" is the partition key value to use and defaults to the default key.
+// "seed-ttl" controls when a seed expires if it isn't re-pushed.
+// See AWSSessionConfig for region, endpoint and credential options; setting
+// "endpoint" allows DynamoDB Local to be used.
+func NewDynamoDBProvider(config map[string]interface{}) (*DynamoDBProvider, error) {
+	var provider DynamoDBProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse dynamodb provider config: %w", err)
+	}
+
+	if provider.Table == "" {
+		return nil, errors.New("missing required 'table' in provider config")
+	}
+
+	if provider.Cluster == "" {
+		provider.Cluster = constants.DefaultKey
+	}
+
+	provider.Cluster = namespaced(provider.Cluster, provider.ClusterName)
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	sess, err := provider.newSession()
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider.client = dynamodb.New(sess)
+
+	return &provider, nil
+}
+
+// FetchSeed queries all unexpired seeds for the cluster. DynamoDB deletes
+// expired items lazily, so expiry is also checked here.
+func (d *DynamoDBProvider) FetchSeed() (Seeds, error) {
+	seeds := Seeds{}
+
+	err := d.client.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		KeyConditionExpression: aws.String("#cluster = :cluster"),
+		FilterExpression:       aws.String("#expires > :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#cluster": aws.String(dynamoDBClusterAttribute),
+			"#expires": aws.String(dynamoDBExpiresAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cluster": {S: aws.String(d.Cluster)},
+			":now":     {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			seed := Seed{}
+
+			if address, ok := item[dynamoDBAddressAttribute]; ok {
+				seed.Address = aws.StringValue(address.S)
+			}
+
+			if port, ok := item[dynamoDBPortAttribute]; ok {
+				seed.Port = aws.StringValue(port.S)
+			}
+
+			if lastSeen, ok := item[dynamoDBLastSeenAttribute]; ok {
+				unix, err := strconv.ParseInt(aws.StringValue(lastSeen.N), 10, 64)
+
+				if err == nil {
+					seed.LastSeen = time.Unix(unix, 0)
+				}
+			}
+
+			if seed.Address == "" || seed.Port == "" {
+				log.Println("skipping incomplete seed from dynamodb")
+				continue
+			}
+
+			seeds.Seeds = append(seeds.Seeds, seed)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to query seeds from dynamodb: %w", err)
+	}
+
+	return seeds, nil
+}
+
+// PushSeed writes the local node's seed item with a refreshed expiry time
+func (d *DynamoDBProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	nowString := strconv.FormatInt(now.Unix(), 10)
+
+	_, err = d.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamoDBClusterAttribute:  {S: aws.String(d.Cluster)},
+			dynamoDBSeedAttribute:     {S: aws.String(ip + ":" + port)},
+			dynamoDBAddressAttribute:  {S: aws.String(ip)},
+			dynamoDBPortAttribute:     {S: aws.String(port)},
+			dynamoDBLastSeenAttribute: {N: aws.String(nowString)},
+			dynamoDBExpiresAttribute:  {N: aws.String(strconv.FormatInt(now.Add(d.seedTTL).Unix(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#seed) OR #lastSeen <= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#seed":     aws.String(dynamoDBSeedAttribute),
+			"#lastSeen": aws.String(dynamoDBLastSeenAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(nowString)},
+		},
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			log.Println("skipping seed push as a newer push is already stored")
+			return nil
+		}
+
+		return fmt.Errorf("couldn't put seed in dynamodb: %w", err)
+	}
+
+	log.Println("successfully pushed seed to dynamodb")
+
+	return nil
+}
+
+// RemoveSeed deletes the local node's seed item
+func (d *DynamoDBProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoDBClusterAttribute: {S: aws.String(d.Cluster)},
+			dynamoDBSeedAttribute:    {S: aws.String(ip + ":" + port)},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't delete seed from dynamodb: %w", err)
+	}
+
+	log.Println("successfully removed seed from dynamodb")
+
+	return nil
+}
+
+// TTL returns how long after its last push a seed item expires
+func (d *DynamoDBProvider) TTL() time.Duration {
+	return d.seedTTL
+}
@@ -0,0 +1,233 @@
+package seed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDynamoDBValue struct {
+	S *string `json:",omitempty"`
+	N *string `json:",omitempty"`
+}
+
+type fakeDynamoDBItem map[string]fakeDynamoDBValue
+
+// fakeDynamoDB implements PutItem, DeleteItem and Query from the DynamoDB
+// JSON API for a single table, evaluating only the expressions used by the
+// DynamoDB provider
+type fakeDynamoDB struct {
+	t     *testing.T
+	table string
+
+	lock  sync.Mutex
+	items map[string]fakeDynamoDBItem
+}
+
+func newFakeDynamoDB(t *testing.T, table string) (*fakeDynamoDB, *httptest.Server) {
+	fake := &fakeDynamoDB{
+		t:     t,
+		table: table,
+		items: make(map[string]fakeDynamoDBItem),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+// put stores an item as another client would
+func (f *fakeDynamoDB) put(item fakeDynamoDBItem) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.items[fakeDynamoDBKey(item)] = item
+}
+
+func fakeDynamoDBKey(item fakeDynamoDBItem) string {
+	return *item[dynamoDBClusterAttribute].S + "|" + *item[dynamoDBSeedAttribute].S
+}
+
+func fakeDynamoDBNumber(value fakeDynamoDBValue) int64 {
+	if value.N == nil {
+		return 0
+	}
+
+	n, _ := strconv.ParseInt(*value.N, 10, 64)
+
+	return n
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDTEST/") {
+		awsJSONError(w, "UnrecognizedClientException")
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var request struct {
+		TableName                 string
+		Item                      fakeDynamoDBItem
+		Key                       fakeDynamoDBItem
+		ConditionExpression       string
+		KeyConditionExpression    string
+		FilterExpression          string
+		ExpressionAttributeValues map[string]fakeDynamoDBValue
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+
+	if err != nil || request.TableName != f.table {
+		awsJSONError(w, "ResourceNotFoundException")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.PutItem":
+		if request.ConditionExpression != "attribute_not_exists(#seed) OR #lastSeen <= :now" {
+			f.t.Errorf("unexpected condition expression %q", request.ConditionExpression)
+		}
+
+		key := fakeDynamoDBKey(request.Item)
+
+		if existing, ok := f.items[key]; ok && fakeDynamoDBNumber(existing[dynamoDBLastSeenAttribute]) > fakeDynamoDBNumber(request.ExpressionAttributeValues[":now"]) {
+			awsJSONError(w, "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException")
+			return
+		}
+
+		f.items[key] = request.Item
+		w.Write([]byte("{}"))
+
+	case "DynamoDB_20120810.DeleteItem":
+		delete(f.items, fakeDynamoDBKey(request.Key))
+		w.Write([]byte("{}"))
+
+	case "DynamoDB_20120810.Query":
+		if request.KeyConditionExpression != "#cluster = :cluster" || request.FilterExpression != "#expires > :now" {
+			f.t.Errorf("unexpected query expressions %q and %q", request.KeyConditionExpression, request.FilterExpression)
+		}
+
+		cluster := *request.ExpressionAttributeValues[":cluster"].S
+		now := fakeDynamoDBNumber(request.ExpressionAttributeValues[":now"])
+		items := []fakeDynamoDBItem{}
+
+		for _, item := range f.items {
+			if *item[dynamoDBClusterAttribute].S == cluster && fakeDynamoDBNumber(item[dynamoDBExpiresAttribute]) > now {
+				items = append(items, item)
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Items": items,
+			"Count": len(items),
+		})
+
+	default:
+		f.t.Errorf("unexpected dynamodb request %s", r.Header.Get("X-Amz-Target"))
+		awsJSONError(w, "UnknownOperationException")
+	}
+}
+
+func newTestDynamoDBProvider(t *testing.T, server *httptest.Server) *DynamoDBProvider {
+	t.Helper()
+
+	provider, err := NewDynamoDBProvider(map[string]interface{}{
+		"table":             "seeds",
+		"region":            "us-east-1",
+		"endpoint":          server.URL,
+		"access-key-id":     "AKIDTEST",
+		"secret-access-key": "secret",
+		"seed-ttl":          "10m",
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create dynamodb provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestDynamoDBProviderContract(t *testing.T) {
+	_, server := newFakeDynamoDB(t, "seeds")
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestDynamoDBProvider(t, server)
+	})
+}
+
+func TestDynamoDBProviderSkipsExpiredItems(t *testing.T) {
+	fake, server := newFakeDynamoDB(t, "seeds")
+	provider := newTestDynamoDBProvider(t, server)
+
+	err := provider.PushSeed(staticResolver("[fd00::2]"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	// an expired item which DynamoDB hasn't deleted yet isn't a seed
+	cluster, seed, address, port := provider.Cluster, "10.0.0.9:9999", "10.0.0.9", "9999"
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	fake.put(fakeDynamoDBItem{
+		dynamoDBClusterAttribute: {S: &cluster},
+		dynamoDBSeedAttribute:    {S: &seed},
+		dynamoDBAddressAttribute: {S: &address},
+		dynamoDBPortAttribute:    {S: &port},
+		dynamoDBExpiresAttribute: {N: &expired},
+	})
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "[fd00::2]:9999")
+
+	if seeds.Seeds[0].LastSeen.IsZero() {
+		t.Error("expected the seed to have a last-seen time")
+	}
+}
+
+func TestDynamoDBProviderSkipsOlderPush(t *testing.T) {
+	fake, server := newFakeDynamoDB(t, "seeds")
+	provider := newTestDynamoDBProvider(t, server)
+
+	// a push from a clock which is ahead has already been stored
+	cluster, seed, address, port := provider.Cluster, "10.0.0.1:9999", "10.0.0.1", "9999"
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	fake.put(fakeDynamoDBItem{
+		dynamoDBClusterAttribute:  {S: &cluster},
+		dynamoDBSeedAttribute:     {S: &seed},
+		dynamoDBAddressAttribute:  {S: &address},
+		dynamoDBPortAttribute:     {S: &port},
+		dynamoDBLastSeenAttribute: {N: &future},
+		dynamoDBExpiresAttribute:  {N: &future},
+	})
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("expected a push older than the stored seed to be skipped, but got: %v", err)
+	}
+
+	fake.lock.Lock()
+	lastSeen := fake.items[cluster+"|"+seed][dynamoDBLastSeenAttribute]
+	fake.lock.Unlock()
+
+	if *lastSeen.N != future {
+		t.Errorf("expected the newer last-seen time %s to be kept but got %s", future, *lastSeen.N)
+	}
+}
@@ -0,0 +1,416 @@
+package seed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const (
+	defaultEtcdEndpoint = "http://127.0.0.1:2379"
+	defaultEtcdPrefix   = "/scrimplb/seeds/"
+)
+
+// EtcdProvider stores each load balancer's seed under its own key beneath a
+// prefix in etcd, using the v3 JSON gateway. Every key is bound to a lease
+// which is kept alive by each push, so seeds of load balancers which die are
+// removed automatically by etcd once their lease expires.
+type EtcdProvider struct {
+	Endpoint    string
+	Prefix      string
+	Username    string
+	Password    string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *http.Client
+
+	leaseLock sync.Mutex
+	leaseID   int64
+
+	tokenLock sync.Mutex
+	token     string
+}
+
+// NewEtcdProvider creates a new etcd seed provider from the given config.
+// "endpoint" is the etcd client URL and defaults to a local etcd.
+// "prefix" defaults to "/scrimplb/seeds/".
+// "username" and "password" are optional, for clusters with auth enabled.
+// "seed-ttl" is the TTL of the lease attached to each seed, and must be
+// longer than the push period.
+func NewEtcdProvider(config map[string]interface{}) (*EtcdProvider, error) {
+	var provider EtcdProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse etcd provider config: %w", err)
+	}
+
+	if provider.Endpoint == "" {
+		provider.Endpoint = defaultEtcdEndpoint
+	}
+
+	provider.Endpoint = strings.TrimSuffix(provider.Endpoint, "/")
+
+	if provider.Prefix == "" {
+		provider.Prefix = defaultEtcdPrefix
+	}
+
+	if provider.ClusterName != "" {
+		provider.Prefix = namespaced(provider.Prefix, provider.ClusterName) + "/"
+	}
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	if provider.seedTTL < time.Second {
+		return nil, fmt.Errorf("'seed-ttl' must be at least 1s for etcd leases")
+	}
+
+	provider.client = &http.Client{Timeout: 30 * time.Second}
+
+	return &provider, nil
+}
+
+// FetchSeed reads all seeds under the prefix
+func (e *EtcdProvider) FetchSeed() (Seeds, error) {
+	var response struct {
+		KVs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+
+	err := e.call("/v3/kv/range", map[string]interface{}{
+		"key":       []byte(e.Prefix),
+		"range_end": prefixRangeEnd([]byte(e.Prefix)),
+	}, &response)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to fetch seeds from etcd: %w", err)
+	}
+
+	seeds := Seeds{}
+
+	for _, kv := range response.KVs {
+		// keys nested under the prefix belong to something else, such as
+		// another cluster with an overlapping prefix
+		if strings.Contains(strings.TrimPrefix(string(kv.Key), e.Prefix), "/") {
+			continue
+		}
+
+		var seed Seed
+
+		err = json.Unmarshal(kv.Value, &seed)
+
+		if err != nil {
+			log.Printf("skipping unparseable seed from etcd: %v\n", err)
+			continue
+		}
+
+		seeds.Seeds = append(seeds.Seeds, seed)
+	}
+
+	return seeds, nil
+}
+
+// PushSeed keeps the local node's lease alive, or if there's no live lease,
+// grants a new one and writes the local node's seed bound to it
+func (e *EtcdProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	e.leaseLock.Lock()
+	defer e.leaseLock.Unlock()
+
+	if e.leaseID != 0 {
+		alive, err := e.keepAlive()
+
+		if err != nil {
+			return fmt.Errorf("couldn't keep etcd lease alive: %w", err)
+		}
+
+		if alive {
+			return nil
+		}
+
+		log.Println("etcd lease expired; re-publishing seed with a new lease")
+		e.leaseID = 0
+	}
+
+	var grant struct {
+		ID int64 `json:"ID,string"`
+	}
+
+	err = e.call("/v3/lease/grant", map[string]interface{}{
+		"TTL": int64(e.seedTTL.Seconds()),
+	}, &grant)
+
+	if err != nil {
+		return fmt.Errorf("couldn't grant etcd lease: %w", err)
+	}
+
+	out, err := json.Marshal(Seed{
+		Address:  ip,
+		Port:     port,
+		LastSeen: time.Now(),
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal seed for etcd: %w", err)
+	}
+
+	err = e.call("/v3/kv/put", map[string]interface{}{
+		"key":   []byte(e.seedKey(ip, port)),
+		"value": out,
+		"lease": fmt.Sprintf("%d", grant.ID),
+	}, nil)
+
+	if err != nil {
+		return fmt.Errorf("couldn't put seed in etcd: %w", err)
+	}
+
+	e.leaseID = grant.ID
+
+	log.Println("successfully pushed seed to etcd")
+
+	return nil
+}
+
+// RemoveSeed revokes the local node's lease, which deletes its seed. If
+// there's no lease, the seed is deleted directly.
+func (e *EtcdProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	e.leaseLock.Lock()
+	defer e.leaseLock.Unlock()
+
+	if e.leaseID != 0 {
+		err = e.call("/v3/lease/revoke", map[string]interface{}{
+			"ID": fmt.Sprintf("%d", e.leaseID),
+		}, nil)
+
+		if err != nil {
+			return fmt.Errorf("couldn't revoke etcd lease: %w", err)
+		}
+
+		e.leaseID = 0
+	} else {
+		err = e.call("/v3/kv/deleterange", map[string]interface{}{
+			"key": []byte(e.seedKey(ip, port)),
+		}, nil)
+
+		if err != nil {
+			return fmt.Errorf("couldn't delete seed from etcd: %w", err)
+		}
+	}
+
+	log.Println("successfully removed seed from etcd")
+
+	return nil
+}
+
+// keepAlive refreshes the current lease, returning false if it has expired
+func (e *EtcdProvider) keepAlive() (bool, error) {
+	var response struct {
+		Result struct {
+			TTL int64 `json:"TTL,string"`
+		} `json:"result"`
+	}
+
+	err := e.call("/v3/lease/keepalive", map[string]interface{}{
+		"ID": fmt.Sprintf("%d", e.leaseID),
+	}, &response)
+
+	if err != nil {
+		return false, err
+	}
+
+	return response.Result.TTL > 0, nil
+}
+
+func (e *EtcdProvider) seedKey(ip string, port string) string {
+	return e.Prefix + strings.Trim(ip, "[]") + "_" + port
+}
+
+// call POSTs a JSON request to the etcd gateway and decodes the response into
+// result if it's non-nil. []byte values are base64 encoded by encoding/json,
+// which is what the gateway expects for keys and values. If the cached auth
+// token has expired, call authenticates again and retries once.
+func (e *EtcdProvider) call(path string, request interface{}, result interface{}) error {
+	body, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	resp, raw, err := e.post(path, body, false)
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && e.Username != "" {
+		log.Println("etcd auth token rejected; authenticating again")
+		resp, raw, err = e.post(path, body, true)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from etcd: %s: %s", resp.Status, string(raw))
+	}
+
+	if result != nil {
+		err = json.Unmarshal(raw, result)
+
+		if err != nil {
+			return fmt.Errorf("couldn't parse response from etcd: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// post sends body to the etcd gateway, returning the response and its body.
+// If a username is configured, the request carries the cached auth token,
+// which is fetched first if there isn't one or if refreshToken is set.
+func (e *EtcdProvider) post(path string, body []byte, refreshToken bool) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint+path, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if e.Username != "" {
+		token, err := e.authToken(refreshToken)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := e.client.Do(req)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, raw, nil
+}
+
+// authToken returns the cached auth token, authenticating if there isn't one
+// or if refresh is set
+func (e *EtcdProvider) authToken(refresh bool) (string, error) {
+	e.tokenLock.Lock()
+	defer e.tokenLock.Unlock()
+
+	if e.token == "" || refresh {
+		token, err := e.authenticate()
+
+		if err != nil {
+			return "", err
+		}
+
+		e.token = token
+	}
+
+	return e.token, nil
+}
+
+func (e *EtcdProvider) authenticate() (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"name":     e.Username,
+		"password": e.Password,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := e.client.Post(e.Endpoint+"/v3/auth/authenticate", "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return "", fmt.Errorf("couldn't authenticate with etcd: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status authenticating with etcd: %s", resp.Status)
+	}
+
+	var response struct {
+		Token string `json:"token"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&response)
+
+	if err != nil {
+		return "", fmt.Errorf("couldn't parse etcd authentication response: %w", err)
+	}
+
+	return response.Token, nil
+}
+
+// prefixRangeEnd returns the key which ends a range read covering every key
+// with the given prefix, in the same way as etcd's clientv3.GetPrefixRangeEnd
+func prefixRangeEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// the prefix was all 0xff, so read to the end of the keyspace
+	return []byte{0}
+}
+
+// TTL returns the TTL of the lease each seed is attached to
+func (e *EtcdProvider) TTL() time.Duration {
+	return e.seedTTL
+}
@@ -0,0 +1,386 @@
+package seed
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeEtcd implements the parts of the etcd v3 JSON gateway used by the etcd
+// provider: range reads, puts bound to leases, lease management and
+// authentication with tokens which can be invalidated
+type fakeEtcd struct {
+	t *testing.T
+
+	lock          sync.Mutex
+	kvs           map[string][]byte
+	keyLeases     map[string]int64
+	leases        map[int64]bool
+	nextLease     int64
+	token         string
+	authenticates int
+	unauthorised  int
+	requests      map[string]int
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *httptest.Server) {
+	fake := &fakeEtcd{
+		t:         t,
+		kvs:       make(map[string][]byte),
+		keyLeases: make(map[string]int64),
+		leases:    make(map[int64]bool),
+		requests:  make(map[string]int),
+		nextLease: 7587848820000000000,
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+// expireLeases expires every lease, deleting the keys bound to them
+func (f *fakeEtcd) expireLeases() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for id := range f.leases {
+		f.revoke(id)
+	}
+}
+
+// invalidateToken makes the current auth token invalid, as if it had expired
+func (f *fakeEtcd) invalidateToken() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.token = ""
+}
+
+func (f *fakeEtcd) revoke(id int64) {
+	delete(f.leases, id)
+
+	for key, lease := range f.keyLeases {
+		if lease == id {
+			delete(f.kvs, key)
+			delete(f.keyLeases, key)
+		}
+	}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var request struct {
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end"`
+		Value    []byte `json:"value"`
+		Lease    int64  `json:"lease,string"`
+		ID       int64  `json:"ID,string"`
+		TTL      int64  `json:"TTL"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+
+	if err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		if request.Name != "scrimplb" || request.Password != "hunter2" {
+			http.Error(w, `{"error":"etcdserver: authentication failed, invalid user ID or password"}`, http.StatusBadRequest)
+			return
+		}
+
+		f.authenticates++
+		f.token = "token-" + strconv.Itoa(f.authenticates)
+
+		json.NewEncoder(w).Encode(map[string]string{"token": f.token})
+		return
+	}
+
+	if f.token == "" || r.Header.Get("Authorization") != f.token {
+		f.unauthorised++
+		http.Error(w, `{"error":"etcdserver: invalid auth token","code":16}`, http.StatusUnauthorized)
+		return
+	}
+
+	f.requests[r.URL.Path]++
+
+	response := map[string]interface{}{}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var kvs []map[string][]byte
+
+		for key, value := range f.kvs {
+			if key >= string(request.Key) && key < string(request.RangeEnd) {
+				kvs = append(kvs, map[string][]byte{"key": []byte(key), "value": value})
+			}
+		}
+
+		response["kvs"] = kvs
+
+	case "/v3/kv/put":
+		if request.Lease != 0 && !f.leases[request.Lease] {
+			http.Error(w, `{"error":"etcdserver: requested lease not found"}`, http.StatusNotFound)
+			return
+		}
+
+		f.kvs[string(request.Key)] = request.Value
+		f.keyLeases[string(request.Key)] = request.Lease
+
+	case "/v3/kv/deleterange":
+		delete(f.kvs, string(request.Key))
+		delete(f.keyLeases, string(request.Key))
+
+	case "/v3/lease/grant":
+		f.nextLease++
+		f.leases[f.nextLease] = true
+
+		response["ID"] = strconv.FormatInt(f.nextLease, 10)
+		response["TTL"] = strconv.FormatInt(request.TTL, 10)
+
+	case "/v3/lease/keepalive":
+		// etcd reports a TTL of 0 when keeping an expired lease alive
+		result := map[string]string{"ID": strconv.FormatInt(request.ID, 10), "TTL": "0"}
+
+		if f.leases[request.ID] {
+			result["TTL"] = "600"
+		}
+
+		response["result"] = result
+
+	case "/v3/lease/revoke":
+		f.revoke(request.ID)
+
+	default:
+		f.t.Errorf("unexpected request %s", r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func newTestEtcdProvider(t *testing.T, server *httptest.Server) *EtcdProvider {
+	t.Helper()
+
+	provider, err := NewEtcdProvider(map[string]interface{}{
+		"endpoint": server.URL,
+		"username": "scrimplb",
+		"password": "hunter2",
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create etcd provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestEtcdProviderContract(t *testing.T) {
+	_, server := newFakeEtcd(t)
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestEtcdProvider(t, server)
+	})
+}
+
+func TestEtcdProviderIgnoresKeysOutsidePrefix(t *testing.T) {
+	fake, server := newFakeEtcd(t)
+	provider := newTestEtcdProvider(t, server)
+
+	err := provider.PushSeed(staticResolver("[fd00::2]"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	fake.lock.Lock()
+	fake.kvs["/scrimplb/seedsx"] = []byte(`{"address":"10.0.0.9","port":"9999"}`)
+	fake.kvs["/scrimplb/seeds/nested/10.0.0.8_9999"] = []byte(`{"address":"10.0.0.8","port":"9999"}`)
+	fake.lock.Unlock()
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "[fd00::2]:9999")
+}
+
+func TestEtcdProviderKeepsLeaseAlive(t *testing.T) {
+	fake, server := newFakeEtcd(t)
+	provider := newTestEtcdProvider(t, server)
+
+	for i := 0; i < 3; i++ {
+		err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+		if err != nil {
+			t.Fatalf("couldn't push seed: %v", err)
+		}
+	}
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if fake.requests["/v3/lease/grant"] != 1 || fake.requests["/v3/kv/put"] != 1 || fake.requests["/v3/lease/keepalive"] != 2 {
+		t.Errorf("expected one grant and put followed by keepalives, but got %v", fake.requests)
+	}
+}
+
+func TestEtcdProviderRegrantsExpiredLease(t *testing.T) {
+	fake, server := newFakeEtcd(t)
+	provider := newTestEtcdProvider(t, server)
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	expiredLease := provider.leaseID
+
+	// once the lease expires the seed is gone, and keepalive reports a TTL of 0
+	fake.expireLeases()
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds after expiry: %v", err)
+	}
+
+	assertAddresses(t, seeds)
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed after expiry: %v", err)
+	}
+
+	if provider.leaseID == expiredLease {
+		t.Error("expected a new lease after the old one expired")
+	}
+
+	fake.lock.Lock()
+	keepalives, grants, puts := fake.requests["/v3/lease/keepalive"], fake.requests["/v3/lease/grant"], fake.requests["/v3/kv/put"]
+	lease := fake.keyLeases["/scrimplb/seeds/10.0.0.1_9999"]
+	fake.lock.Unlock()
+
+	if keepalives != 1 || grants != 2 || puts != 2 {
+		t.Errorf("expected a keepalive followed by a new grant and put, but got %d keepalives, %d grants and %d puts", keepalives, grants, puts)
+	}
+
+	if lease != provider.leaseID {
+		t.Errorf("expected the seed to be re-put with lease %d but it has lease %d", provider.leaseID, lease)
+	}
+
+	seeds, err = provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds after re-pushing: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+}
+
+func TestEtcdProviderCachesAuthToken(t *testing.T) {
+	fake, server := newFakeEtcd(t)
+	provider := newTestEtcdProvider(t, server)
+
+	for i := 0; i < 3; i++ {
+		err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+		if err != nil {
+			t.Fatalf("couldn't push seed: %v", err)
+		}
+
+		_, err = provider.FetchSeed()
+
+		if err != nil {
+			t.Fatalf("couldn't fetch seeds: %v", err)
+		}
+	}
+
+	if fake.authenticates != 1 {
+		t.Errorf("expected to authenticate once but authenticated %d times", fake.authenticates)
+	}
+}
+
+func TestEtcdProviderReauthenticates(t *testing.T) {
+	fake, server := newFakeEtcd(t)
+	provider := newTestEtcdProvider(t, server)
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	// the next call gets a 401 and must authenticate again before retrying
+	fake.invalidateToken()
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed after the token was invalidated: %v", err)
+	}
+
+	fake.lock.Lock()
+	authenticates, unauthorised := fake.authenticates, fake.unauthorised
+	fake.lock.Unlock()
+
+	if authenticates != 2 || unauthorised != 1 {
+		t.Errorf("expected one 401 followed by re-authentication, but got %d 401s and %d authentications", unauthorised, authenticates)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds with the new token: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+}
+
+func TestEtcdProviderWrongPassword(t *testing.T) {
+	_, server := newFakeEtcd(t)
+
+	provider, err := NewEtcdProvider(map[string]interface{}{
+		"endpoint": server.URL,
+		"username": "scrimplb",
+		"password": "wrong",
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create etcd provider: %v", err)
+	}
+
+	_, err = provider.FetchSeed()
+
+	if err == nil {
+		t.Fatal("expected fetching with the wrong password to fail")
+	}
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	for prefix, expected := range map[string][]byte{
+		"/scrimplb/seeds/": []byte("/scrimplb/seeds0"),
+		"a\xff":            []byte("b"),
+		"\xff\xff":         {0},
+	} {
+		if actual := prefixRangeEnd([]byte(prefix)); !bytes.Equal(actual, expected) {
+			t.Errorf("expected range end %q for prefix %q but got %q", expected, prefix, actual)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package seed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+// FileProvider reads and writes seeds in a JSON file at a given path. This is
+// useful where load balancers and backends share a volume such as NFS or EFS,
+// or where seeds are written by configuration management.
+// Updates take an exclusive flock on a lock file next to the seed file and
+// then atomically replace the seed file, so readers never see a partial write.
+type FileProvider struct {
+	Path        string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+}
+
+// NewFileProvider creates a new file seed provider from the given config.
+// "path" is required.
+// "seed-ttl" is optional, and controls how long a seed which hasn't been
+// re-pushed is kept for before being pruned.
+func NewFileProvider(config map[string]interface{}) (*FileProvider, error) {
+	var provider FileProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse file provider config: %w", err)
+	}
+
+	if provider.Path == "" {
+		return nil, errors.New("missing required 'path' in provider config")
+	}
+
+	provider.Path = namespacedPath(provider.Path, provider.ClusterName)
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	return &provider, nil
+}
+
+// FetchSeed reads seeds from the file, treating a missing file as empty. No
+// lock is needed since writes atomically replace the file, which also means
+// that backends can read seeds from a read-only mount.
+func (f *FileProvider) FetchSeed() (Seeds, error) {
+	return f.read()
+}
+
+// PushSeed adds the local node to the seed file, pruning any stale seeds
+func (f *FileProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.lock()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	seeds, err := f.read()
+
+	if err != nil {
+		return err
+	}
+
+	pushSeed(&seeds, ip, port, f.seedTTL)
+
+	err = f.write(seeds)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("successfully pushed seed to file")
+
+	return nil
+}
+
+// RemoveSeed removes the local node from the seed file
+func (f *FileProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.lock()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	seeds, err := f.read()
+
+	if err != nil {
+		return err
+	}
+
+	if !seeds.Remove(ip, port) {
+		log.Println("skipping seed removal as address is not published")
+		return nil
+	}
+
+	err = f.write(seeds)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("successfully removed seed from file")
+
+	return nil
+}
+
+// lock takes an exclusive flock on the lock file for the seed file,
+// returning a function which releases it. A separate lock file is used since
+// the seed file itself is replaced on every write.
+func (f *FileProvider) lock() (func(), error) {
+	lockFile, err := os.OpenFile(f.Path+".lock", os.O_RDONLY|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open seed lock file: %w", err)
+	}
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+
+	if err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("couldn't lock seed lock file: %w", err)
+	}
+
+	return func() {
+		err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+		if err != nil {
+			log.Printf("couldn't unlock seed lock file: %v\n", err)
+		}
+
+		lockFile.Close()
+	}, nil
+}
+
+func (f *FileProvider) read() (Seeds, error) {
+	raw, err := ioutil.ReadFile(f.Path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Seeds{}, nil
+		}
+
+		return Seeds{}, fmt.Errorf("unable to read seed file: %w", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(raw, &seeds)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to parse seed file: %w", err)
+	}
+
+	return seeds, nil
+}
+
+// write atomically replaces the seed file by writing to a temporary file in
+// the same directory and renaming it over the seed file
+func (f *FileProvider) write(seeds Seeds) error {
+	out, err := json.Marshal(seeds)
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal seeds for file: %w", err)
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".tmp")
+
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary seed file: %w", err)
+	}
+
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(out)
+
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+
+	closeErr := tmpFile.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("couldn't write temporary seed file: %w", err)
+	}
+
+	err = os.Rename(tmpFile.Name(), f.Path)
+
+	if err != nil {
+		return fmt.Errorf("couldn't replace seed file: %w", err)
+	}
+
+	return nil
+}
+
+// TTL returns how long a seed stays in the file without being re-pushed
+func (f *FileProvider) TTL() time.Duration {
+	return f.seedTTL
+}
@@ -0,0 +1,117 @@
+package seed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestFileProvider(t *testing.T, path string) *FileProvider {
+	t.Helper()
+
+	provider, err := NewFileProvider(map[string]interface{}{"path": path})
+
+	if err != nil {
+		t.Fatalf("couldn't create file provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestFileProviderContract(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.json")
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestFileProvider(t, path)
+	})
+}
+
+func TestFileProviderConcurrentPushes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "seeds.json")
+
+	var wg sync.WaitGroup
+	var expected []string
+
+	for i := 1; i <= 2; i++ {
+		provider := newTestFileProvider(t, path)
+		subnet := i
+
+		for j := 1; j <= 25; j++ {
+			expected = append(expected, fmt.Sprintf("10.0.%d.%d:9999", subnet, j))
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 1; j <= 25; j++ {
+				err := provider.PushSeed(staticResolver(fmt.Sprintf("10.0.%d.%d", subnet, j)), "9999")
+
+				if err != nil {
+					t.Errorf("couldn't push seed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	seeds, err := newTestFileProvider(t, path).FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, expected...)
+
+	entries, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		t.Fatalf("couldn't list seed directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Name() != "seeds.json" && entry.Name() != "seeds.json.lock" {
+			t.Errorf("expected temporary files to be renamed or removed, but found %s", entry.Name())
+		}
+	}
+}
+
+func TestFileProviderKeepsUnparseableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.json")
+
+	err := ioutil.WriteFile(path, []byte("not json"), 0644)
+
+	if err != nil {
+		t.Fatalf("couldn't write seed file: %v", err)
+	}
+
+	provider := newTestFileProvider(t, path)
+
+	_, err = provider.FetchSeed()
+
+	if err == nil {
+		t.Error("expected fetching an unparseable seed file to fail")
+	}
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Error("expected pushing to an unparseable seed file to fail")
+	}
+
+	raw, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("couldn't read seed file: %v", err)
+	}
+
+	if string(raw) != "not json" {
+		t.Errorf("expected the unparseable seed file to be left alone but got %s", raw)
+	}
+}
@@ -0,0 +1,282 @@
+package seed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultGCSEndpoint = "https://storage.googleapis.com"
+	gcsReadWriteScope  = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// GCSProvider stores seeds in a single object in a Google Cloud Storage
+// bucket. Updates are made with a generation-match precondition so that
+// concurrent pushes from several load balancers can't overwrite each other.
+// Required roles for a load balancer: roles/storage.objectAdmin on the bucket
+// Required roles for an application server: roles/storage.objectViewer on the bucket
+type GCSProvider struct {
+	Bucket          string
+	Object          string
+	CredentialsFile string `mapstructure:"credentials-file"`
+	Endpoint        string
+	Anonymous       bool
+	SeedTTL         string `mapstructure:"seed-ttl"`
+	ClusterName     string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *http.Client
+}
+
+// NewGCSProvider creates a new GCS seed provider from the given config.
+// "object" is optional and defaults to the default key.
+// "credentials-file" is optional and points to a service account key file;
+// if not given, application default credentials are used.
+// "endpoint" and "anonymous" are optional, and are intended for use with a
+// local fake GCS server.
+func NewGCSProvider(config map[string]interface{}) (*GCSProvider, error) {
+	var provider GCSProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse gcs provider config: %w", err)
+	}
+
+	if provider.Bucket == "" {
+		return nil, errors.New("missing required 'bucket' in provider config")
+	}
+
+	if provider.Object == "" {
+		provider.Object = constants.DefaultKey
+	}
+
+	provider.Object = namespaced(provider.Object, provider.ClusterName)
+
+	if provider.Endpoint == "" {
+		provider.Endpoint = defaultGCSEndpoint
+	}
+
+	provider.Endpoint = strings.TrimSuffix(provider.Endpoint, "/")
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	if provider.Anonymous {
+		provider.client = &http.Client{Timeout: 30 * time.Second}
+		return &provider, nil
+	}
+
+	ctx := context.Background()
+
+	var credentials *google.Credentials
+
+	if provider.CredentialsFile != "" {
+		rawCredentials, err := ioutil.ReadFile(provider.CredentialsFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read gcs credentials file: %w", err)
+		}
+
+		credentials, err = google.CredentialsFromJSON(ctx, rawCredentials, gcsReadWriteScope)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse gcs credentials file: %w", err)
+		}
+	} else {
+		credentials, err = google.FindDefaultCredentials(ctx, gcsReadWriteScope)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find default gcs credentials: %w", err)
+		}
+	}
+
+	provider.client = oauth2.NewClient(ctx, credentials.TokenSource)
+	provider.client.Timeout = 30 * time.Second
+
+	return &provider, nil
+}
+
+// FetchSeed downloads the seed object from GCS
+func (g *GCSProvider) FetchSeed() (Seeds, error) {
+	seeds, _, err := g.download()
+
+	if err != nil {
+		return Seeds{}, err
+	}
+
+	return seeds, nil
+}
+
+// PushSeed adds the local node to the seed object, pruning any stale seeds,
+// retrying if another node updates the object at the same time
+func (g *GCSProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	err = retryOnConflict("gcs", func() error {
+		seeds, generation, err := g.download()
+
+		if err != nil {
+			return err
+		}
+
+		pushSeed(&seeds, ip, port, g.seedTTL)
+
+		return g.upload(seeds, generation)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("successfully pushed seed to gcs")
+
+	return nil
+}
+
+// RemoveSeed removes the local node from the seed object
+func (g *GCSProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	return retryOnConflict("gcs", func() error {
+		seeds, generation, err := g.download()
+
+		if err != nil {
+			return err
+		}
+
+		if !seeds.Remove(ip, port) {
+			log.Println("skipping seed removal as address is not published")
+			return nil
+		}
+
+		err = g.upload(seeds, generation)
+
+		if err != nil {
+			return err
+		}
+
+		log.Println("successfully removed seed from gcs")
+
+		return nil
+	})
+}
+
+// download fetches the seed object and returns it along with its generation.
+// A missing object is treated as empty with generation 0, which GCS
+// interprets as "the object must not exist" in preconditions. An object which
+// can't be parsed is an error, rather than being overwritten and losing every
+// other load balancer's seed.
+func (g *GCSProvider) download() (Seeds, int64, error) {
+	objectURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", g.Endpoint, url.PathEscape(g.Bucket), url.PathEscape(g.Object))
+
+	resp, err := g.client.Get(objectURL)
+
+	if err != nil {
+		return Seeds{}, 0, fmt.Errorf("unable to download seed from gcs: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Seeds{}, 0, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return Seeds{}, 0, fmt.Errorf("unable to read seed from gcs: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Seeds{}, 0, fmt.Errorf("unexpected status downloading seed from gcs: %s: %s", resp.Status, string(body))
+	}
+
+	generation, err := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+
+	if err != nil {
+		return Seeds{}, 0, fmt.Errorf("couldn't parse gcs object generation: %w", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(body, &seeds)
+
+	if err != nil {
+		return Seeds{}, 0, fmt.Errorf("unable to parse seed object from gcs: %w", err)
+	}
+
+	return seeds, generation, nil
+}
+
+// upload writes the seed object, failing with errConflict if the object's
+// generation no longer matches the given generation
+func (g *GCSProvider) upload(seeds Seeds, generation int64) error {
+	out, err := json.Marshal(seeds)
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal output for gcs: %w", err)
+	}
+
+	query := url.Values{}
+	query.Set("uploadType", "media")
+	query.Set("name", g.Object)
+	query.Set("ifGenerationMatch", strconv.FormatInt(generation, 10))
+
+	uploadURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", g.Endpoint, url.PathEscape(g.Bucket), query.Encode())
+
+	resp, err := g.client.Post(uploadURL, "application/json", bytes.NewReader(out))
+
+	if err != nil {
+		return fmt.Errorf("couldn't upload gcs content: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errConflict
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status uploading seed to gcs: %s: %s", resp.Status, string(body))
+	}
+
+	return nil
+}
+
+// TTL returns how long a seed can go without being re-pushed before it's pruned from the seed object
+func (g *GCSProvider) TTL() time.Duration {
+	return g.seedTTL
+}
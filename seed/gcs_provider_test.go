@@ -0,0 +1,266 @@
+package seed
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGCS implements the JSON API media download and upload endpoints used by
+// the GCS provider, along with an OAuth2 token endpoint for service accounts
+type fakeGCS struct {
+	t      *testing.T
+	bucket string
+	token  string
+
+	lock         sync.Mutex
+	objects      map[string][]byte
+	generations  map[string]int64
+	beforeUpload func()
+}
+
+func newFakeGCS(t *testing.T, bucket string) (*fakeGCS, *httptest.Server) {
+	fake := &fakeGCS{
+		t:           t,
+		bucket:      bucket,
+		objects:     make(map[string][]byte),
+		generations: make(map[string]int64),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+// write stores an object as another client would, bumping its generation
+func (f *fakeGCS) write(name string, body []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.objects[name] = body
+	f.generations[name]++
+}
+
+func (f *fakeGCS) read(name string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.objects[name]
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"` + f.token + `","token_type":"Bearer","expires_in":3600}`))
+		return
+	}
+
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+		return
+	}
+
+	downloadPrefix := "/storage/v1/b/" + f.bucket + "/o/"
+	uploadPath := "/upload/storage/v1/b/" + f.bucket + "/o"
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.EscapedPath(), downloadPrefix):
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), downloadPrefix))
+
+		if err != nil || r.URL.Query().Get("alt") != "media" {
+			f.t.Errorf("unexpected download request %s", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		f.lock.Lock()
+		body, ok := f.objects[name]
+		generation := f.generations[name]
+		f.lock.Unlock()
+
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(generation, 10))
+		w.Write(body)
+
+	case r.Method == http.MethodPost && r.URL.Path == uploadPath:
+		query := r.URL.Query()
+
+		if query.Get("uploadType") != "media" {
+			f.t.Errorf("unexpected upload request %s", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if f.beforeUpload != nil {
+			beforeUpload := f.beforeUpload
+			f.beforeUpload = nil
+			beforeUpload()
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			f.t.Errorf("couldn't read upload body: %v", err)
+		}
+
+		name := query.Get("name")
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if query.Get("ifGenerationMatch") != strconv.FormatInt(f.generations[name], 10) {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+
+		f.objects[name] = body
+		f.generations[name]++
+		w.Write([]byte("{}"))
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestGCSProvider(t *testing.T, server *httptest.Server) *GCSProvider {
+	t.Helper()
+
+	provider, err := NewGCSProvider(map[string]interface{}{
+		"bucket":    "seeds",
+		"endpoint":  server.URL,
+		"anonymous": true,
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create gcs provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestGCSProviderContract(t *testing.T) {
+	_, server := newFakeGCS(t, "seeds")
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestGCSProvider(t, server)
+	})
+}
+
+func TestGCSProviderKeepsUnparseableObject(t *testing.T) {
+	fake, server := newFakeGCS(t, "seeds")
+	provider := newTestGCSProvider(t, server)
+
+	fake.write("scrimplb", []byte("not json"))
+
+	_, err := provider.FetchSeed()
+
+	if err == nil {
+		t.Error("expected fetching an unparseable seed object to fail")
+	}
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Error("expected pushing to an unparseable seed object to fail")
+	}
+
+	if body := fake.read("scrimplb"); string(body) != "not json" {
+		t.Errorf("expected the unparseable seed object to be left alone but got %s", body)
+	}
+}
+
+func TestGCSProviderRetriesConflictingPush(t *testing.T) {
+	fake, server := newFakeGCS(t, "seeds")
+	provider := newTestGCSProvider(t, server)
+
+	// another load balancer pushes between this one downloading and uploading
+	// the object, so the first upload must fail its precondition and be retried
+	fake.beforeUpload = func() {
+		concurrent, _ := json.Marshal(Seeds{Seeds: []Seed{{Address: "10.0.0.2", Port: "9999"}}})
+		fake.write("scrimplb", concurrent)
+	}
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(fake.read("scrimplb"), &seeds)
+
+	if err != nil {
+		t.Fatalf("couldn't parse seed object: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.2:9999")
+}
+
+func TestGCSProviderServiceAccountCredentials(t *testing.T) {
+	fake, server := newFakeGCS(t, "seeds")
+	fake.token = "test-token"
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	credentials, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "scrimplb@example.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":      server.URL + "/token",
+	})
+
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+
+	err = ioutil.WriteFile(credentialsFile, credentials, 0600)
+
+	if err != nil {
+		t.Fatalf("couldn't write credentials file: %v", err)
+	}
+
+	provider, err := NewGCSProvider(map[string]interface{}{
+		"bucket":           "seeds",
+		"endpoint":         server.URL,
+		"credentials-file": credentialsFile,
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create gcs provider: %v", err)
+	}
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed with service account credentials: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds with service account credentials: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+}
@@ -0,0 +1,245 @@
+package seed
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+// HTTPProvider fetches a JSON seeds document from a URL, and pushes the local
+// node's seed as a JSON object to another URL. This allows seeds to be served
+// by any small web service, or by an object store using presigned URLs.
+// Fetched seeds are cached and revalidated using their ETag.
+type HTTPProvider struct {
+	URL          string
+	PushURL      string `mapstructure:"push-url"`
+	PushMethod   string `mapstructure:"push-method"`
+	RemoveMethod string `mapstructure:"remove-method"`
+	BearerToken  string `mapstructure:"bearer-token"`
+	CAFile       string `mapstructure:"ca-file"`
+
+	client *http.Client
+
+	cacheLock   sync.Mutex
+	cachedETag  string
+	cachedSeeds Seeds
+}
+
+// NewHTTPProvider creates a new HTTP seed provider from the given config.
+// "url" is required and is where seeds are fetched from.
+// "push-url" is optional; if not given, seeds are never pushed. The local seed
+// is sent using "push-method" (PUT by default) when pushing, and
+// "remove-method" (DELETE by default) when removing.
+// "bearer-token" is optional and is sent with every request.
+// "ca-file" is optional and gives a PEM bundle of CAs to trust instead of the
+// system roots.
+func NewHTTPProvider(config map[string]interface{}) (*HTTPProvider, error) {
+	var provider HTTPProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse http provider config: %w", err)
+	}
+
+	if provider.URL == "" {
+		return nil, errors.New("missing required 'url' in provider config")
+	}
+
+	if provider.PushMethod == "" {
+		provider.PushMethod = http.MethodPut
+	}
+
+	if provider.RemoveMethod == "" {
+		provider.RemoveMethod = http.MethodDelete
+	}
+
+	provider.PushMethod = strings.ToUpper(provider.PushMethod)
+	provider.RemoveMethod = strings.ToUpper(provider.RemoveMethod)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if provider.CAFile != "" {
+		rawCAs, err := ioutil.ReadFile(provider.CAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read 'ca-file': %w", err)
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(rawCAs) {
+			return nil, fmt.Errorf("no certificates found in 'ca-file' %s", provider.CAFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: pool,
+		}
+	}
+
+	provider.client = &http.Client{
+		Transport: transport,
+		Timeout:   30 * time.Second,
+	}
+
+	return &provider, nil
+}
+
+// FetchSeed GETs the seeds document, using the cached copy if the server
+// reports that it's unchanged
+func (h *HTTPProvider) FetchSeed() (Seeds, error) {
+	h.cacheLock.Lock()
+	defer h.cacheLock.Unlock()
+
+	req, err := h.newRequest(http.MethodGet, h.URL, nil)
+
+	if err != nil {
+		return Seeds{}, err
+	}
+
+	if h.cachedETag != "" {
+		req.Header.Set("If-None-Match", h.cachedETag)
+	}
+
+	resp, err := h.client.Do(req)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to fetch seed: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Println("seed unchanged since last fetch; using cached seed")
+		return h.cachedSeeds, nil
+
+	case http.StatusNotFound:
+		return Seeds{}, nil
+
+	case http.StatusOK:
+
+	default:
+		return Seeds{}, fmt.Errorf("unexpected status fetching seed: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to read seed: %w", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(body, &seeds)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to parse fetched seed: %w", err)
+	}
+
+	h.cachedETag = resp.Header.Get("ETag")
+	h.cachedSeeds = seeds
+
+	return seeds, nil
+}
+
+// PushSeed sends the local node's seed to the push URL, if configured
+func (h *HTTPProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	if h.PushURL == "" {
+		return nil
+	}
+
+	err := h.sendSeed(h.PushMethod, resolver, port)
+
+	if err != nil {
+		return fmt.Errorf("couldn't push seed: %w", err)
+	}
+
+	log.Println("successfully pushed seed over http")
+
+	return nil
+}
+
+// RemoveSeed sends the local node's seed to the push URL using the removal
+// method, if a push URL is configured
+func (h *HTTPProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	if h.PushURL == "" {
+		return nil
+	}
+
+	err := h.sendSeed(h.RemoveMethod, resolver, port)
+
+	if err != nil {
+		return fmt.Errorf("couldn't remove seed: %w", err)
+	}
+
+	log.Println("successfully removed seed over http")
+
+	return nil
+}
+
+func (h *HTTPProvider) sendSeed(method string, resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	out, err := json.Marshal(Seed{
+		Address:  ip,
+		Port:     port,
+		LastSeen: time.Now(),
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal seed: %w", err)
+	}
+
+	req, err := h.newRequest(method, h.PushURL, out)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (h *HTTPProvider) newRequest(method string, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create request: %w", err)
+	}
+
+	if h.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.BearerToken)
+	}
+
+	return req, nil
+}
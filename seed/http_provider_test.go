@@ -0,0 +1,236 @@
+package seed
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeSeedServer serves a seeds document with an ETag, and adds or removes
+// seeds sent to /push, changing the ETag
+type fakeSeedServer struct {
+	t     *testing.T
+	token string
+
+	lock      sync.Mutex
+	seeds     Seeds
+	etag      string
+	version   int
+	notFound  bool
+	fetches   int
+	unchanged int
+}
+
+func (f *fakeSeedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case r.URL.Path == "/seeds" && r.Method == http.MethodGet:
+		f.fetches++
+
+		if f.notFound {
+			http.NotFound(w, r)
+			return
+		}
+
+		if f.etag != "" && r.Header.Get("If-None-Match") == f.etag {
+			f.unchanged++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", f.etag)
+		json.NewEncoder(w).Encode(f.seeds)
+
+	case r.URL.Path == "/push":
+		if r.Header.Get("Content-Type") != "application/json" {
+			f.t.Errorf("expected a JSON seed but got %q", r.Header.Get("Content-Type"))
+		}
+
+		var seed Seed
+
+		err := json.NewDecoder(r.Body).Decode(&seed)
+
+		if err != nil {
+			f.t.Errorf("couldn't decode pushed seed: %v", err)
+		}
+
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			if seed.LastSeen.IsZero() {
+				f.t.Errorf("expected pushed seed %+v to have a last-seen time", seed)
+			}
+
+			f.seeds.Remove(seed.Address, seed.Port)
+			f.seeds.Seeds = append(f.seeds.Seeds, seed)
+
+		case http.MethodDelete:
+			f.seeds.Remove(seed.Address, seed.Port)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f.version++
+		f.etag = fmt.Sprintf(`"p%d"`, f.version)
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestHTTPServer starts a TLS server for fake, returning it along with a
+// CA file which trusts its certificate
+func newTestHTTPServer(t *testing.T, fake *fakeSeedServer) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	rawCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	err := ioutil.WriteFile(caFile, rawCA, 0644)
+
+	if err != nil {
+		t.Fatalf("couldn't write CA file: %v", err)
+	}
+
+	return server, caFile
+}
+
+func TestHTTPProviderFetchUsesETag(t *testing.T) {
+	fake := &fakeSeedServer{
+		t:     t,
+		token: "secret",
+		seeds: Seeds{Seeds: []Seed{{Address: "10.0.0.1", Port: "9999"}}},
+		etag:  `"v1"`,
+	}
+
+	server, caFile := newTestHTTPServer(t, fake)
+
+	provider, err := NewHTTPProvider(map[string]interface{}{
+		"url":          server.URL + "/seeds",
+		"bearer-token": "secret",
+		"ca-file":      caFile,
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create http provider: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		seeds, err := provider.FetchSeed()
+
+		if err != nil {
+			t.Fatalf("couldn't fetch seeds: %v", err)
+		}
+
+		assertAddresses(t, seeds, "10.0.0.1:9999")
+	}
+
+	if fake.fetches != 2 || fake.unchanged != 1 {
+		t.Errorf("expected the second fetch to be revalidated with the ETag, but got %d fetches and %d unchanged", fake.fetches, fake.unchanged)
+	}
+
+	fake.lock.Lock()
+	fake.seeds.Seeds = append(fake.seeds.Seeds, Seed{Address: "10.0.0.2", Port: "9999"})
+	fake.etag = `"v2"`
+	fake.lock.Unlock()
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch changed seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.2:9999")
+
+	fake.lock.Lock()
+	fake.notFound = true
+	fake.lock.Unlock()
+
+	seeds, err = provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch missing seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds)
+}
+
+func TestHTTPProviderContract(t *testing.T) {
+	fake := &fakeSeedServer{t: t, token: "secret"}
+	server, caFile := newTestHTTPServer(t, fake)
+
+	providerContract(t, func(t *testing.T) Provider {
+		provider, err := NewHTTPProvider(map[string]interface{}{
+			"url":          server.URL + "/seeds",
+			"push-url":     server.URL + "/push",
+			"push-method":  "post",
+			"bearer-token": "secret",
+			"ca-file":      caFile,
+		})
+
+		if err != nil {
+			t.Fatalf("couldn't create http provider: %v", err)
+		}
+
+		return provider
+	})
+}
+
+func TestHTTPProviderErrors(t *testing.T) {
+	fake := &fakeSeedServer{t: t, token: "secret"}
+	server, caFile := newTestHTTPServer(t, fake)
+
+	untrusted, err := NewHTTPProvider(map[string]interface{}{
+		"url":          server.URL + "/seeds",
+		"bearer-token": "secret",
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create http provider: %v", err)
+	}
+
+	_, err = untrusted.FetchSeed()
+
+	if err == nil {
+		t.Error("expected fetching from a server with an untrusted certificate to fail")
+	}
+
+	unauthorised, err := NewHTTPProvider(map[string]interface{}{
+		"url":      server.URL + "/seeds",
+		"push-url": server.URL + "/push",
+		"ca-file":  caFile,
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create http provider: %v", err)
+	}
+
+	_, err = unauthorised.FetchSeed()
+
+	if err == nil {
+		t.Error("expected fetching without a bearer token to fail")
+	}
+
+	err = unauthorised.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Error("expected pushing without a bearer token to fail")
+	}
+}
@@ -40,8 +40,8 @@ func (m *ManualProvider) FetchSeed() (Seeds, error) {
 	return Seeds{
 		Seeds: []Seed{
 			{
-				m.IP,
-				m.Port,
+				Address: m.IP,
+				Port:    m.Port,
 			},
 		},
 	}, nil
@@ -51,3 +51,8 @@ func (m *ManualProvider) FetchSeed() (Seeds, error) {
 func (m *ManualProvider) PushSeed(resolver resolver.IPResolver, port string) error {
 	return nil
 }
+
+// RemoveSeed is a no-op for a manual provider; the configured seed is fixed
+func (m *ManualProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	return nil
+}
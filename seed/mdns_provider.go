@@ -0,0 +1,247 @@
+package seed
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const (
+	defaultMDNSService = "_scrimplb._udp"
+	defaultMDNSDomain  = "local"
+	defaultMDNSWindow  = "3s"
+
+	// mdnsMaxEntries is how many responses a single query can collect
+	mdnsMaxEntries = 256
+)
+
+// MDNSProvider discovers seeds on the local network using multicast DNS,
+// requiring no external storage at all. Load balancers answer queries for a
+// service with their address and port, and FetchSeed collects answers for a
+// configurable window. Since an mDNS responder stops answering when the load
+// balancer stops, there are never stale seeds to prune.
+type MDNSProvider struct {
+	Service     string
+	Domain      string
+	Window      string
+	Instance    string
+	Interface   string
+	ClusterName string `mapstructure:"cluster-name"`
+
+	window time.Duration
+	iface  *net.Interface
+
+	serverLock sync.Mutex
+	server     *mdns.Server
+	announced  string
+}
+
+// NewMDNSProvider creates a new mDNS seed provider from the given config.
+// "service" defaults to "_scrimplb._udp" and "domain" to "local".
+// "window" is how long FetchSeed waits for responses and defaults to 3s.
+// "instance" names this load balancer and defaults to the host name.
+// "interface" optionally restricts mDNS to a single network interface.
+func NewMDNSProvider(config map[string]interface{}) (*MDNSProvider, error) {
+	var provider MDNSProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse mdns provider config: %w", err)
+	}
+
+	if provider.Service == "" {
+		provider.Service = defaultMDNSService
+	}
+
+	provider.Service = namespacedService(provider.Service, provider.ClusterName)
+
+	if provider.Domain == "" {
+		provider.Domain = defaultMDNSDomain
+	}
+
+	if provider.Window == "" {
+		provider.Window = defaultMDNSWindow
+	}
+
+	provider.window, err = time.ParseDuration(provider.Window)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'window' in provider config: %w", err)
+	}
+
+	if provider.Instance == "" {
+		provider.Instance, err = os.Hostname()
+
+		if err != nil {
+			return nil, fmt.Errorf("couldn't determine host name for mdns instance: %w", err)
+		}
+	}
+
+	if provider.Interface != "" {
+		provider.iface, err = net.InterfaceByName(provider.Interface)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'interface' in provider config: %w", err)
+		}
+	}
+
+	return &provider, nil
+}
+
+// FetchSeed queries for the service and returns a seed for every load
+// balancer which responds within the window
+func (m *MDNSProvider) FetchSeed() (Seeds, error) {
+	// the mdns client keeps updating entries after sending them until the
+	// query finishes, so they're only read afterwards, and entries which
+	// don't fit in the buffer are dropped
+	entries := make(chan *mdns.ServiceEntry, mdnsMaxEntries)
+
+	err := mdns.Query(&mdns.QueryParam{
+		Service:   m.Service,
+		Domain:    m.Domain,
+		Timeout:   m.window,
+		Interface: m.iface,
+		Entries:   entries,
+	})
+
+	close(entries)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("mdns query failed: %w", err)
+	}
+
+	seeds := Seeds{}
+	found := make(map[string]bool)
+
+	for entry := range entries {
+		var address string
+
+		if entry.AddrV6 != nil {
+			address = fmt.Sprintf("[%s]", entry.AddrV6.String())
+		} else if entry.AddrV4 != nil {
+			address = entry.AddrV4.String()
+		} else {
+			continue
+		}
+
+		port := strconv.Itoa(entry.Port)
+
+		if found[address+":"+port] {
+			continue
+		}
+
+		found[address+":"+port] = true
+
+		seeds.Seeds = append(seeds.Seeds, Seed{
+			Address: address,
+			Port:    port,
+		})
+	}
+
+	log.Printf("discovered %d seeds over mdns\n", len(seeds.Seeds))
+
+	return seeds, nil
+}
+
+// PushSeed starts answering mDNS queries for the local node, restarting the
+// responder if the local address has changed since the last push
+func (m *MDNSProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	rawIP, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	m.serverLock.Lock()
+	defer m.serverLock.Unlock()
+
+	if m.server != nil && m.announced == rawIP+":"+port {
+		return nil
+	}
+
+	ip := net.ParseIP(strings.Trim(rawIP, "[]"))
+
+	if ip == nil {
+		return fmt.Errorf("couldn't parse resolved ip %s", rawIP)
+	}
+
+	intPort, err := strconv.Atoi(port)
+
+	if err != nil {
+		return fmt.Errorf("invalid port %s for mdns service: %w", port, err)
+	}
+
+	// the responder needs a fully qualified domain, while queries accept either
+	domain := strings.TrimSuffix(m.Domain, ".") + "."
+
+	service, err := mdns.NewMDNSService(m.Instance, m.Service, domain, "", intPort, []net.IP{ip}, nil)
+
+	if err != nil {
+		return fmt.Errorf("couldn't create mdns service: %w", err)
+	}
+
+	m.shutdownServer()
+
+	server, err := mdns.NewServer(&mdns.Config{
+		Zone:  service,
+		Iface: m.iface,
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't start mdns responder: %w", err)
+	}
+
+	m.server = server
+	m.announced = rawIP + ":" + port
+
+	log.Printf("announcing seed over mdns as %s\n", m.Instance)
+
+	return nil
+}
+
+// Announce starts answering mDNS queries for the local node straight away,
+// since there's no stored seed for other nodes to find in the meantime
+func (m *MDNSProvider) Announce(resolver resolver.IPResolver, port string) error {
+	return m.PushSeed(resolver, port)
+}
+
+// RemoveSeed stops answering mDNS queries
+func (m *MDNSProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	return m.Close()
+}
+
+// Close stops answering mDNS queries. Unlike RemoveSeed it's called whenever
+// the node stops, since the responder would otherwise outlive the node.
+func (m *MDNSProvider) Close() error {
+	m.serverLock.Lock()
+	defer m.serverLock.Unlock()
+
+	m.shutdownServer()
+
+	return nil
+}
+
+func (m *MDNSProvider) shutdownServer() {
+	if m.server == nil {
+		return
+	}
+
+	err := m.server.Shutdown()
+
+	if err != nil {
+		log.Printf("couldn't shut down mdns responder: %v\n", err)
+	}
+
+	m.server = nil
+	m.announced = ""
+}
@@ -0,0 +1,145 @@
+package seed
+
+import "testing"
+
+func newTestMDNSProvider(t *testing.T, config map[string]interface{}) *MDNSProvider {
+	t.Helper()
+
+	provider, err := NewMDNSProvider(config)
+
+	if err != nil {
+		t.Fatalf("couldn't create mdns provider: %v", err)
+	}
+
+	t.Cleanup(func() { provider.Close() })
+
+	return provider
+}
+
+// announceTestMDNSProvider starts the provider's responder, skipping the test
+// if multicast isn't available
+func announceTestMDNSProvider(t *testing.T, provider *MDNSProvider, ip string) {
+	t.Helper()
+
+	err := provider.Announce(staticResolver(ip), "9999")
+
+	if err != nil {
+		t.Skipf("couldn't start mdns responder, multicast may be unavailable: %v", err)
+	}
+}
+
+func TestNewMDNSProvider(t *testing.T) {
+	provider := newTestMDNSProvider(t, map[string]interface{}{
+		"instance":     "lb-1",
+		"cluster-name": "prod",
+	})
+
+	if provider.Service != "_scrimplb-prod._udp" || provider.Domain != "local" || provider.window.String() != "3s" {
+		t.Errorf("unexpected defaults for mdns provider: %+v", provider)
+	}
+
+	_, err := NewMDNSProvider(map[string]interface{}{"window": "soon"})
+
+	if err == nil {
+		t.Error("expected an invalid window to be rejected")
+	}
+}
+
+func TestMDNSProviderClose(t *testing.T) {
+	provider := newTestMDNSProvider(t, map[string]interface{}{"instance": "lb-1"})
+	announceTestMDNSProvider(t, provider, "127.0.0.1")
+
+	server := provider.server
+
+	// pushing the same address keeps the running responder
+	err := provider.PushSeed(staticResolver("127.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	if provider.server != server {
+		t.Error("expected pushing an unchanged address to keep the responder")
+	}
+
+	for i := 0; i < 2; i++ {
+		err = provider.Close()
+
+		if err != nil {
+			t.Fatalf("couldn't close mdns provider: %v", err)
+		}
+
+		if provider.server != nil || provider.announced != "" {
+			t.Fatal("expected closing to shut down the responder")
+		}
+	}
+
+	// the responder can be started again after being closed
+	announceTestMDNSProvider(t, provider, "127.0.0.1")
+
+	if provider.server == nil {
+		t.Error("expected announcing after closing to start a new responder")
+	}
+}
+
+func TestChainProviderClosesMDNSProvider(t *testing.T) {
+	chain, err := NewChainProvider(map[string]interface{}{
+		"providers": []map[string]interface{}{
+			{"name": "file", "config": map[string]interface{}{"path": t.TempDir() + "/seeds.json"}},
+			{"name": "mdns", "config": map[string]interface{}{"instance": "lb-1"}},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create chain provider: %v", err)
+	}
+
+	provider := chain.providers[1].(*MDNSProvider)
+	t.Cleanup(func() { provider.Close() })
+
+	announceTestMDNSProvider(t, provider, "127.0.0.1")
+
+	err = chain.Close()
+
+	if err != nil {
+		t.Fatalf("couldn't close chain provider: %v", err)
+	}
+
+	if provider.server != nil {
+		t.Error("expected closing the chain to shut down the mdns responder")
+	}
+}
+
+func TestMDNSProviderStopsAnsweringOnceClosed(t *testing.T) {
+	// a cluster name keeps the query from finding anything else on the network
+	config := map[string]interface{}{"instance": "lb-1", "window": "500ms", "cluster-name": "scrimplb-test"}
+
+	provider := newTestMDNSProvider(t, config)
+	announceTestMDNSProvider(t, provider, "127.0.0.1")
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	if len(seeds.Seeds) == 0 {
+		t.Skip("no mdns responses were received, multicast loopback may be unavailable")
+	}
+
+	assertAddresses(t, seeds, "127.0.0.1:9999")
+
+	err = provider.Close()
+
+	if err != nil {
+		t.Fatalf("couldn't close mdns provider: %v", err)
+	}
+
+	seeds, err = provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds after closing: %v", err)
+	}
+
+	assertAddresses(t, seeds)
+}
@@ -0,0 +1,70 @@
+package seed
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ClusterNameKey is the provider config key holding the name of the cluster.
+// It's set from the top level "cluster-name" config, and providers which
+// store seeds under a key, prefix or name add it so that clusters sharing a
+// seed source can't find each other's seeds. Providers which read from a
+// location chosen by the operator, such as a URL or DNS name, ignore it.
+const ClusterNameKey = "cluster-name"
+
+// namespaced appends the cluster name to key with a hyphen, so "scrimplb"
+// becomes "scrimplb-prod", or returns key if there's no cluster name. The
+// result is a sibling of key rather than nested under it, so that listing
+// the unnamed cluster's prefix never finds a named cluster's seeds.
+func namespaced(key string, clusterName string) string {
+	if clusterName == "" {
+		return key
+	}
+
+	return strings.TrimSuffix(key, "/") + "-" + clusterName
+}
+
+// namespacedPath inserts the cluster name before the path's extension, so
+// "/var/lib/seeds.json" becomes "/var/lib/seeds-prod.json"
+func namespacedPath(path string, clusterName string) string {
+	if clusterName == "" {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + clusterName + ext
+}
+
+// namespacedService adds the cluster name to the first label of a DNS-SD
+// service, so "_scrimplb._udp" becomes "_scrimplb-prod._udp"
+func namespacedService(service string, clusterName string) string {
+	if clusterName == "" {
+		return service
+	}
+
+	parts := strings.SplitN(service, ".", 2)
+	parts[0] += "-" + clusterName
+
+	return strings.Join(parts, ".")
+}
+
+// WithClusterName returns a copy of the provider config with the cluster name
+// set, unless it's empty or the config already sets one
+func WithClusterName(config map[string]interface{}, clusterName string) map[string]interface{} {
+	if clusterName == "" {
+		return config
+	}
+
+	if _, ok := config[ClusterNameKey]; ok {
+		return config
+	}
+
+	withName := make(map[string]interface{}, len(config)+1)
+
+	for k, v := range config {
+		withName[k] = v
+	}
+
+	withName[ClusterNameKey] = clusterName
+	return withName
+}
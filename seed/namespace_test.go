@@ -0,0 +1,21 @@
+package seed
+
+import "testing"
+
+func TestNamespaced(t *testing.T) {
+	for _, test := range []struct {
+		key      string
+		cluster  string
+		expected string
+	}{
+		{"scrimplb", "", "scrimplb"},
+		{"scrimplb", "prod", "scrimplb-prod"},
+		{"scrimplb/", "prod", "scrimplb-prod"},
+		{"/scrimplb/seeds", "prod", "/scrimplb/seeds-prod"},
+		{"scrimplb:seeds", "prod", "scrimplb:seeds-prod"},
+	} {
+		if actual := namespaced(test.key, test.cluster); actual != test.expected {
+			t.Errorf("expected %q in cluster %q to be namespaced as %q but got %q", test.key, test.cluster, test.expected, actual)
+		}
+	}
+}
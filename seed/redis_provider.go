@@ -0,0 +1,170 @@
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const defaultRedisKey = "scrimplb:seeds"
+
+// RedisProvider stores seeds as members of a Redis sorted set, scored by the
+// time they were last pushed. Only seeds pushed within the seed TTL are
+// fetched, and older seeds are pruned on every push.
+type RedisProvider struct {
+	URL         string
+	Key         string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *redis.Client
+}
+
+// NewRedisProvider creates a new Redis seed provider from the given config.
+// "url" is required, and is a redis:// or rediss:// URL which can include a
+// password and database number.
+// "key" is the sorted set to use and defaults to "scrimplb:seeds".
+// "seed-ttl" is the freshness window for seeds.
+func NewRedisProvider(config map[string]interface{}) (*RedisProvider, error) {
+	var provider RedisProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse redis provider config: %w", err)
+	}
+
+	if provider.URL == "" {
+		return nil, errors.New("missing required 'url' in provider config")
+	}
+
+	if provider.Key == "" {
+		provider.Key = defaultRedisKey
+	}
+
+	provider.Key = namespaced(provider.Key, provider.ClusterName)
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	options, err := redis.ParseURL(provider.URL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'url' in provider config: %w", err)
+	}
+
+	provider.client = redis.NewClient(options)
+
+	return &provider, nil
+}
+
+// FetchSeed returns all seeds pushed within the seed TTL
+func (r *RedisProvider) FetchSeed() (Seeds, error) {
+	minScore := strconv.FormatInt(time.Now().Add(-r.seedTTL).Unix(), 10)
+
+	members, err := r.client.ZRangeByScore(r.Key, redis.ZRangeBy{
+		Min: minScore,
+		Max: "+inf",
+	}).Result()
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to fetch seeds from redis: %w", err)
+	}
+
+	seeds := Seeds{}
+
+	for _, member := range members {
+		separator := strings.LastIndex(member, ":")
+
+		if separator == -1 {
+			log.Printf("skipping unparseable seed from redis: %s\n", member)
+			continue
+		}
+
+		seeds.Seeds = append(seeds.Seeds, Seed{
+			Address: member[:separator],
+			Port:    member[separator+1:],
+		})
+	}
+
+	return seeds, nil
+}
+
+// PushSeed adds or refreshes the local node's seed and prunes stale seeds
+func (r *RedisProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	err = r.client.ZAdd(r.Key, redis.Z{
+		Score:  float64(now.Unix()),
+		Member: ip + ":" + port,
+	}).Err()
+
+	if err != nil {
+		return fmt.Errorf("couldn't push seed to redis: %w", err)
+	}
+
+	log.Println("successfully pushed seed to redis")
+
+	// the "(" makes the maximum exclusive, so seeds exactly on the
+	// boundary are kept to match FetchSeed
+	maxScore := "(" + strconv.FormatInt(now.Add(-r.seedTTL).Unix(), 10)
+
+	pruned, err := r.client.ZRemRangeByScore(r.Key, "-inf", maxScore).Result()
+
+	if err != nil {
+		log.Printf("couldn't prune stale seeds from redis: %v\n", err)
+		return nil
+	}
+
+	if pruned > 0 {
+		log.Printf("pruned %d stale seeds older than %v\n", pruned, r.seedTTL)
+	}
+
+	return nil
+}
+
+// RemoveSeed removes the local node's seed
+func (r *RedisProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	err = r.client.ZRem(r.Key, ip+":"+port).Err()
+
+	if err != nil {
+		return fmt.Errorf("couldn't remove seed from redis: %w", err)
+	}
+
+	log.Println("successfully removed seed from redis")
+
+	return nil
+}
+
+// TTL returns how old a seed's score can be before it's removed from the sorted set
+func (r *RedisProvider) TTL() time.Duration {
+	return r.seedTTL
+}
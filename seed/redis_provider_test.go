@@ -0,0 +1,107 @@
+package seed
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+func newTestRedisProvider(t *testing.T, url string) *RedisProvider {
+	t.Helper()
+
+	provider, err := NewRedisProvider(map[string]interface{}{
+		"url":      url,
+		"seed-ttl": "10m",
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create redis provider: %v", err)
+	}
+
+	t.Cleanup(func() { provider.client.Close() })
+
+	return provider
+}
+
+// newTestMiniredis starts a miniredis server which requires the given password
+func newTestMiniredis(t *testing.T, password string) *miniredis.Miniredis {
+	t.Helper()
+
+	server, err := miniredis.Run()
+
+	if err != nil {
+		t.Fatalf("couldn't start miniredis: %v", err)
+	}
+
+	t.Cleanup(server.Close)
+
+	server.RequireAuth(password)
+
+	return server
+}
+
+func TestRedisProviderContract(t *testing.T) {
+	server := newTestMiniredis(t, "hunter2")
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestRedisProvider(t, "redis://:hunter2@"+server.Addr())
+	})
+}
+
+func TestRedisProviderPrunesStaleSeeds(t *testing.T) {
+	server := newTestMiniredis(t, "hunter2")
+	provider := newTestRedisProvider(t, "redis://:hunter2@"+server.Addr())
+
+	err := provider.PushSeed(staticResolver("[fd00::2]"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	// a seed pushed an hour ago is stale, and isn't fetched
+	_, err = server.ZAdd("scrimplb:seeds", float64(time.Now().Add(-time.Hour).Unix()), "10.0.0.9:9999")
+
+	if err != nil {
+		t.Fatalf("couldn't add stale seed: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "[fd00::2]:9999")
+
+	// and is pruned on the next push
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	members, err := server.ZMembers("scrimplb:seeds")
+
+	if err != nil {
+		t.Fatalf("couldn't list sorted set: %v", err)
+	}
+
+	sort.Strings(members)
+
+	if len(members) != 2 || members[0] != "10.0.0.1:9999" || members[1] != "[fd00::2]:9999" {
+		t.Errorf("expected the stale seed to be pruned but got %v", members)
+	}
+}
+
+func TestRedisProviderWrongPassword(t *testing.T) {
+	server := newTestMiniredis(t, "hunter2")
+	provider := newTestRedisProvider(t, "redis://:wrong@"+server.Addr())
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Fatal("expected pushing with the wrong password to fail")
+	}
+}
@@ -0,0 +1,83 @@
+package seed
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a Provider from the raw "provider-config" map.
+type Factory func(config map[string]interface{}) (Provider, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+func init() {
+	Register("dummy", func(config map[string]interface{}) (Provider, error) { return NewDummyProvider(config) })
+	Register("manual", func(config map[string]interface{}) (Provider, error) { return NewManualProvider(config) })
+	Register("s3", func(config map[string]interface{}) (Provider, error) { return NewS3Provider(config) })
+	Register("gcs", func(config map[string]interface{}) (Provider, error) { return NewGCSProvider(config) })
+	Register("azure-blob", func(config map[string]interface{}) (Provider, error) { return NewAzureBlobProvider(config) })
+	Register("dns", func(config map[string]interface{}) (Provider, error) { return NewDNSProvider(config) })
+	Register("http", func(config map[string]interface{}) (Provider, error) { return NewHTTPProvider(config) })
+	Register("file", func(config map[string]interface{}) (Provider, error) { return NewFileProvider(config) })
+	Register("consul", func(config map[string]interface{}) (Provider, error) { return NewConsulProvider(config) })
+	Register("etcd", func(config map[string]interface{}) (Provider, error) { return NewEtcdProvider(config) })
+	Register("redis", func(config map[string]interface{}) (Provider, error) { return NewRedisProvider(config) })
+	Register("mdns", func(config map[string]interface{}) (Provider, error) { return NewMDNSProvider(config) })
+	Register("ssm", func(config map[string]interface{}) (Provider, error) { return NewSSMProvider(config) })
+	Register("dynamodb", func(config map[string]interface{}) (Provider, error) { return NewDynamoDBProvider(config) })
+	Register("chain", func(config map[string]interface{}) (Provider, error) { return NewChainProvider(config) })
+}
+
+// Register makes a provider available under the given name, so that it can be
+// selected with "provider" in config. Names are case insensitive. This is
+// intended to be called from an init function, and panics if factory is nil
+// or if a provider is already registered with the same name.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	name = strings.ToLower(name)
+
+	if factory == nil {
+		panic("seed: Register factory is nil for provider " + name)
+	}
+
+	if _, exists := registry[name]; exists {
+		panic("seed: Register called twice for provider " + name)
+	}
+
+	registry[name] = factory
+}
+
+// Registered returns the sorted names of all registered providers.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// NewProvider creates the provider registered under the given name from its
+// config. An unknown name is an error which lists the registered providers.
+func NewProvider(name string, config map[string]interface{}) (Provider, error) {
+	registryLock.RLock()
+	factory, ok := registry[strings.ToLower(name)]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown provider '%s'; registered providers are: %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return factory(config)
+}
@@ -0,0 +1,72 @@
+package seed
+
+import (
+	"strings"
+	"testing"
+)
+
+func assertPanics(t *testing.T, description string, fn func()) {
+	t.Helper()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected %s to panic", description)
+		}
+	}()
+
+	fn()
+}
+
+func TestRegisterRejectsDuplicateNames(t *testing.T) {
+	factory := func(config map[string]interface{}) (Provider, error) { return NewDummyProvider(config) }
+
+	// names are case insensitive, so this clashes with the built in provider
+	assertPanics(t, "registering a provider twice", func() { Register("S3", factory) })
+	assertPanics(t, "registering a nil factory", func() { Register("registry-test-nil", nil) })
+}
+
+func TestNewProviderRejectsUnknownName(t *testing.T) {
+	_, err := NewProvider("no-such-provider", nil)
+
+	if err == nil {
+		t.Fatal("expected an unknown provider to be rejected")
+	}
+
+	if !strings.Contains(err.Error(), "no-such-provider") || !strings.Contains(err.Error(), "dynamodb") {
+		t.Errorf("expected the error to name the provider and list registered providers, but got: %v", err)
+	}
+}
+
+// a third-party provider registers itself at init, which also keeps repeated
+// test runs from registering it twice
+func init() {
+	Register("registry-test-provider", func(config map[string]interface{}) (Provider, error) {
+		return NewManualProvider(config)
+	})
+}
+
+func TestRegisterThirdPartyProvider(t *testing.T) {
+	provider, err := NewProvider("Registry-Test-Provider", map[string]interface{}{"ip": "10.0.0.1", "port": "9999"})
+
+	if err != nil {
+		t.Fatalf("couldn't create registered provider: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds from registered provider: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+
+	found := false
+
+	for _, name := range Registered() {
+		found = found || name == "registry-test-provider"
+	}
+
+	if !found {
+		t.Errorf("expected the registered provider to be listed but got %v", Registered())
+	}
+}
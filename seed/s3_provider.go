@@ -5,34 +5,56 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/mitchellh/mapstructure"
 	"github.com/sgtcodfish/scrimplb/constants"
 	"github.com/sgtcodfish/scrimplb/resolver"
 )
 
-// S3Provider can retrieve a seed from an object in an S3 bucket.
-// Required permissions for a load balancer are: GetObject, PutObject, ListBucket
+// S3Provider can retrieve seeds from objects in an S3 bucket.
+// Each load balancer writes its own seed to a separate object under the
+// prefix "<key>/", so concurrent pushes from several load balancers can't
+// overwrite each other. Fetching lists the prefix and merges every fresh seed,
+// along with any seeds in the single object at "<key>" which older versions
+// of scrimplb wrote to.
+// Required permissions for a load balancer are: GetObject, PutObject, DeleteObject, ListBucket
 // Required permissions for an application server are: GetObject, ListBucket
-// Without ListBucket you'll get an AccessDenied when you try to fetch a nonexistant seed
+// Any S3-compatible store (e.g. DigitalOcean Spaces, Backblaze B2, Wasabi or
+// MinIO) can be used by setting an endpoint and credentials.
 type S3Provider struct {
-	Bucket string
-	Region string
-	Key    string
+	AWSSessionConfig `mapstructure:",squash"`
 
-	// accessKey       string
-	// secretAccessKey string
+	Bucket          string
+	Key             string
+	SeedTTL         string `mapstructure:"seed-ttl"`
+	ForcePathStyle  bool   `mapstructure:"force-path-style"`
+	WriteLegacySeed bool   `mapstructure:"write-legacy-seed"`
+	ClusterName     string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *s3.S3
 }
 
 // NewS3Provider creates a new S3 seed provider from the given config.
 // "availability-zone" is optional; if not given it will be deduced from instance
 // metadata if running on EC2.
+// "seed-ttl" is optional, and controls how long a seed which hasn't been
+// re-pushed is kept for before being pruned.
+// "force-path-style" is optional, and is needed for most S3-compatible stores
+// other than AWS.
+// "write-legacy-seed" is optional, and makes load balancers also maintain the
+// single seed object at "key" which older versions of scrimplb read, so that
+// backends which haven't been upgraded yet can still find a seed. It should
+// only be enabled while upgrading, since load balancers can overwrite each
+// other's seeds in that object.
+// See AWSSessionConfig for region, endpoint and credential options.
 func NewS3Provider(config map[string]interface{}) (*S3Provider, error) {
 	var provider S3Provider
 
@@ -46,67 +68,111 @@ func NewS3Provider(config map[string]interface{}) (*S3Provider, error) {
 		return nil, errors.New("missing required 'bucket' in provider config")
 	}
 
-	if provider.Region == "" {
-		return nil, errors.New("missing required 'region' in provider config")
-	}
-
 	if provider.Key == "" {
 		provider.Key = constants.DefaultKey
 	}
 
+	provider.Key = namespaced(provider.Key, provider.ClusterName)
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	sess, err := provider.newSession()
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider.client = s3.New(sess, &aws.Config{
+		S3ForcePathStyle: aws.Bool(provider.ForcePathStyle),
+	})
+
 	return &provider, nil
 }
 
-// FetchSeed makes a call to S3 to retrieve the seed for the AZ this
-// instance is located in.
+// FetchSeed lists all seed objects under the configured prefix and merges
+// those which were pushed within the seed TTL, along with any seeds in the
+// legacy seed object.
 func (s *S3Provider) FetchSeed() (Seeds, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s.Region)},
-	)
+	now := time.Now()
+	freshKeys, _, err := s.listSeedObjects(now)
 
 	if err != nil {
 		return Seeds{}, err
 	}
 
-	downloader := s3manager.NewDownloader(sess)
-
-	buf := aws.NewWriteAtBuffer([]byte{})
+	seeds := Seeds{}
 
-	numBytes, err := downloader.Download(buf,
-		&s3.GetObjectInput{
+	for _, key := range freshKeys {
+		output, err := s.client.GetObject(&s3.GetObjectInput{
 			Bucket: aws.String(s.Bucket),
-			Key:    aws.String(s.Key),
+			Key:    aws.String(key),
 		})
 
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				return Seeds{}, nil
-
-			default:
-				return Seeds{}, fmt.Errorf("unable to download seed: %w", err)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				// removed since we listed it
+				continue
 			}
-		} else {
-			return Seeds{}, fmt.Errorf("unable to download seed; non-AWS error: %w", err)
+
+			return Seeds{}, fmt.Errorf("unable to download seed %s: %w", key, err)
 		}
-	}
 
-	log.Printf("downloaded %d bytes from S3 for seed\n", numBytes)
+		raw, err := ioutil.ReadAll(output.Body)
+		output.Body.Close()
 
-	var seeds Seeds
+		if err != nil {
+			return Seeds{}, fmt.Errorf("unable to read seed %s: %w", key, err)
+		}
+
+		var seed Seed
 
-	err = json.Unmarshal(buf.Bytes(), &seeds)
+		err = json.Unmarshal(raw, &seed)
+
+		if err != nil {
+			log.Printf("skipping unparseable seed %s: %v\n", key, err)
+			continue
+		}
+
+		seeds.Seeds = append(seeds.Seeds, seed)
+	}
+
+	legacySeeds, err := s.fetchLegacySeeds(now)
 
 	if err != nil {
-		return Seeds{}, fmt.Errorf("unable to parse downloaded seed: %w", err)
+		return Seeds{}, err
 	}
 
+	for _, legacySeed := range legacySeeds.Seeds {
+		found := false
+
+		for _, seed := range seeds.Seeds {
+			if seed.Address == legacySeed.Address && seed.Port == legacySeed.Port {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			seeds.Seeds = append(seeds.Seeds, legacySeed)
+		}
+	}
+
+	log.Printf("fetched %d seeds from S3\n", len(seeds.Seeds))
+
 	return seeds, nil
 }
 
-// PushSeed fetches remote data, updates with local node details and then
-// publishes the details to an S3 bucket so that future nodes can join
+// PushSeed writes the local node's seed to its own object in the S3 bucket
+// so that future nodes can join, and then deletes any stale seed objects
+// left behind by load balancers which have since died.
 func (s *S3Provider) PushSeed(resolver resolver.IPResolver, port string) error {
 	ip, err := resolver.ResolveIP()
 
@@ -114,90 +180,221 @@ func (s *S3Provider) PushSeed(resolver resolver.IPResolver, port string) error {
 		return err
 	}
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s.Region)},
-	)
+	now := time.Now()
+
+	out, err := json.Marshal(Seed{
+		Address:  ip,
+		Port:     port,
+		LastSeen: now,
+	})
 
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't marshal output for S3: %w", err)
 	}
 
-	downloader := s3manager.NewDownloader(sess)
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.seedKey(ip, port)),
+		Body:        bytes.NewReader(out),
+		ContentType: aws.String("application/json"),
+	})
 
-	buf := aws.NewWriteAtBuffer([]byte{})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+			return fmt.Errorf("unable to push seed - no such bucket: %w", err)
+		}
 
-	numBytes, err := downloader.Download(buf,
-		&s3.GetObjectInput{
-			Bucket: aws.String(s.Bucket),
-			Key:    aws.String(s.Key),
+		return fmt.Errorf("couldn't upload S3 content: %w", err)
+	}
+
+	log.Println("successfully pushed seed to s3")
+
+	if s.WriteLegacySeed {
+		err = s.updateLegacySeeds(func(seeds *Seeds) bool {
+			pushSeed(seeds, ip, port, s.seedTTL)
+			return true
 		})
 
-	var downloadedSeeds Seeds
+		if err != nil {
+			log.Printf("couldn't push seed to legacy seed object: %v\n", err)
+		}
+	}
+
+	_, staleKeys, err := s.listSeedObjects(now)
+
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				return fmt.Errorf("unable to push seed - no such bucket: %w", err)
+		log.Printf("couldn't list seeds to prune: %v\n", err)
+		return nil
+	}
 
-			default:
-				// ignore
-			}
+	for _, key := range staleKeys {
+		_, err = s.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(key),
+		})
+
+		if err != nil {
+			log.Printf("couldn't prune stale seed %s: %v\n", key, err)
+			continue
 		}
-	} else {
-		log.Printf("downloaded %d bytes from S3 for seed\n", numBytes)
-		err = json.Unmarshal(buf.Bytes(), &downloadedSeeds)
+
+		log.Printf("pruned stale seed %s older than %v\n", key, s.seedTTL)
+	}
+
+	return nil
+}
+
+// RemoveSeed deletes the local node's seed object. This is used to remove a
+// load balancer which is shutting down.
+func (s *S3Provider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.seedKey(ip, port)),
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't delete S3 seed: %w", err)
+	}
+
+	if s.WriteLegacySeed {
+		err = s.updateLegacySeeds(func(seeds *Seeds) bool {
+			return seeds.Remove(ip, port)
+		})
 
 		if err != nil {
-			log.Println("unable to parse downloaded seed, defaulting to overwriting file")
+			return fmt.Errorf("couldn't remove seed from legacy seed object: %w", err)
 		}
 	}
 
-	seeds := Seeds{}
-	if downloadedSeeds.Seeds != nil && len(downloadedSeeds.Seeds) > 0 {
-		seeds.Seeds = downloadedSeeds.Seeds
-		hasCurrent := false
+	log.Println("successfully removed seed from s3")
 
-		for _, s := range downloadedSeeds.Seeds {
-			if s.Address == ip && s.Port == port {
-				hasCurrent = true
-				break
+	return nil
+}
+
+// listSeedObjects returns the keys of all seed objects under the prefix,
+// split into those modified within the seed TTL and those which are stale.
+func (s *S3Provider) listSeedObjects(now time.Time) (fresh []string, stale []string, err error) {
+	// the delimiter stops objects nested under the prefix, such as those of
+	// another cluster with an overlapping prefix, from being listed
+	err = s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(s.prefix()),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if now.Sub(aws.TimeValue(object.LastModified)) > s.seedTTL {
+				stale = append(stale, aws.StringValue(object.Key))
+			} else {
+				fresh = append(fresh, aws.StringValue(object.Key))
 			}
 		}
 
-		if !hasCurrent {
-			seeds.Seeds = append(seeds.Seeds, Seed{
-				Address: ip,
-				Port:    port,
-			})
-		} else {
-			log.Println("skipping publishing seed as address is already published")
-			return nil
+		return true
+	})
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list seeds: %w", err)
+	}
+
+	return fresh, stale, nil
+}
+
+// fetchLegacySeeds reads the single seed object which older versions of
+// scrimplb wrote every seed to, treating a missing object as empty. Seeds
+// pushed with "write-legacy-seed" are pruned by the seed TTL, but those
+// written by older versions have no LastSeen time and are kept.
+func (s *S3Provider) fetchLegacySeeds(now time.Time) (Seeds, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.legacyKey()),
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return Seeds{}, nil
 		}
-	} else {
-		seeds.Seeds = []Seed{{
-			Address: ip,
-			Port:    port,
-		}}
+
+		return Seeds{}, fmt.Errorf("unable to download legacy seed object: %w", err)
+	}
+
+	raw, err := ioutil.ReadAll(output.Body)
+	output.Body.Close()
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to read legacy seed object: %w", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal(raw, &seeds)
+
+	if err != nil {
+		log.Printf("skipping unparseable legacy seed object: %v\n", err)
+		return Seeds{}, nil
+	}
+
+	seeds.Prune(s.seedTTL, now)
+
+	return seeds, nil
+}
+
+// updateLegacySeeds applies update to the seeds in the legacy seed object,
+// writing them back if update returns true
+func (s *S3Provider) updateLegacySeeds(update func(*Seeds) bool) error {
+	seeds, err := s.fetchLegacySeeds(time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	if !update(&seeds) {
+		return nil
 	}
 
 	out, err := json.Marshal(seeds)
 
 	if err != nil {
-		return fmt.Errorf("couldn't marshal output for S3: %w", err)
+		return fmt.Errorf("couldn't marshal legacy seeds for S3: %w", err)
 	}
 
-	uploader := s3manager.NewUploader(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s.Key),
-		Body:   bytes.NewReader(out),
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.legacyKey()),
+		Body:        bytes.NewReader(out),
+		ContentType: aws.String("application/json"),
 	})
 
 	if err != nil {
-		return fmt.Errorf("couldn't upload S3 content: %w", err)
+		return fmt.Errorf("couldn't upload legacy seed object: %w", err)
 	}
 
-	log.Println("successfully pushed seed to s3")
-
 	return nil
 }
+
+// legacyKey is the key of the single object which older versions of
+// scrimplb wrote every seed to
+func (s *S3Provider) legacyKey() string {
+	return strings.TrimSuffix(s.Key, "/")
+}
+
+func (s *S3Provider) prefix() string {
+	return strings.TrimSuffix(s.Key, "/") + "/"
+}
+
+// seedKey returns the object key for the seed with the given address and
+// port, avoiding characters from IPv6 addresses which are awkward in keys.
+func (s *S3Provider) seedKey(address string, port string) string {
+	name := strings.NewReplacer("[", "", "]", "", ":", "-").Replace(address)
+	return s.prefix() + name + "_" + port + ".json"
+}
+
+// TTL returns the age after which a seed object which hasn't been rewritten is deleted
+func (s *S3Provider) TTL() time.Duration {
+	return s.seedTTL
+}
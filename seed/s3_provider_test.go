@@ -0,0 +1,416 @@
+package seed
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeS3Object struct {
+	body         []byte
+	lastModified time.Time
+}
+
+// fakeS3 implements just enough of the S3 API, with path style addressing,
+// for the S3 provider
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+
+	lock    sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		t:       t,
+		bucket:  bucket,
+		objects: make(map[string]fakeS3Object),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func (f *fakeS3) put(key string, body []byte, lastModified time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.objects[key] = fakeS3Object{body, lastModified}
+}
+
+func (f *fakeS3) get(key string) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	object, ok := f.objects[key]
+	return object.body, ok
+}
+
+func (f *fakeS3) keys() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDTEST/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+
+	if parts[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			f.list(w, r)
+			return
+		}
+
+		f.t.Errorf("unexpected bucket request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	key := parts[1]
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		object, ok := f.objects[key]
+
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("Last-Modified", object.lastModified.UTC().Format(http.TimeFormat))
+		w.Write(object.body)
+
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			f.t.Errorf("couldn't read put body: %v", err)
+		}
+
+		f.objects[key] = fakeS3Object{body, time.Now()}
+
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.t.Errorf("unexpected object request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type contents struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+
+	type commonPrefix struct {
+		Prefix string
+	}
+
+	type listBucketResult struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []contents
+		CommonPrefixes []commonPrefix
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	result := listBucketResult{
+		Name:   f.bucket,
+		Prefix: prefix,
+	}
+
+	seenPrefixes := make(map[string]bool)
+
+	for _, key := range f.keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+
+				if !seenPrefixes[common] {
+					seenPrefixes[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{common})
+				}
+
+				continue
+			}
+		}
+
+		f.lock.Lock()
+		object := f.objects[key]
+		f.lock.Unlock()
+
+		result.Contents = append(result.Contents, contents{
+			Key:          key,
+			LastModified: object.lastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			Size:         len(object.body),
+		})
+	}
+
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	err := xml.NewEncoder(w).Encode(result)
+
+	if err != nil {
+		f.t.Errorf("couldn't encode list result: %v", err)
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte("<Error><Code>" + code + "</Code><Message>" + code + "</Message></Error>"))
+}
+
+func newTestS3Provider(t *testing.T, server *httptest.Server, extra map[string]interface{}) *S3Provider {
+	t.Helper()
+
+	config := map[string]interface{}{
+		"bucket":            "seeds",
+		"region":            "us-east-1",
+		"endpoint":          server.URL,
+		"force-path-style":  true,
+		"access-key-id":     "AKIDTEST",
+		"secret-access-key": "secret",
+	}
+
+	for k, v := range extra {
+		config[k] = v
+	}
+
+	provider, err := NewS3Provider(config)
+
+	if err != nil {
+		t.Fatalf("couldn't create s3 provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestS3ProviderContract(t *testing.T) {
+	_, server := newFakeS3(t, "seeds")
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestS3Provider(t, server, nil)
+	})
+}
+
+func TestS3ProviderStoresOneObjectPerSeed(t *testing.T) {
+	fake, server := newFakeS3(t, "seeds")
+	provider := newTestS3Provider(t, server, nil)
+
+	for _, ip := range []string{"10.0.0.1", "[fd00::2]"} {
+		err := provider.PushSeed(staticResolver(ip), "9999")
+
+		if err != nil {
+			t.Fatalf("couldn't push seed for %s: %v", ip, err)
+		}
+	}
+
+	keys := fake.keys()
+
+	if len(keys) != 2 || keys[0] != "scrimplb/10.0.0.1_9999.json" || keys[1] != "scrimplb/fd00--2_9999.json" {
+		t.Fatalf("expected one object per load balancer but got %v", keys)
+	}
+}
+
+func TestS3ProviderPrunesStaleSeeds(t *testing.T) {
+	fake, server := newFakeS3(t, "seeds")
+	provider := newTestS3Provider(t, server, map[string]interface{}{"seed-ttl": "10m"})
+
+	stale, _ := json.Marshal(Seed{Address: "10.0.0.9", Port: "9999"})
+	fake.put("scrimplb/10.0.0.9_9999.json", stale, time.Now().Add(-time.Hour))
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds)
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	if _, ok := fake.get("scrimplb/10.0.0.9_9999.json"); ok {
+		t.Errorf("expected stale seed to be pruned on push")
+	}
+}
+
+func TestS3ProviderReadsLegacySeedObject(t *testing.T) {
+	fake, server := newFakeS3(t, "seeds")
+
+	legacy, _ := json.Marshal(Seeds{Seeds: []Seed{{Address: "10.0.0.5", Port: "9999"}}})
+	fake.put("scrimplb", legacy, time.Now().Add(-time.Hour))
+
+	provider := newTestS3Provider(t, server, nil)
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	seeds, err := provider.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.5:9999")
+
+	body, _ := fake.get("scrimplb")
+
+	if string(body) != string(legacy) {
+		t.Errorf("expected legacy seed object to be left alone without write-legacy-seed, but got %s", body)
+	}
+}
+
+func TestS3ProviderWritesLegacySeedObject(t *testing.T) {
+	fake, server := newFakeS3(t, "seeds")
+
+	legacy, _ := json.Marshal(Seeds{Seeds: []Seed{{Address: "10.0.0.5", Port: "9999"}}})
+	fake.put("scrimplb", legacy, time.Now().Add(-time.Hour))
+
+	provider := newTestS3Provider(t, server, map[string]interface{}{"write-legacy-seed": true})
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push seed: %v", err)
+	}
+
+	var seeds Seeds
+	body, _ := fake.get("scrimplb")
+
+	err = json.Unmarshal(body, &seeds)
+
+	if err != nil {
+		t.Fatalf("couldn't parse legacy seed object: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.5:9999")
+
+	err = provider.RemoveSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't remove seed: %v", err)
+	}
+
+	body, _ = fake.get("scrimplb")
+	seeds = Seeds{}
+
+	err = json.Unmarshal(body, &seeds)
+
+	if err != nil {
+		t.Fatalf("couldn't parse legacy seed object: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.5:9999")
+}
+
+func TestS3ProviderRejectsBadCredentials(t *testing.T) {
+	_, server := newFakeS3(t, "seeds")
+	provider := newTestS3Provider(t, server, map[string]interface{}{"access-key-id": "WRONG"})
+
+	_, err := provider.FetchSeed()
+
+	if err == nil {
+		t.Fatal("expected fetching with the wrong credentials to fail")
+	}
+}
+
+func TestS3ProviderIsolatesClusters(t *testing.T) {
+	fake, server := newFakeS3(t, "seeds")
+
+	unnamed := newTestS3Provider(t, server, map[string]interface{}{"seed-ttl": "10m"})
+	prod := newTestS3Provider(t, server, map[string]interface{}{"seed-ttl": "10m", "cluster-name": "prod"})
+
+	err := prod.PushSeed(staticResolver("10.0.0.2"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push named cluster's seed: %v", err)
+	}
+
+	// a stale object nested under the unnamed cluster's prefix, as written
+	// by an operator with an overlapping key, is neither read nor pruned
+	nested, _ := json.Marshal(Seed{Address: "10.0.0.9", Port: "9999"})
+	fake.put("scrimplb/nested/10.0.0.9_9999.json", nested, time.Now().Add(-time.Hour))
+
+	err = unnamed.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push unnamed cluster's seed: %v", err)
+	}
+
+	seeds, err := unnamed.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch unnamed cluster's seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+
+	seeds, err = prod.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch named cluster's seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.2:9999")
+
+	if _, ok := fake.get("scrimplb/nested/10.0.0.9_9999.json"); !ok {
+		t.Error("expected an object nested under the prefix not to be pruned")
+	}
+
+	if _, ok := fake.get("scrimplb-prod/10.0.0.2_9999.json"); !ok {
+		t.Errorf("expected the named cluster's seed in a sibling prefix but got %v", fake.keys())
+	}
+}
@@ -1,6 +1,8 @@
 package seed
 
 import (
+	"time"
+
 	"github.com/sgtcodfish/scrimplb/resolver"
 )
 
@@ -8,8 +10,9 @@ import (
 // without requiring multicast or another type of service discovery. This
 // allows us to bootstrap the gossip cluster
 type Seed struct {
-	Address string `json:"address"`
-	Port    string `json:"port"`
+	Address  string    `json:"address"`
+	Port     string    `json:"port"`
+	LastSeen time.Time `json:"last-seen"`
 }
 
 // Seeds is a collection of seeds in one file.
@@ -17,9 +20,88 @@ type Seeds struct {
 	Seeds []Seed `json:"seeds"`
 }
 
+// Upsert adds a seed with the given address and port, or refreshes the
+// LastSeen time of the seed if it's already present.
+func (s *Seeds) Upsert(address string, port string, now time.Time) {
+	for i := range s.Seeds {
+		if s.Seeds[i].Address == address && s.Seeds[i].Port == port {
+			s.Seeds[i].LastSeen = now
+			return
+		}
+	}
+
+	s.Seeds = append(s.Seeds, Seed{
+		Address:  address,
+		Port:     port,
+		LastSeen: now,
+	})
+}
+
+// Remove removes any seed with the given address and port, returning true
+// if a seed was removed.
+func (s *Seeds) Remove(address string, port string) bool {
+	kept := []Seed{}
+
+	for _, seed := range s.Seeds {
+		if seed.Address == address && seed.Port == port {
+			continue
+		}
+
+		kept = append(kept, seed)
+	}
+
+	removed := len(kept) != len(s.Seeds)
+	s.Seeds = kept
+
+	return removed
+}
+
+// Prune removes seeds which haven't been seen within ttl of now, returning
+// the number of seeds removed. Seeds with no LastSeen time were written by
+// hand, by configuration management or by an older version of scrimplb, and
+// are always kept since there's no way to tell whether they're stale.
+func (s *Seeds) Prune(ttl time.Duration, now time.Time) int {
+	kept := []Seed{}
+
+	for _, seed := range s.Seeds {
+		if !seed.LastSeen.IsZero() && now.Sub(seed.LastSeen) > ttl {
+			continue
+		}
+
+		kept = append(kept, seed)
+	}
+
+	pruned := len(s.Seeds) - len(kept)
+	s.Seeds = kept
+
+	return pruned
+}
+
 // Provider abstracts the concept of fetching and pushing seeds, to avoid
 // depending on the details of any one cloud or hosting platform.
+// RemoveSeed is called by a load balancer which is shutting down, and
+// should remove anything published by PushSeed with the same arguments.
+// Providers which hold resources, such as a running responder, also implement
+// io.Closer and are closed when the node stops, even if RemoveSeed isn't
+// called.
 type Provider interface {
 	FetchSeed() (Seeds, error)
 	PushSeed(resolver.IPResolver, string) error
+	RemoveSeed(resolver.IPResolver, string) error
+}
+
+// TTLProvider is implemented by providers which expire seeds that haven't been
+// re-pushed within a TTL. A load balancer has to push more often than this, or
+// its own seed would be pruned between pushes. A TTL of zero means that seeds
+// never expire.
+type TTLProvider interface {
+	TTL() time.Duration
+}
+
+// Announcer is implemented by providers which announce the local node
+// directly rather than storing seeds elsewhere, such that the node can't be
+// discovered at all until it has announced itself. Load balancers announce as
+// soon as they start rather than waiting for the first push.
+type Announcer interface {
+	Announce(resolver.IPResolver, string) error
 }
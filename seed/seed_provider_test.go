@@ -0,0 +1,130 @@
+package seed
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// staticResolver resolves to a fixed address, so tests can push seeds for
+// several load balancers
+type staticResolver string
+
+func (r staticResolver) ResolveIP() (string, error) {
+	return string(r), nil
+}
+
+// addresses returns the sorted "address:port" of every seed
+func addresses(seeds Seeds) []string {
+	var out []string
+
+	for _, seed := range seeds.Seeds {
+		out = append(out, seed.Address+":"+seed.Port)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+func assertAddresses(t *testing.T, seeds Seeds, expected ...string) {
+	t.Helper()
+
+	actual := addresses(seeds)
+	sort.Strings(expected)
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected seeds %v but got %v", expected, actual)
+	}
+
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected seeds %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestSeedsPrune(t *testing.T) {
+	now := time.Now()
+
+	seeds := Seeds{
+		Seeds: []Seed{
+			{Address: "10.0.0.1", Port: "9999", LastSeen: now.Add(-time.Minute)},
+			{Address: "10.0.0.2", Port: "9999", LastSeen: now.Add(-time.Hour)},
+			{Address: "10.0.0.3", Port: "9999"},
+		},
+	}
+
+	pruned := seeds.Prune(10*time.Minute, now)
+
+	if pruned != 1 {
+		t.Errorf("expected 1 seed to be pruned but got %d", pruned)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.3:9999")
+}
+
+// providerContract checks the behaviour every writable provider shares.
+// newProvider is called once for each load balancer, and every provider it
+// returns must share one empty seed source. Provider-specific behaviour, such
+// as preconditions on concurrent writes, is tested alongside each provider.
+func providerContract(t *testing.T, newProvider func(t *testing.T) Provider) {
+	t.Helper()
+
+	first := newProvider(t)
+	second := newProvider(t)
+
+	seeds, err := first.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch from an empty seed source: %v", err)
+	}
+
+	assertAddresses(t, seeds)
+
+	err = first.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push first seed: %v", err)
+	}
+
+	err = second.PushSeed(staticResolver("10.0.0.2"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push second seed: %v", err)
+	}
+
+	// pushing again refreshes the seed rather than adding another
+	err = first.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't push first seed again: %v", err)
+	}
+
+	seeds, err = second.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999", "10.0.0.2:9999")
+
+	err = second.RemoveSeed(staticResolver("10.0.0.2"), "9999")
+
+	if err != nil {
+		t.Fatalf("couldn't remove seed: %v", err)
+	}
+
+	seeds, err = first.FetchSeed()
+
+	if err != nil {
+		t.Fatalf("couldn't fetch seeds after removal: %v", err)
+	}
+
+	assertAddresses(t, seeds, "10.0.0.1:9999")
+
+	err = second.RemoveSeed(staticResolver("10.0.0.2"), "9999")
+
+	if err != nil {
+		t.Errorf("expected removing a seed which is already gone to succeed, but got: %v", err)
+	}
+}
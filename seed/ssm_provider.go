@@ -0,0 +1,197 @@
+package seed
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sgtcodfish/scrimplb/constants"
+	"github.com/sgtcodfish/scrimplb/resolver"
+)
+
+const defaultSSMParameter = "/scrimplb/seeds"
+
+// SSMProvider stores the seeds document in an AWS SSM Parameter Store
+// parameter. Parameter Store has no conditional writes, so a push which races
+// with another load balancer's push can drop that load balancer's seed until
+// its next push.
+// Required permissions for a load balancer are: ssm:GetParameter, ssm:PutParameter
+// Required permissions for an application server are: ssm:GetParameter
+type SSMProvider struct {
+	AWSSessionConfig `mapstructure:",squash"`
+
+	Parameter   string
+	SeedTTL     string `mapstructure:"seed-ttl"`
+	ClusterName string `mapstructure:"cluster-name"`
+
+	seedTTL time.Duration
+	client  *ssm.SSM
+}
+
+// NewSSMProvider creates a new SSM Parameter Store seed provider from the
+// given config.
+// "parameter" is the parameter name and defaults to "/scrimplb/seeds".
+// "seed-ttl" is optional, and controls how long a seed which hasn't been
+// re-pushed is kept for before being pruned.
+// See AWSSessionConfig for region, endpoint and credential options.
+func NewSSMProvider(config map[string]interface{}) (*SSMProvider, error) {
+	var provider SSMProvider
+
+	err := mapstructure.Decode(config, &provider)
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse ssm provider config: %w", err)
+	}
+
+	if provider.Parameter == "" {
+		provider.Parameter = defaultSSMParameter
+	}
+
+	provider.Parameter = namespaced(provider.Parameter, provider.ClusterName)
+
+	if provider.SeedTTL == "" {
+		provider.SeedTTL = constants.DefaultSeedTTL
+	}
+
+	provider.seedTTL, err = time.ParseDuration(provider.SeedTTL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'seed-ttl' in provider config: %w", err)
+	}
+
+	sess, err := provider.newSession()
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider.client = ssm.New(sess)
+
+	return &provider, nil
+}
+
+// FetchSeed reads the seeds parameter
+func (s *SSMProvider) FetchSeed() (Seeds, error) {
+	seeds, err := s.read()
+
+	if err != nil {
+		return Seeds{}, err
+	}
+
+	return seeds, nil
+}
+
+// PushSeed adds the local node to the seeds parameter, pruning stale seeds
+func (s *SSMProvider) PushSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	seeds, err := s.read()
+
+	if err != nil {
+		return err
+	}
+
+	pushSeed(&seeds, ip, port, s.seedTTL)
+
+	err = s.write(seeds)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("successfully pushed seed to ssm")
+
+	return nil
+}
+
+// RemoveSeed removes the local node from the seeds parameter
+func (s *SSMProvider) RemoveSeed(resolver resolver.IPResolver, port string) error {
+	ip, err := resolver.ResolveIP()
+
+	if err != nil {
+		return err
+	}
+
+	seeds, err := s.read()
+
+	if err != nil {
+		return err
+	}
+
+	if !seeds.Remove(ip, port) {
+		log.Println("skipping seed removal as address is not published")
+		return nil
+	}
+
+	err = s.write(seeds)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("successfully removed seed from ssm")
+
+	return nil
+}
+
+// read fetches and parses the seeds parameter, treating a missing parameter
+// as empty. A parameter which can't be parsed is an error, since overwriting
+// it would lose every other load balancer's seed.
+func (s *SSMProvider) read() (Seeds, error) {
+	output, err := s.client.GetParameter(&ssm.GetParameterInput{
+		Name: aws.String(s.Parameter),
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return Seeds{}, nil
+		}
+
+		return Seeds{}, fmt.Errorf("unable to get ssm parameter: %w", err)
+	}
+
+	var seeds Seeds
+
+	err = json.Unmarshal([]byte(aws.StringValue(output.Parameter.Value)), &seeds)
+
+	if err != nil {
+		return Seeds{}, fmt.Errorf("unable to parse ssm parameter: %w", err)
+	}
+
+	return seeds, nil
+}
+
+func (s *SSMProvider) write(seeds Seeds) error {
+	out, err := json.Marshal(seeds)
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal output for ssm: %w", err)
+	}
+
+	_, err = s.client.PutParameter(&ssm.PutParameterInput{
+		Name:      aws.String(s.Parameter),
+		Value:     aws.String(string(out)),
+		Type:      aws.String(ssm.ParameterTypeString),
+		Overwrite: aws.Bool(true),
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't put ssm parameter: %w", err)
+	}
+
+	return nil
+}
+
+// TTL returns how long a seed is kept in the parameter without being re-pushed
+func (s *SSMProvider) TTL() time.Duration {
+	return s.seedTTL
+}
@@ -0,0 +1,190 @@
+package seed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSSM implements GetParameter and PutParameter from the SSM JSON API
+type fakeSSM struct {
+	t *testing.T
+
+	lock       sync.Mutex
+	parameters map[string]string
+	denyReads  bool
+}
+
+func newFakeSSM(t *testing.T) (*fakeSSM, *httptest.Server) {
+	fake := &fakeSSM{
+		t:          t,
+		parameters: make(map[string]string),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func (f *fakeSSM) get(name string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.parameters[name]
+}
+
+func (f *fakeSSM) set(name string, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.parameters[name] = value
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDTEST/") {
+		awsJSONError(w, "UnrecognizedClientException")
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var request struct {
+		Name      string
+		Value     string
+		Type      string
+		Overwrite bool
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+
+	if err != nil {
+		awsJSONError(w, "ValidationException")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSSM.GetParameter":
+		if f.denyReads {
+			awsJSONError(w, "AccessDeniedException")
+			return
+		}
+
+		value, ok := f.parameters[request.Name]
+
+		if !ok {
+			awsJSONError(w, "ParameterNotFound")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Parameter": map[string]interface{}{
+				"Name":  request.Name,
+				"Type":  "String",
+				"Value": value,
+			},
+		})
+
+	case "AmazonSSM.PutParameter":
+		if _, ok := f.parameters[request.Name]; ok && !request.Overwrite {
+			awsJSONError(w, "ParameterAlreadyExists")
+			return
+		}
+
+		f.parameters[request.Name] = request.Value
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"Version": 1})
+
+	default:
+		f.t.Errorf("unexpected ssm request %s", r.Header.Get("X-Amz-Target"))
+		awsJSONError(w, "InvalidAction")
+	}
+}
+
+// awsJSONError writes a non-retryable error in the format used by AWS JSON
+// protocol APIs
+func awsJSONError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  code,
+		"message": code,
+	})
+}
+
+func newTestSSMProvider(t *testing.T, server *httptest.Server) *SSMProvider {
+	t.Helper()
+
+	provider, err := NewSSMProvider(map[string]interface{}{
+		"region":            "us-east-1",
+		"endpoint":          server.URL,
+		"access-key-id":     "AKIDTEST",
+		"secret-access-key": "secret",
+	})
+
+	if err != nil {
+		t.Fatalf("couldn't create ssm provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestSSMProviderContract(t *testing.T) {
+	_, server := newFakeSSM(t)
+
+	providerContract(t, func(t *testing.T) Provider {
+		return newTestSSMProvider(t, server)
+	})
+}
+
+func TestSSMProviderKeepsParameterAfterFailedRead(t *testing.T) {
+	fake, server := newFakeSSM(t)
+	provider := newTestSSMProvider(t, server)
+
+	existing := `{"seeds":[{"address":"10.0.0.2","port":"9999"}]}`
+	fake.set("/scrimplb/seeds", existing)
+
+	fake.lock.Lock()
+	fake.denyReads = true
+	fake.lock.Unlock()
+
+	err := provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Fatal("expected a push which couldn't read the parameter to fail")
+	}
+
+	if actual := fake.get("/scrimplb/seeds"); actual != existing {
+		t.Errorf("expected the parameter to be left alone after a failed read but got %s", actual)
+	}
+}
+
+func TestSSMProviderKeepsUnparseableParameter(t *testing.T) {
+	fake, server := newFakeSSM(t)
+	provider := newTestSSMProvider(t, server)
+
+	fake.set("/scrimplb/seeds", "not json")
+
+	_, err := provider.FetchSeed()
+
+	if err == nil {
+		t.Error("expected fetching an unparseable parameter to fail")
+	}
+
+	err = provider.PushSeed(staticResolver("10.0.0.1"), "9999")
+
+	if err == nil {
+		t.Error("expected pushing over an unparseable parameter to fail")
+	}
+
+	if actual := fake.get("/scrimplb/seeds"); actual != "not json" {
+		t.Errorf("expected the unparseable parameter to be left alone but got %s", actual)
+	}
+}
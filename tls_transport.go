@@ -0,0 +1,481 @@
+package scrimplb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// tlsHandshakeTimeout bounds how long an incoming stream can take to
+// complete a TLS handshake before it's dropped
+const tlsHandshakeTimeout = 10 * time.Second
+
+// maxConcurrentHandshakes limits how many incoming streams can be mid-handshake
+// at once; further streams are dropped until a handshake finishes
+const maxConcurrentHandshakes = 64
+
+// TransportTLSConfig enables mutual TLS for memberlist's TCP streams, which
+// carry push/pull state syncs, joins and large metadata. Every node presents a
+// certificate signed by the cluster CA, and its identity is taken from the
+// certificate's common name, or its first DNS SAN if the common name is empty.
+type TransportTLSConfig struct {
+	CAFile            string   `json:"ca-file"`
+	CertFile          string   `json:"cert-file"`
+	KeyFile           string   `json:"key-file"`
+	AllowedIdentities []string `json:"allowed-identities"`
+
+	tlsConfig *tls.Config
+	identity  string
+	roots     *x509.CertPool
+	peers     *peerIdentities
+}
+
+func initialiseTransportTLSConfig(config *TransportTLSConfig) error {
+	if config.CAFile == "" || config.CertFile == "" || config.KeyFile == "" {
+		return errors.New("transport-tls requires 'ca-file', 'cert-file' and 'key-file'")
+	}
+
+	caPEM, err := ioutil.ReadFile(config.CAFile)
+
+	if err != nil {
+		return fmt.Errorf("couldn't read transport CA: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", config.CAFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+
+	if err != nil {
+		return fmt.Errorf("couldn't load transport certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		return fmt.Errorf("couldn't parse transport certificate: %w", err)
+	}
+
+	config.identity = certificateIdentity(leaf)
+
+	if config.identity == "" {
+		return errors.New("transport certificate has no common name or DNS SAN to use as an identity")
+	}
+
+	config.roots = roots
+	config.peers = newPeerIdentities()
+
+	config.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// peers are dialled by IP and identified by certificate rather than
+		// by host name, so verification is done in VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := config.verifyPeer(rawCerts, roots)
+			return err
+		},
+	}
+
+	return nil
+}
+
+// streamTLSConfig returns a copy of the TLS config for a single stream, which
+// stores the peer's identity in identity once it has been verified
+func (c *TransportTLSConfig) streamTLSConfig(identity *string) *tls.Config {
+	config := c.tlsConfig.Clone()
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		var err error
+
+		*identity, err = c.verifyPeer(rawCerts, c.roots)
+		return err
+	}
+
+	return config
+}
+
+// certificateIdentity returns the certificate's common name, or its first DNS
+// SAN if it has no common name
+func certificateIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+
+	return ""
+}
+
+// verifyPeer checks that the peer's chain leads to the cluster CA and that its
+// identity is allowed, returning the identity
+func (c *TransportTLSConfig) verifyPeer(rawCerts [][]byte, roots *x509.CertPool) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("peer presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+
+		if err != nil {
+			return "", fmt.Errorf("couldn't parse peer certificate: %w", err)
+		}
+
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("peer certificate isn't signed by the cluster CA: %w", err)
+	}
+
+	identity := certificateIdentity(certs[0])
+
+	if identity == "" {
+		return "", errors.New("peer certificate has no identity")
+	}
+
+	if len(c.AllowedIdentities) == 0 {
+		return identity, nil
+	}
+
+	for _, allowed := range c.AllowedIdentities {
+		if identity == allowed {
+			return identity, nil
+		}
+	}
+
+	return "", fmt.Errorf("peer identity '%s' isn't allowed", identity)
+}
+
+// errUnverifiedPeer is returned for a node whose name hasn't been presented
+// in a certificate on any stream to or from its address
+var errUnverifiedPeer = errors.New("no stream to or from its address has presented a certificate for it")
+
+// peerIdentities records the identities verified on streams to and from each
+// IP address, so that a node can't announce itself under a name other than
+// the one in its certificate
+type peerIdentities struct {
+	lock       sync.Mutex
+	identities map[string]map[string]struct{}
+
+	// learn, if set, opens a stream to an unseen address in the background
+	// so that its identity is recorded. learning holds addresses for which
+	// this is in progress.
+	learn    func(addr string)
+	learning map[string]struct{}
+}
+
+func newPeerIdentities() *peerIdentities {
+	return &peerIdentities{
+		identities: make(map[string]map[string]struct{}),
+		learning:   make(map[string]struct{}),
+	}
+}
+
+// record stores an identity verified on a stream to or from the given host
+func (p *peerIdentities) record(host string, identity string) {
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	identities, ok := p.identities[host]
+
+	if !ok {
+		identities = make(map[string]struct{})
+		p.identities[host] = identities
+	}
+
+	identities[identity] = struct{}{}
+}
+
+// verify returns errUnverifiedPeer unless a stream to or from the given
+// address has presented a certificate for name. A stream is then opened to the
+// given port in the background, recording the identity of whichever node is
+// listening there, so that a later alive message from a genuine node can be
+// verified. Several nodes can share an address, so a name which hasn't been
+// seen at an address isn't necessarily an impersonation.
+func (p *peerIdentities) verify(name string, addr net.IP, port uint16) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.identities[addr.String()][name]; ok {
+		return nil
+	}
+
+	p.startLearning(net.JoinHostPort(addr.String(), strconv.Itoa(int(port))))
+
+	return fmt.Errorf("couldn't verify '%s' at %s: %w", name, addr, errUnverifiedPeer)
+}
+
+// startLearning must be called with the lock held
+func (p *peerIdentities) startLearning(addr string) {
+	if p.learn == nil || len(p.learning) >= maxConcurrentHandshakes {
+		return
+	}
+
+	if _, ok := p.learning[addr]; ok {
+		return
+	}
+
+	p.learning[addr] = struct{}{}
+
+	go func() {
+		p.learn(addr)
+
+		p.lock.Lock()
+		delete(p.learning, addr)
+		p.lock.Unlock()
+	}()
+}
+
+// TLSTransport is a memberlist Transport which sends packets (gossip and
+// probes) over UDP exactly as memberlist's NetTransport does, but runs every
+// TCP stream over mutual TLS. Packets are only encrypted if a keyring is
+// configured.
+type TLSTransport struct {
+	*memberlist.NetTransport
+
+	config     *TransportTLSConfig
+	streamCh   chan net.Conn
+	handshakes chan struct{}
+
+	shutdown     chan struct{}
+	stopped      chan struct{}
+	shutdownOnce sync.Once
+	wg           sync.WaitGroup
+}
+
+// NewTLSTransport listens on the given address and port, upgrading streams to
+// TLS using the given config
+func NewTLSTransport(config *TransportTLSConfig, bindAddr string, bindPort int) (*TLSTransport, error) {
+	if config.tlsConfig == nil {
+		err := initialiseTransportTLSConfig(config)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	netTransport, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{bindAddr},
+		BindPort:  bindPort,
+		Logger:    log.New(os.Stderr, "", log.LstdFlags),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create transport: %w", err)
+	}
+
+	transport := &TLSTransport{
+		NetTransport: netTransport,
+		config:       config,
+		streamCh:     make(chan net.Conn),
+		handshakes:   make(chan struct{}, maxConcurrentHandshakes),
+		shutdown:     make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	config.peers.learn = transport.learnIdentity
+
+	transport.wg.Add(1)
+	go transport.acceptStreams()
+
+	return transport, nil
+}
+
+// learnIdentity opens and immediately closes a stream to addr, recording the
+// identity in the peer's certificate
+func (t *TLSTransport) learnIdentity(addr string) {
+	conn, err := t.DialTimeout(addr, tlsHandshakeTimeout)
+
+	if err != nil {
+		log.Printf("couldn't verify identity of %s: %v\n", addr, err)
+		return
+	}
+
+	conn.Close()
+}
+
+// acceptStreams completes the TLS handshake for each incoming stream before
+// passing it to memberlist. Handshakes happen concurrently so a slow or
+// malicious peer can't hold up others, up to maxConcurrentHandshakes at once.
+// During shutdown, streams are closed until the underlying transport has
+// stopped accepting them.
+func (t *TLSTransport) acceptStreams() {
+	defer t.wg.Done()
+
+	for {
+		select {
+		case conn := <-t.NetTransport.StreamCh():
+			select {
+			case <-t.shutdown:
+				conn.Close()
+				continue
+
+			default:
+			}
+
+			select {
+			case t.handshakes <- struct{}{}:
+
+			default:
+				log.Printf("rejecting stream from %s: too many handshakes in progress\n", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+
+			t.wg.Add(1)
+			go t.handshake(conn)
+
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+// handshake completes the TLS handshake for an incoming stream, recording the
+// peer's identity against its address before memberlist reads from it
+func (t *TLSTransport) handshake(conn net.Conn) {
+	defer t.wg.Done()
+
+	var identity string
+
+	tlsConn := tls.Server(conn, t.config.streamTLSConfig(&identity))
+
+	err := tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+
+	<-t.handshakes
+
+	if err != nil {
+		log.Printf("rejecting stream from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	// memberlist sets its own deadlines once it has the stream
+	err = tlsConn.SetDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	t.config.peers.record(host, identity)
+
+	select {
+	case t.streamCh <- tlsConn:
+
+	case <-t.shutdown:
+		conn.Close()
+	}
+}
+
+// StreamCh returns incoming streams which have completed a TLS handshake with
+// a verified peer
+func (t *TLSTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// DialTimeout opens a stream to the given address and completes a TLS
+// handshake, verifying the peer's certificate and recording its identity
+// against the address, within the timeout
+func (t *TLSTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.NetTransport.DialTimeout(addr, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var identity string
+
+	tlsConn := tls.Client(conn, t.config.streamTLSConfig(&identity))
+
+	err = tlsConn.SetDeadline(deadline)
+
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+
+	err = tlsConn.SetDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.config.peers.record(host, identity)
+
+	return tlsConn, nil
+}
+
+// Shutdown stops accepting streams, closes all listeners and waits for any
+// handshakes in progress to finish
+func (t *TLSTransport) Shutdown() error {
+	var err error
+
+	t.shutdownOnce.Do(func() {
+		close(t.shutdown)
+		err = t.NetTransport.Shutdown()
+		close(t.stopped)
+		t.wg.Wait()
+	})
+
+	return err
+}
@@ -0,0 +1,282 @@
+package scrimplb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// newTestCertificate creates a certificate for the given common name, signed
+// by parent or self-signed if parent is nil
+func newTestCertificate(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := template, interface{}(key)
+
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+
+	if err != nil {
+		t.Fatalf("couldn't create certificate: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(raw)
+
+	if err != nil {
+		t.Fatalf("couldn't parse certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeTestPEM writes a PEM block to a new file in dir, returning its path
+func writeTestPEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+
+	if err != nil {
+		t.Fatalf("couldn't write %s: %v", name, err)
+	}
+
+	return path
+}
+
+// newTestTLSConfig writes the CA and a new certificate for identity to files,
+// returning config which refers to them
+func newTestTLSConfig(t *testing.T, ca *tls.Certificate, identity string) *TransportTLSConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	cert := newTestCertificate(t, identity, ca)
+
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+
+	if err != nil {
+		t.Fatalf("couldn't marshal key: %v", err)
+	}
+
+	return &TransportTLSConfig{
+		CAFile:   writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", ca.Certificate[0]),
+		CertFile: writeTestPEM(t, dir, "cert.pem", "CERTIFICATE", cert.Certificate[0]),
+		KeyFile:  writeTestPEM(t, dir, "key.pem", "EC PRIVATE KEY", key),
+	}
+}
+
+func newTestTLSTransport(t *testing.T, ca *tls.Certificate, identity string) *TLSTransport {
+	t.Helper()
+
+	transport, err := NewTLSTransport(newTestTLSConfig(t, ca, identity), "127.0.0.1", 0)
+
+	if err != nil {
+		t.Fatalf("couldn't create transport: %v", err)
+	}
+
+	t.Cleanup(func() {
+		transport.Shutdown()
+	})
+
+	return transport
+}
+
+func dialTestTransport(t *testing.T, from *TLSTransport, to *TLSTransport) error {
+	t.Helper()
+
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(to.GetAutoBindPort()))
+
+	conn, err := from.DialTimeout(addr, time.Second)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	select {
+	case accepted := <-to.StreamCh():
+		accepted.Close()
+		return nil
+
+	case <-time.After(time.Second):
+		return errors.New("stream wasn't accepted")
+	}
+}
+
+func TestTLSTransportRecordsPeerIdentities(t *testing.T) {
+	ca := newTestCertificate(t, "cluster-ca", nil)
+
+	lb := newTestTLSTransport(t, &ca, "lb1")
+	backend := newTestTLSTransport(t, &ca, "backend1")
+
+	err := dialTestTransport(t, lb, backend)
+
+	if err != nil {
+		t.Fatalf("couldn't open stream: %v", err)
+	}
+
+	admission := &admissionDelegate{localName: "lb1", peers: lb.config.peers}
+
+	err = admission.NotifyAlive(&memberlist.Node{Name: "imposter", Addr: net.ParseIP("127.0.0.1")})
+
+	if err == nil {
+		t.Error("expected a node announcing a name other than its certificate's to be rejected")
+	}
+
+	err = backend.config.peers.verify("lb1", net.ParseIP("127.0.0.1"), 0)
+
+	if err != nil {
+		t.Errorf("expected the dialling peer's identity to be recorded: %v", err)
+	}
+
+	err = lb.config.peers.verify("backend1", net.ParseIP("127.0.0.1"), 0)
+
+	if err != nil {
+		t.Errorf("expected the dialled peer's identity to be recorded: %v", err)
+	}
+
+	err = lb.config.peers.verify("backend2", net.ParseIP("10.0.0.2"), 0)
+
+	if !errors.Is(err, errUnverifiedPeer) {
+		t.Errorf("expected a node at an unseen address to be rejected but got %v", err)
+	}
+}
+
+func TestTLSTransportRejectsUnverifiedAliveMessages(t *testing.T) {
+	ca := newTestCertificate(t, "cluster-ca", nil)
+
+	lb := newTestTLSTransport(t, &ca, "lb1")
+	backend := newTestTLSTransport(t, &ca, "backend1")
+
+	// the stream the load balancer opens to learn the backend's identity
+	go func() {
+		for conn := range backend.StreamCh() {
+			conn.Close()
+		}
+	}()
+
+	admission := &admissionDelegate{localName: "lb1", peers: lb.config.peers}
+
+	alive := newTestBackendNode(t, "backend1", time.Now(), "www.example.com")
+	alive.Addr = net.ParseIP("127.0.0.1")
+	alive.Port = uint16(backend.GetAutoBindPort())
+
+	err := admission.NotifyAlive(alive)
+
+	if !errors.Is(err, errUnverifiedPeer) {
+		t.Fatalf("expected an alive message from an address which hasn't opened a stream to be rejected but got %v", err)
+	}
+
+	err = admission.NotifyMerge([]*memberlist.Node{alive})
+
+	if err != nil {
+		t.Errorf("expected an unverified node not to cancel a merge: %v", err)
+	}
+
+	// the load balancer learns the backend's identity in the background
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		err = admission.NotifyAlive(alive)
+
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Fatalf("expected the alive message to be accepted once the node's identity was verified: %v", err)
+	}
+
+	imposter := newTestBackendNode(t, "imposter", time.Now(), "www.example.com")
+	imposter.Addr = alive.Addr
+	imposter.Port = alive.Port
+
+	err = admission.NotifyAlive(imposter)
+
+	if err == nil {
+		t.Error("expected another name at the verified address to be rejected")
+	}
+}
+
+func TestTLSClusterVerifiesNodesLearnedByGossip(t *testing.T) {
+	ca := newTestCertificate(t, "cluster-ca", nil)
+
+	var nodes []*Node
+
+	for i := 0; i < 3; i++ {
+		tlsConfig := newTestTLSConfig(t, &ca, fmt.Sprintf("lb%d", i))
+		provider := ""
+
+		// later nodes only join the first, so they learn of each other
+		// through gossip before they've opened a stream to each other
+		if i > 0 {
+			provider = fmt.Sprintf(`"provider": "manual", "provider-config": {"ip": "127.0.0.1", "port": "%d"},`, nodes[0].LocalNode().Port)
+		}
+
+		node := newTestNode(t, fmt.Sprintf(`{
+			"lb": true, "bind-address": "127.0.0.1", "port": "0", "resolver": "dummy", "leave-timeout": "1s", %s
+			"transport-tls": {"ca-file": %q, "cert-file": %q, "key-file": %q}
+		}`, provider, tlsConfig.CAFile, tlsConfig.CertFile, tlsConfig.KeyFile))
+
+		err := node.Start(context.Background())
+
+		if err != nil {
+			t.Fatalf("couldn't start node %d: %v", i, err)
+		}
+
+		t.Cleanup(func() { node.Stop(context.Background()) })
+
+		nodes = append(nodes, node)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for _, node := range nodes {
+		for len(node.Members()) != 3 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if members := len(node.Members()); members != 3 {
+			t.Errorf("expected %s to verify and admit every node but it has %d members", node.LocalNode().Name, members)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package scrimplb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout     = "10s"
+	defaultWebhookMaxAttempts = 5
+
+	webhookInitialBackoff = 1 * time.Second
+	webhookMaxBackoff     = 60 * time.Second
+	webhookQueueSize      = 64
+
+	// WebhookSignatureHeader carries the hex-encoded HMAC-SHA256 of the request
+	// body, keyed with the webhook's secret and prefixed with "sha256="
+	WebhookSignatureHeader = "X-Scrimplb-Signature"
+
+	// WebhookEventHeader carries the event type of the request body
+	WebhookEventHeader = "X-Scrimplb-Event"
+)
+
+// WebhookConfig describes a URL which is sent a JSON POST request for each
+// matching event on a load balancer.
+type WebhookConfig struct {
+	URL         string        `json:"url"`
+	Secret      string        `json:"secret"`
+	EventsRaw   []string      `json:"events"`
+	TimeoutRaw  string        `json:"timeout"`
+	MaxAttempts int           `json:"max-attempts"`
+	Events      []EventType   `json:"-"`
+	Timeout     time.Duration `json:"-"`
+}
+
+func initialiseWebhookConfig(webhook *WebhookConfig) error {
+	parsedURL, err := url.Parse(webhook.URL)
+
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return fmt.Errorf("webhook url '%s' must be http or https", webhook.URL)
+	}
+
+	webhook.Events = nil
+
+	for _, name := range webhook.EventsRaw {
+		eventType, err := parseEventType(name)
+
+		if err != nil {
+			return err
+		}
+
+		webhook.Events = append(webhook.Events, eventType)
+	}
+
+	if webhook.TimeoutRaw == "" {
+		webhook.TimeoutRaw = defaultWebhookTimeout
+	}
+
+	webhook.Timeout, err = time.ParseDuration(webhook.TimeoutRaw)
+
+	if err != nil {
+		return fmt.Errorf("invalid webhook timeout: %w", err)
+	}
+
+	if webhook.MaxAttempts == 0 {
+		webhook.MaxAttempts = defaultWebhookMaxAttempts
+	}
+
+	if webhook.MaxAttempts < 0 {
+		return errors.New("webhook max-attempts must be positive")
+	}
+
+	return nil
+}
+
+func parseEventType(name string) (EventType, error) {
+	for t := EventBackendJoined; t <= EventDomainConflictsChanged; t++ {
+		if strings.EqualFold(name, t.String()) {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown event type '%s' in webhook config", name)
+}
+
+// wants returns true if the webhook should be sent the given event type. A
+// webhook with no event filter is sent every event.
+func (w *WebhookConfig) wants(eventType EventType) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookPayload is the JSON body sent to webhooks
+type WebhookPayload struct {
+	Event       string            `json:"event"`
+	Time        time.Time         `json:"time"`
+	Upstream    *WebhookUpstream  `json:"upstream,omitempty"`
+	Application *JSONApplication  `json:"application,omitempty"`
+	Backends    int               `json:"backends"`
+	Error       string            `json:"error,omitempty"`
+	Conflicts   []WebhookConflict `json:"conflicts,omitempty"`
+}
+
+// WebhookConflict describes a domain conflict by application name
+type WebhookConflict struct {
+	Domain     string   `json:"domain"`
+	ListenPort string   `json:"listen-port"`
+	Allowed    []string `json:"allowed"`
+	Excluded   []string `json:"excluded"`
+}
+
+// WebhookUpstream identifies the backend an event relates to
+type WebhookUpstream struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+func newWebhookPayload(event Event) WebhookPayload {
+	payload := WebhookPayload{
+		Event:    event.Type.String(),
+		Time:     event.Time,
+		Backends: event.New.Len(),
+	}
+
+	switch event.Type {
+	case EventBackendJoined, EventBackendLeft, EventBackendUpdated, EventApplicationAdded, EventApplicationRemoved:
+		payload.Upstream = &WebhookUpstream{
+			Name:    event.Upstream.Name,
+			Address: event.Upstream.Address,
+		}
+	}
+
+	if event.Type == EventApplicationAdded || event.Type == EventApplicationRemoved {
+		payload.Application = &JSONApplication{
+			Name:            event.Application.Name,
+			ListenPort:      event.Application.ListenPort,
+			ApplicationPort: event.Application.ApplicationPort,
+			Protocol:        event.Application.Protocol,
+			Domains:         event.Application.DomainSlice(),
+		}
+
+		if event.Application.UpstreamVerify || event.Application.UpstreamServerName != "" {
+			payload.Application.UpstreamTLS = &JSONUpstreamTLS{
+				Verify:     event.Application.UpstreamVerify,
+				ServerName: event.Application.UpstreamServerName,
+			}
+		}
+	}
+
+	if event.Err != nil {
+		payload.Error = event.Err.Error()
+	}
+
+	payload.Conflicts = newWebhookConflicts(event.Conflicts)
+
+	return payload
+}
+
+func newWebhookConflicts(conflicts []DomainConflict) []WebhookConflict {
+	var out []WebhookConflict
+
+	for _, conflict := range conflicts {
+		c := WebhookConflict{
+			Domain:     conflict.Domain,
+			ListenPort: conflict.ListenPort,
+		}
+
+		for _, app := range conflict.Allowed {
+			c.Allowed = append(c.Allowed, app.Name)
+		}
+
+		for _, app := range conflict.Excluded {
+			c.Excluded = append(c.Excluded, app.Name)
+		}
+
+		out = append(out, c)
+	}
+
+	return out
+}
+
+// WebhookDispatcher delivers events from an EventBus to configured webhooks.
+// Each webhook has its own queue and delivers events in order, retrying with
+// exponential backoff, so a slow or failing receiver doesn't hold up others.
+type WebhookDispatcher struct {
+	webhooks []*WebhookConfig
+	client   *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWebhookDispatcher creates a dispatcher for the given webhooks, which
+// must already have been initialised by loading config
+func NewWebhookDispatcher(webhooks []*WebhookConfig) *WebhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &WebhookDispatcher{
+		webhooks: webhooks,
+		client:   &http.Client{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start subscribes to the given bus and starts delivering events
+func (d *WebhookDispatcher) Start(bus *EventBus) {
+	for _, webhook := range d.webhooks {
+		events, unsubscribe := bus.Subscribe(webhookQueueSize)
+
+		d.wg.Add(1)
+		go d.deliverLoop(webhook, events, unsubscribe)
+	}
+}
+
+// Flush waits until every event published before the bus was closed has been
+// delivered or given up on, returning an error if ctx is done first
+func (d *WebhookDispatcher) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop abandons any undelivered events and waits for in-flight requests to
+// finish
+func (d *WebhookDispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *WebhookDispatcher) deliverLoop(webhook *WebhookConfig, events <-chan Event, unsubscribe func()) {
+	defer d.wg.Done()
+	defer unsubscribe()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if !webhook.wants(event.Type) {
+				continue
+			}
+
+			err := d.deliver(webhook, event)
+
+			if err != nil {
+				log.Printf("giving up on %v webhook to %s: %v\n", event.Type, webhook.URL, err)
+			}
+
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(webhook *WebhookConfig, event Event) error {
+	body, err := json.Marshal(newWebhookPayload(event))
+
+	if err != nil {
+		return fmt.Errorf("couldn't marshal webhook payload: %w", err)
+	}
+
+	backoff := webhookInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err = d.send(webhook, event.Type, body)
+
+		if err == nil {
+			return nil
+		}
+
+		if d.ctx.Err() != nil {
+			return d.ctx.Err()
+		}
+
+		if attempt >= webhook.MaxAttempts {
+			return fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+
+		log.Printf("attempt %d of %v webhook to %s failed, retrying in %v: %v\n", attempt, event.Type, webhook.URL, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		}
+
+		backoff *= 2
+
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (d *WebhookDispatcher) send(webhook *WebhookConfig, eventType EventType, body []byte) error {
+	ctx, cancel := context.WithTimeout(d.ctx, webhook.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("couldn't create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, eventType.String())
+
+	if webhook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signWebhookBody(webhook.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
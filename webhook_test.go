@@ -0,0 +1,249 @@
+package scrimplb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// newWebhookReceiver starts a server which records every request it's sent,
+// failing the first failures requests with a 500
+func newWebhookReceiver(t *testing.T, failures int) (*httptest.Server, <-chan webhookRequest) {
+	requests := make(chan webhookRequest, 16)
+
+	var lock sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			t.Errorf("couldn't read webhook body: %v", err)
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON webhook but got %q", r.Header.Get("Content-Type"))
+		}
+
+		requests <- webhookRequest{
+			event:     r.Header.Get(WebhookEventHeader),
+			signature: r.Header.Get(WebhookSignatureHeader),
+			body:      body,
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func newTestWebhook(t *testing.T, webhook WebhookConfig) *WebhookConfig {
+	t.Helper()
+
+	err := initialiseWebhookConfig(&webhook)
+
+	if err != nil {
+		t.Fatalf("couldn't initialise webhook config: %v", err)
+	}
+
+	return &webhook
+}
+
+func receiveWebhook(t *testing.T, requests <-chan webhookRequest) webhookRequest {
+	t.Helper()
+
+	select {
+	case request := <-requests:
+		return request
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+		return webhookRequest{}
+	}
+}
+
+func TestWebhookDispatcherSignsAndFilters(t *testing.T) {
+	server, requests := newWebhookReceiver(t, 0)
+
+	webhook := newTestWebhook(t, WebhookConfig{
+		URL:       server.URL,
+		Secret:    "hunter2",
+		EventsRaw: []string{"backend-joined"},
+	})
+
+	bus := NewEventBus()
+	dispatcher := NewWebhookDispatcher([]*WebhookConfig{webhook})
+	dispatcher.Start(bus)
+	defer dispatcher.Stop()
+
+	bus.Publish(
+		Event{Type: EventGeneratorSucceeded, Time: time.Now()},
+		Event{Type: EventBackendJoined, Time: time.Now(), Upstream: Upstream{Name: "backend1", Address: "10.0.0.1"}},
+	)
+
+	request := receiveWebhook(t, requests)
+
+	if request.event != "backend-joined" {
+		t.Errorf("expected only the backend-joined event to be sent but got %s", request.event)
+	}
+
+	if expected := "sha256=" + signWebhookBody("hunter2", request.body); request.signature != expected {
+		t.Errorf("expected signature %s but got %s", expected, request.signature)
+	}
+
+	var payload WebhookPayload
+
+	err := json.Unmarshal(request.body, &payload)
+
+	if err != nil {
+		t.Fatalf("couldn't parse webhook payload: %v", err)
+	}
+
+	if payload.Event != "backend-joined" || payload.Upstream == nil || payload.Upstream.Name != "backend1" || payload.Upstream.Address != "10.0.0.1" {
+		t.Errorf("unexpected payload %s", request.body)
+	}
+
+	select {
+	case request := <-requests:
+		t.Errorf("expected a filtered event not to be sent but got %s", request.event)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookDispatcherRetries(t *testing.T) {
+	server, requests := newWebhookReceiver(t, 1)
+
+	webhook := newTestWebhook(t, WebhookConfig{
+		URL:         server.URL,
+		MaxAttempts: 2,
+	})
+
+	bus := NewEventBus()
+	dispatcher := NewWebhookDispatcher([]*WebhookConfig{webhook})
+	dispatcher.Start(bus)
+	defer dispatcher.Stop()
+
+	bus.Publish(Event{Type: EventGeneratorFailed, Time: time.Now(), Err: errors.New("nginx didn't restart")})
+
+	first := receiveWebhook(t, requests)
+	second := receiveWebhook(t, requests)
+
+	if first.signature != "" {
+		t.Errorf("expected no signature without a secret but got %s", first.signature)
+	}
+
+	if string(first.body) != string(second.body) {
+		t.Errorf("expected a retry to resend the same body, but got %s and %s", first.body, second.body)
+	}
+
+	var payload WebhookPayload
+
+	err := json.Unmarshal(second.body, &payload)
+
+	if err != nil {
+		t.Fatalf("couldn't parse webhook payload: %v", err)
+	}
+
+	if payload.Event != "generator-failed" || payload.Error != "nginx didn't restart" {
+		t.Errorf("unexpected payload %s", second.body)
+	}
+}
+
+func TestWebhookDispatcherFlushesQueuedEvents(t *testing.T) {
+	server, requests := newWebhookReceiver(t, 0)
+	webhook := newTestWebhook(t, WebhookConfig{URL: server.URL})
+
+	bus := NewEventBus()
+	dispatcher := NewWebhookDispatcher([]*WebhookConfig{webhook})
+	dispatcher.Start(bus)
+	defer dispatcher.Stop()
+
+	bus.Publish(
+		Event{Type: EventBackendLeft, Time: time.Now()},
+		Event{Type: EventGeneratorSucceeded, Time: time.Now()},
+	)
+
+	bus.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := dispatcher.Flush(ctx)
+
+	if err != nil {
+		t.Fatalf("couldn't flush webhooks: %v", err)
+	}
+
+	// both events were delivered before Flush returned
+	for _, expected := range []string{"backend-left", "generator-succeeded"} {
+		select {
+		case request := <-requests:
+			if request.event != expected {
+				t.Errorf("expected a %s webhook but got %s", expected, request.event)
+			}
+
+		default:
+			t.Fatalf("expected a %s webhook to have been delivered by the flush", expected)
+		}
+	}
+}
+
+func TestWebhookDispatcherFlushGivesUp(t *testing.T) {
+	webhook := newTestWebhook(t, WebhookConfig{URL: "http://127.0.0.1:1", MaxAttempts: 10})
+
+	bus := NewEventBus()
+	dispatcher := NewWebhookDispatcher([]*WebhookConfig{webhook})
+	dispatcher.Start(bus)
+
+	bus.Publish(Event{Type: EventGeneratorSucceeded, Time: time.Now()})
+	bus.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := dispatcher.Flush(ctx)
+
+	if err == nil {
+		t.Error("expected flushing an undeliverable webhook with a cancelled context to fail")
+	}
+
+	dispatcher.Stop()
+}
+
+func TestInitialiseWebhookConfigErrors(t *testing.T) {
+	for _, webhook := range []WebhookConfig{
+		{URL: "ftp://example.com"},
+		{URL: "https://example.com", EventsRaw: []string{"backend-exploded"}},
+		{URL: "https://example.com", TimeoutRaw: "soon"},
+		{URL: "https://example.com", MaxAttempts: -1},
+	} {
+		err := initialiseWebhookConfig(&webhook)
+
+		if err == nil {
+			t.Errorf("expected webhook config %+v to be rejected", webhook)
+		}
+	}
+}